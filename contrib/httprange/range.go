@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"net/textproto"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -109,3 +110,24 @@ func ParseRange(s string, size int64) ([]Range, error) { // nolint:gocognit
 	}
 	return ranges, nil
 }
+
+// Coalesce sorts ranges by their start and merges those that overlap or are
+// adjacent, as allowed by RFC 7233 Section 4.1.
+func Coalesce(ranges []Range) []Range {
+	sorted := make([]Range, len(ranges))
+	copy(sorted, ranges)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Start < sorted[j].Start
+	})
+	var res []Range
+	for _, r := range sorted {
+		if n := len(res); n > 0 && r.Start <= res[n-1].Start+res[n-1].Length {
+			if end := r.Start + r.Length; end > res[n-1].Start+res[n-1].Length {
+				res[n-1].Length = end - res[n-1].Start
+			}
+			continue
+		}
+		res = append(res, r)
+	}
+	return res
+}
@@ -111,3 +111,42 @@ func TestParseRange(t *testing.T) {
 		})
 	}
 }
+
+func TestCoalesce(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges []Range
+		want   []Range
+	}{
+		{
+			name: "blank",
+		},
+		{
+			name:   "disjoint",
+			ranges: []Range{{Start: 10, Length: 5}, {Start: 0, Length: 5}},
+			want:   []Range{{Start: 0, Length: 5}, {Start: 10, Length: 5}},
+		},
+		{
+			name:   "overlapping",
+			ranges: []Range{{Start: 0, Length: 10}, {Start: 5, Length: 10}},
+			want:   []Range{{Start: 0, Length: 15}},
+		},
+		{
+			name:   "adjacent",
+			ranges: []Range{{Start: 5, Length: 5}, {Start: 0, Length: 5}},
+			want:   []Range{{Start: 0, Length: 10}},
+		},
+		{
+			name:   "contained",
+			ranges: []Range{{Start: 0, Length: 100}, {Start: 10, Length: 5}, {Start: 200, Length: 1}},
+			want:   []Range{{Start: 0, Length: 100}, {Start: 200, Length: 1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Coalesce(tt.ranges); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Coalesce() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,15 +1,27 @@
 package env
 
 import (
+	"time"
+
 	"github.com/kelseyhightower/envconfig"
 )
 
 var Env EnvConfig
 
 type EnvConfig struct {
-	HTTPAddress string `default:"0.0.0.0"`
-	HTTPPort    uint16 `default:"3000"`
-	Root        string `required:"true"`
+	// ContentMaxSize limits how much of a text file is indexed
+	ContentMaxSize int64  `default:"1048576"`
+	HTTPAddress    string `default:"0.0.0.0"`
+	HTTPPort       uint16 `default:"3000"`
+	// IndexWorkers defaults to the number of CPUs
+	IndexWorkers int `default:"0"`
+	// IndexBatchDocs and IndexBatchBytes limit the changes written to the
+	// index at once, 0 for no limit
+	IndexBatchDocs  int           `default:"1000"`
+	IndexBatchBytes int           `default:"16777216"`
+	Root            string        `required:"true"`
+	Watch           bool          `default:"true"`
+	WatchDebounce   time.Duration `default:"2s"`
 }
 
 func Process() error {
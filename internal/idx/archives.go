@@ -1,47 +1,447 @@
 package idx
 
 import (
+	"archive/tar"
 	"archive/zip"
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/fatalbanana/filetundra/internal/log"
 	"github.com/fatalbanana/filetundra/internal/properties"
 
 	"github.com/blugelabs/bluge"
+	"github.com/bodgit/sevenzip"
+	"github.com/h2non/filetype"
 	"github.com/h2non/filetype/matchers"
 	"github.com/h2non/filetype/types"
+	"github.com/klauspost/compress/zstd"
+	"github.com/nwaples/rardecode"
+	"github.com/ulikunitz/xz"
 	"go.uber.org/zap"
 )
 
-func getZipFiles(fpath string) ([]string, error) {
-	z, err := zip.OpenReader(fpath)
-	if err != nil {
-		return []string{}, err
-	}
-	zipNumFiles := len(z.File)
-	res := make([]string, zipNumFiles)
-	for i := 0; i < zipNumFiles; i++ {
-		res[i] = z.File[i].FileHeader.Name
+var (
+	archiveMimeMap = map[types.Type]struct{}{
+		matchers.Type7z:   {},
+		matchers.TypeAr:   {},
+		matchers.TypeBz2:  {},
+		matchers.TypeDeb:  {},
+		matchers.TypeGz:   {},
+		matchers.TypeRar:  {},
+		matchers.TypeRpm:  {},
+		matchers.TypeTar:  {},
+		matchers.TypeXz:   {},
+		matchers.TypeZip:  {},
+		matchers.TypeZstd: {},
 	}
-	return res, z.Close()
+
+	ErrMemberNotFound = errors.New("archive member was not found")
+
+	errStopArchiveWalk        = errors.New("stop walking archive")
+	errUnhandledArchiveFormat = errors.New("unhandled archive format")
+)
+
+// ArchiveMember describes a file stored inside an archive. Size is -1 if
+// it can't be known without decompressing the member.
+type ArchiveMember struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
 }
 
-func maybeProcessArchive(fpath string, fType types.Type, doc *bluge.Document) {
-	var res []string
-	var err error
+// archiveVisitor is called for each member of an archive. open returns the
+// contents of the member, which may only be read until the visitor returns.
+// Returning errStopArchiveWalk ends the walk without error.
+type archiveVisitor func(m ArchiveMember, open func() (io.Reader, error)) error
 
+// walkArchive streams through the members of the archive at fpath.
+func walkArchive(fpath string, fType types.Type, visit archiveVisitor) error {
+	var err error
 	switch fType {
 	case matchers.TypeZip:
-		res, err = getZipFiles(fpath)
+		err = walkZip(fpath, visit)
+	case matchers.Type7z:
+		err = walk7z(fpath, visit)
+	default:
+		err = walkStream(fpath, fType, visit)
+	}
+	if err == errStopArchiveWalk {
+		return nil
+	}
+	return err
+}
+
+func walkStream(fpath string, fType types.Type, visit archiveVisitor) error {
+	f, err := os.Open(fpath) // #nosec: shut up
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := f.Close()
 		if err != nil {
-			log.Logger.Error("error reading zip file contents",
+			log.Logger.Error("error closing file",
 				zap.String("path", fpath), zap.Error(err))
-			return
 		}
-	default:
-		return
+	}()
+
+	switch fType {
+	case matchers.TypeRar:
+		return walkRar(f, visit)
+	case matchers.TypeTar:
+		return walkTar(f, visit)
+	case matchers.TypeAr, matchers.TypeDeb:
+		// both types match Debian packages
+		br := bufio.NewReader(f)
+		head, err := br.Peek(len(debMagic))
+		if err == nil && string(head) == debMagic {
+			return walkDeb(br, visit)
+		}
+		return walkAr(br, visit)
+	case matchers.TypeRpm:
+		return walkRpm(f, visit)
+	case matchers.TypeBz2, matchers.TypeGz, matchers.TypeXz, matchers.TypeZstd:
+		name, err := compressedMemberName(f, fType)
+		if err != nil {
+			return err
+		}
+		return walkCompressed(f, fType, name, visit)
 	}
+	return errUnhandledArchiveFormat
+}
 
-	for _, e := range res {
-		doc.AddField(bluge.NewTextField(properties.ArchiveFilename, e).StoreValue())
+func walkZip(fpath string, visit archiveVisitor) error {
+	f, err := os.Open(fpath) // #nosec: shut up
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	si, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	z, err := zip.NewReader(f, si.Size())
+	if err != nil {
+		return err
+	}
+	for _, zf := range z.File {
+		zf := zf
+		var rc io.ReadCloser
+		m := ArchiveMember{
+			Name:    zf.Name,
+			Size:    int64(zf.UncompressedSize64),
+			ModTime: zf.Modified,
+			IsDir:   zf.FileInfo().IsDir(),
+		}
+		err = visit(m, func() (io.Reader, error) {
+			if zf.Method == zip.Store {
+				// stored members can be read at random
+				offset, err := zf.DataOffset()
+				if err != nil {
+					return nil, err
+				}
+				return io.NewSectionReader(f, offset, m.Size), nil
+			}
+			var err error
+			rc, err = zf.Open()
+			return rc, err
+		})
+		if rc != nil {
+			rc.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walk7z(fpath string, visit archiveVisitor) error {
+	z, err := sevenzip.OpenReader(fpath)
+	if err != nil {
+		return err
+	}
+	defer z.Close()
+	for _, zf := range z.File {
+		zf := zf
+		var rc io.ReadCloser
+		m := ArchiveMember{
+			Name:    zf.Name,
+			Size:    int64(zf.UncompressedSize),
+			ModTime: zf.Modified,
+			IsDir:   zf.FileInfo().IsDir(),
+		}
+		err = visit(m, func() (io.Reader, error) {
+			var err error
+			rc, err = zf.Open()
+			return rc, err
+		})
+		if rc != nil {
+			rc.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkRar(r io.Reader, visit archiveVisitor) error {
+	rr, err := rardecode.NewReader(r, "")
+	if err != nil {
+		return err
+	}
+	for {
+		hdr, err := rr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		m := ArchiveMember{
+			Name:    hdr.Name,
+			Size:    hdr.UnPackedSize,
+			ModTime: hdr.ModificationTime,
+			IsDir:   hdr.IsDir,
+		}
+		if hdr.UnKnownSize {
+			m.Size = -1
+		}
+		err = visit(m, func() (io.Reader, error) {
+			return rr, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func walkTar(r io.Reader, visit archiveVisitor) error {
+	// members of uncompressed tarballs can be read at random
+	ra, seekable := r.(io.ReaderAt)
+	cr := &countingReader{r: r}
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		m := ArchiveMember{
+			Name:    hdr.Name,
+			Size:    hdr.Size,
+			ModTime: hdr.ModTime,
+			IsDir:   hdr.Typeflag == tar.TypeDir,
+		}
+		offset := cr.n
+		err = visit(m, func() (io.Reader, error) {
+			if seekable && hdr.Typeflag == tar.TypeReg && !isSparseTarMember(hdr) {
+				return io.NewSectionReader(ra, offset, hdr.Size), nil
+			}
+			return tr, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func isSparseTarMember(hdr *tar.Header) bool {
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+func newDecompressor(r io.Reader, fType types.Type) (io.ReadCloser, error) {
+	switch fType {
+	case matchers.TypeBz2:
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	case matchers.TypeGz:
+		return gzip.NewReader(r)
+	case matchers.TypeXz:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xr), nil
+	case matchers.TypeZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return nil, errUnhandledArchiveFormat
+}
+
+// walkCompressed walks a compressed tarball, or treats the decompressed
+// stream as a single member called name if it isn't a tarball.
+func walkCompressed(r io.Reader, fType types.Type, name string, visit archiveVisitor) error {
+	dr, err := newDecompressor(r, fType)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+	br := bufio.NewReader(dr)
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if matchers.Tar(head) {
+		return walkTar(br, visit)
+	}
+	m := ArchiveMember{
+		Name: name,
+		Size: -1,
+	}
+	return visit(m, func() (io.Reader, error) {
+		return br, nil
+	})
+}
+
+// compressedMemberName returns the name stored in the gzip header, or else
+// the name of f without its compression extension. f is rewound afterwards.
+func compressedMemberName(f *os.File, fType types.Type) (string, error) {
+	var name string
+	if fType == matchers.TypeGz {
+		gr, err := gzip.NewReader(f)
+		if err == nil {
+			name = filepath.Base(gr.Name)
+			gr.Close()
+		}
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return name, err
+		}
+	}
+	if name == "" || name == "." {
+		base := filepath.Base(f.Name())
+		name = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	return name, nil
+}
+
+// walkNested walks an archive read from r whose format is detected from its
+// contents, as found inside deb and rpm packages.
+func walkNested(r io.Reader, visit archiveVisitor) error {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	fType, err := filetype.Match(head)
+	if err != nil {
+		return err
+	}
+	switch fType {
+	case matchers.TypeTar:
+		return walkTar(br, visit)
+	case matchers.TypeBz2, matchers.TypeGz, matchers.TypeXz, matchers.TypeZstd:
+		return walkCompressed(br, fType, "", visit)
+	}
+	return errUnhandledArchiveFormat
+}
+
+// CleanMemberName normalises an archive member name to a relative
+// slash-separated path, the archive root being the empty string.
+func CleanMemberName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// VisitArchiveMember calls visit with the contents of the member of the
+// archive at fpath whose cleaned name is name. The reader is only valid until
+// visit returns; it implements io.ReadSeeker if the member is stored
+// uncompressed.
+func VisitArchiveMember(fpath string, name string, visit func(m ArchiveMember, r io.Reader) error) error {
+	fType, err := filetype.MatchFile(fpath)
+	if err != nil {
+		return err
+	}
+	found := false
+	err = walkArchive(fpath, fType, func(m ArchiveMember, open func() (io.Reader, error)) error {
+		if CleanMemberName(m.Name) != name {
+			return nil
+		}
+		found = true
+		r, err := open()
+		if err != nil {
+			return err
+		}
+		err = visit(m, r)
+		if err != nil {
+			return err
+		}
+		return errStopArchiveWalk
+	})
+	if err == nil && !found {
+		return ErrMemberNotFound
+	}
+	return err
+}
+
+// IsArchive reports whether the members of files with the given MIME type
+// are indexed.
+func IsArchive(mimeType string) bool {
+	for fType := range archiveMimeMap {
+		if fType.MIME.Value == mimeType {
+			return true
+		}
+	}
+	return false
+}
+
+// ListArchive returns the members of the archive at fpath.
+func ListArchive(fpath string) ([]ArchiveMember, error) {
+	var res []ArchiveMember
+	fType, err := filetype.MatchFile(fpath)
+	if err != nil {
+		return res, err
+	}
+	err = walkArchive(fpath, fType, func(m ArchiveMember, _ func() (io.Reader, error)) error {
+		res = append(res, m)
+		return nil
+	})
+	return res, err
+}
+
+func maybeProcessArchive(fpath string, fType types.Type, doc *bluge.Document) {
+	_, ok := archiveMimeMap[fType]
+	if !ok {
+		return
+	}
+	err := walkArchive(fpath, fType, func(m ArchiveMember, _ func() (io.Reader, error)) error {
+		if m.Name != "" {
+			doc.AddField(bluge.NewTextField(properties.ArchiveFilename, m.Name).StoreValue().HighlightMatches())
+		}
+		return nil
+	})
+	if err != nil {
+		log.Logger.Error("error reading archive contents",
+			zap.String("path", fpath), zap.Error(err))
 	}
 }
@@ -0,0 +1,90 @@
+package idx
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	arMagic      = "!<arch>\n"
+	debMagic     = arMagic + "debian-binary"
+	arHeaderSize = 60
+)
+
+var (
+	errInvalidAr = errors.New("invalid ar archive")
+)
+
+// walkAr walks the members of a Unix ar archive.
+func walkAr(r io.Reader, visit archiveVisitor) error {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(arMagic))
+	_, err := io.ReadFull(br, magic)
+	if err != nil {
+		return err
+	}
+	if string(magic) != arMagic {
+		return errInvalidAr
+	}
+	hdr := make([]byte, arHeaderSize)
+	for {
+		_, err = io.ReadFull(br, hdr)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(string(bytes.TrimRight(hdr[0:16], " ")), "/")
+		// the GNU long name table has no modification time
+		mtime, _ := strconv.ParseInt(string(bytes.TrimRight(hdr[16:28], " ")), 10, 64)
+		size, err := strconv.ParseInt(string(bytes.TrimRight(hdr[48:58], " ")), 10, 64)
+		if err != nil || size < 0 {
+			return errInvalidAr
+		}
+		lr := &io.LimitedReader{R: br, N: size}
+		m := ArchiveMember{
+			Name:    name,
+			Size:    size,
+			ModTime: time.Unix(mtime, 0),
+		}
+		// skip the GNU symbol and long name tables
+		if name != "" && name != "/" && name != "/SYM64" {
+			err = visit(m, func() (io.Reader, error) {
+				return lr, nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		// members are aligned to two bytes
+		_, err = io.Copy(io.Discard, io.LimitReader(br, lr.N+size%2))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// walkDeb walks the files contained in the data tarball of a Debian package.
+func walkDeb(r io.Reader, visit archiveVisitor) error {
+	return walkAr(r, func(m ArchiveMember, open func() (io.Reader, error)) error {
+		if !strings.HasPrefix(m.Name, "data.tar") {
+			return nil
+		}
+		dr, err := open()
+		if err != nil {
+			return err
+		}
+		err = walkNested(dr, visit)
+		if err == nil {
+			// nothing else of interest follows the data tarball
+			return errStopArchiveWalk
+		}
+		return err
+	})
+}
@@ -0,0 +1,159 @@
+package idx
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/h2non/filetype"
+	"github.com/h2non/filetype/matchers"
+)
+
+const (
+	rpmLeadSize       = 96
+	rpmHeaderMagic    = "\x8e\xad\xe8\x01"
+	cpioNewcMagic     = "070701"
+	cpioNewcCrcMagic  = "070702"
+	cpioNewcHdrSize   = 110
+	cpioTrailerName   = "TRAILER!!!"
+	cpioModeTypeMask  = 0o170000
+	cpioModeDirectory = 0o040000
+
+	// longest name, including its terminating NUL, as PATH_MAX on Linux
+	cpioMaxNameSize = 4096
+)
+
+var (
+	errInvalidRpm  = errors.New("invalid rpm package")
+	errInvalidCpio = errors.New("invalid cpio archive")
+)
+
+// skipRpmHeader skips over a header structure, returning its size.
+func skipRpmHeader(r io.Reader) (int64, error) {
+	intro := make([]byte, 16)
+	_, err := io.ReadFull(r, intro)
+	if err != nil {
+		return 0, err
+	}
+	if string(intro[0:4]) != rpmHeaderMagic {
+		return 0, errInvalidRpm
+	}
+	numIndex := int64(binary.BigEndian.Uint32(intro[8:12]))
+	dataSize := int64(binary.BigEndian.Uint32(intro[12:16]))
+	size := numIndex*16 + dataSize
+	_, err = io.CopyN(io.Discard, r, size)
+	return size + 16, err
+}
+
+// walkRpm walks the files contained in the cpio payload of an RPM package.
+func walkRpm(r io.Reader, visit archiveVisitor) error {
+	br := bufio.NewReader(r)
+	_, err := io.CopyN(io.Discard, br, rpmLeadSize)
+	if err != nil {
+		return err
+	}
+	// signature header, padded to eight bytes
+	sigSize, err := skipRpmHeader(br)
+	if err != nil {
+		return err
+	}
+	if pad := sigSize % 8; pad != 0 {
+		_, err = io.CopyN(io.Discard, br, 8-pad)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = skipRpmHeader(br)
+	if err != nil {
+		return err
+	}
+
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	fType, err := filetype.Match(head)
+	if err != nil {
+		return err
+	}
+	switch fType {
+	case matchers.TypeBz2, matchers.TypeGz, matchers.TypeXz, matchers.TypeZstd:
+		dr, err := newDecompressor(br, fType)
+		if err != nil {
+			return err
+		}
+		defer dr.Close()
+		return walkCpio(dr, visit)
+	}
+	return walkCpio(br, visit)
+}
+
+// walkCpio walks a cpio archive in the "new ASCII" format used by rpm.
+func walkCpio(r io.Reader, visit archiveVisitor) error {
+	br := bufio.NewReader(r)
+	hdr := make([]byte, cpioNewcHdrSize)
+	field := func(i int) (int64, error) {
+		return strconv.ParseInt(string(hdr[6+i*8:14+i*8]), 16, 64)
+	}
+	for {
+		_, err := io.ReadFull(br, hdr)
+		if err != nil {
+			return err
+		}
+		magic := string(hdr[0:6])
+		if magic != cpioNewcMagic && magic != cpioNewcCrcMagic {
+			return errInvalidCpio
+		}
+		mode, err := field(1)
+		if err != nil {
+			return errInvalidCpio
+		}
+		mtime, err := field(5)
+		if err != nil {
+			return errInvalidCpio
+		}
+		size, err := field(6)
+		if err != nil {
+			return errInvalidCpio
+		}
+		nameSize, err := field(11)
+		if err != nil || nameSize < 1 || nameSize > cpioMaxNameSize {
+			return errInvalidCpio
+		}
+		name := make([]byte, nameSize)
+		_, err = io.ReadFull(br, name)
+		if err != nil {
+			return err
+		}
+		// header and name are padded to four bytes
+		_, err = io.CopyN(io.Discard, br, (4-(cpioNewcHdrSize+nameSize)%4)%4)
+		if err != nil {
+			return err
+		}
+		m := ArchiveMember{
+			Name:    strings.TrimPrefix(string(bytes.TrimRight(name, "\x00")), "./"),
+			Size:    size,
+			ModTime: time.Unix(mtime, 0),
+			IsDir:   mode&cpioModeTypeMask == cpioModeDirectory,
+		}
+		if m.Name == cpioTrailerName {
+			return nil
+		}
+		lr := &io.LimitedReader{R: br, N: size}
+		err = visit(m, func() (io.Reader, error) {
+			return lr, nil
+		})
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(io.Discard, br, lr.N+(4-size%4)%4)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package idx
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/h2non/filetype"
+	"github.com/h2non/filetype/types"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+var testArchiveMembers = map[string]string{
+	"hello.txt":     "hello world",
+	"dir/inner.txt": "inner contents",
+}
+
+var testArchiveNames = []string{"dir/inner.txt", "hello.txt"}
+
+func makeTestTar(t *testing.T) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range testArchiveNames {
+		contents := testArchiveMembers[name]
+		err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0o644,
+			Size:    int64(len(contents)),
+			ModTime: time.Unix(1600000000, 0),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tw.Write([]byte(contents))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func makeTestZip(t *testing.T) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range testArchiveNames {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write([]byte(testArchiveMembers[name]))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func compressTest(t *testing.T, data []byte, newWriter func(io.Writer) (io.WriteCloser, error)) []byte {
+	var buf bytes.Buffer
+	w, err := newWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipTest(t *testing.T, data []byte) []byte {
+	return compressTest(t, data, func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	})
+}
+
+func makeTestAr(members map[string][]byte, order []string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(arMagic)
+	for _, name := range order {
+		data := members[name]
+		fmt.Fprintf(&buf, "%-16s%-12d%-6d%-6d%-8o%-10d`\n", name, 1600000000, 0, 0, 0o644, len(data))
+		buf.Write(data)
+		if len(data)%2 != 0 {
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+func makeTestRpm(t *testing.T) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("\xed\xab\xee\xdb")
+	buf.Write(make([]byte, rpmLeadSize-4))
+	// signature header with one index entry and 4 bytes of data, padded to
+	// eight bytes, followed by the main header
+	writeHeader := func(numIndex, dataSize uint32) {
+		buf.WriteString(rpmHeaderMagic)
+		buf.Write(make([]byte, 4))
+		_ = binary.Write(&buf, binary.BigEndian, numIndex)
+		_ = binary.Write(&buf, binary.BigEndian, dataSize)
+		buf.Write(make([]byte, numIndex*16+dataSize))
+	}
+	writeHeader(1, 4)
+	buf.Write(make([]byte, 4))
+	writeHeader(1, 8)
+
+	var cpio bytes.Buffer
+	writeEntry := func(name string, data string) {
+		fmt.Fprintf(&cpio, "%s%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X",
+			cpioNewcMagic, 0, 0o100644, 0, 0, 1, 1600000000, len(data), 0, 0, 0, 0, len(name)+1, 0)
+		cpio.WriteString(name)
+		cpio.WriteByte(0)
+		for (cpio.Len())%4 != 0 {
+			cpio.WriteByte(0)
+		}
+		cpio.WriteString(data)
+		for (cpio.Len())%4 != 0 {
+			cpio.WriteByte(0)
+		}
+	}
+	for _, name := range testArchiveNames {
+		writeEntry("./"+name, testArchiveMembers[name])
+	}
+	writeEntry(cpioTrailerName, "")
+	buf.Write(gzipTest(t, cpio.Bytes()))
+	return buf.Bytes()
+}
+
+func TestWalkCpioLongName(t *testing.T) {
+	hdr := fmt.Sprintf("%s%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X",
+		cpioNewcMagic, 0, 0o100644, 0, 0, 1, 1600000000, 0, 0, 0, 0, 0, cpioMaxNameSize+1, 0)
+	err := walkCpio(strings.NewReader(hdr), func(m ArchiveMember, open func() (io.Reader, error)) error {
+		t.Fatalf("unexpected member %s", m.Name)
+		return nil
+	})
+	if err != errInvalidCpio {
+		t.Fatalf("unexpected error: got %v expected %v", err, errInvalidCpio)
+	}
+}
+
+func TestWalkArchive(t *testing.T) {
+	_, ourFile, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Fatal("couldn't find path to myself")
+	}
+	fixture := func(name string) []byte {
+		data, err := ioutil.ReadFile(filepath.Join(filepath.Dir(ourFile),
+			"..", "..", "testdata", "archives", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	tarData := makeTestTar(t)
+	debData := makeTestAr(map[string][]byte{
+		"debian-binary":  []byte("2.0\n"),
+		"control.tar.gz": gzipTest(t, makeTestTar(t)),
+		"data.tar.gz":    gzipTest(t, tarData),
+	}, []string{"debian-binary", "control.tar.gz", "data.tar.gz"})
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected []string
+	}{
+		{"test.zip", makeTestZip(t), testArchiveNames},
+		{"test.tar", tarData, testArchiveNames},
+		{"test.tar.gz", gzipTest(t, tarData), testArchiveNames},
+		{"test.tar.xz", compressTest(t, tarData, func(w io.Writer) (io.WriteCloser, error) {
+			return xz.NewWriter(w)
+		}), testArchiveNames},
+		{"test.tar.zst", compressTest(t, tarData, func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		}), testArchiveNames},
+		{"notes.txt.gz", gzipTest(t, []byte("just some notes")), []string{"notes.txt"}},
+		{"test.deb", debData, testArchiveNames},
+		{"test.rpm", makeTestRpm(t), testArchiveNames},
+		{"test.7z", fixture("test.7z"), testArchiveNames},
+		{"test.rar", fixture("test.rar"), testArchiveNames},
+	}
+
+	tempDir, err := ioutil.TempDir("", "filetundra_archives")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fpath := filepath.Join(tempDir, tt.name)
+			err := ioutil.WriteFile(fpath, tt.data, 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fType types.Type
+			fType, err = filetype.MatchFile(fpath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			contents := make(map[string]string)
+			err = walkArchive(fpath, fType, func(m ArchiveMember, open func() (io.Reader, error)) error {
+				names = append(names, m.Name)
+				r, err := open()
+				if err != nil {
+					return err
+				}
+				b, err := ioutil.ReadAll(r)
+				contents[m.Name] = string(b)
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(names, tt.expected) {
+				t.Fatalf("unexpected members: got %v expected %v", names, tt.expected)
+			}
+			for _, name := range names {
+				expected, ok := testArchiveMembers[name]
+				if !ok {
+					continue
+				}
+				if contents[name] != expected {
+					t.Fatalf("unexpected contents for %s: got %q expected %q", name, contents[name], expected)
+				}
+			}
+		})
+	}
+}
@@ -58,6 +58,52 @@ func getAudioMetadata(fpath string, fType types.Type) (tag.Metadata, error) {
 	return meta, err
 }
 
+func addAudioTags(meta tag.Metadata, doc *bluge.Document) {
+	for _, field := range []struct {
+		name  string
+		value string
+	}{
+		{properties.AudioAlbum, meta.Album()},
+		{properties.AudioAlbumArtist, meta.AlbumArtist()},
+		{properties.AudioArtist, meta.Artist()},
+		{properties.AudioComposer, meta.Composer()},
+		{properties.AudioGenre, meta.Genre()},
+		{properties.AudioTitle, meta.Title()},
+	} {
+		if field.value != "" {
+			doc.AddField(bluge.NewTextField(field.name, field.value).StoreValue().HighlightMatches())
+		}
+	}
+	// whole names for counting files by artist and album, and completing them
+	if meta.Artist() != "" {
+		doc.AddField(bluge.NewKeywordField(properties.FacetArtist, meta.Artist()).Aggregatable()).
+			AddField(newSuggestField(properties.SuggestArtist, meta.Artist(), meta.Artist()))
+	}
+	if meta.Album() != "" {
+		doc.AddField(bluge.NewKeywordField(properties.FacetAlbum, meta.Album()).Aggregatable()).
+			AddField(newSuggestField(properties.SuggestAlbum, meta.Album(), meta.Album()))
+	}
+	if meta.Picture() != nil {
+		doc.AddField(bluge.NewKeywordField(properties.AudioArtwork, "true").StoreValue())
+	}
+	track, tracks := meta.Track()
+	disc, discs := meta.Disc()
+	for _, field := range []struct {
+		name  string
+		value int
+	}{
+		{properties.AudioDisc, disc},
+		{properties.AudioDiscs, discs},
+		{properties.AudioTrack, track},
+		{properties.AudioTracks, tracks},
+		{properties.AudioYear, meta.Year()},
+	} {
+		if field.value > 0 {
+			doc.AddField(bluge.NewNumericField(field.name, float64(field.value)).StoreValue().Sortable())
+		}
+	}
+}
+
 func maybeProcessAudio(fpath string, fType types.Type, doc *bluge.Document) {
 	_, ok := audioMetaMimeMap[fType]
 	if !ok {
@@ -68,17 +114,18 @@ func maybeProcessAudio(fpath string, fType types.Type, doc *bluge.Document) {
 		log.Logger.Error("error getting audio metadata",
 			zap.String("path", fpath), zap.Error(err))
 	} else {
-		artist := meta.Artist()
-		if artist != "" {
-			doc.AddField(bluge.NewTextField(properties.AudioArtist, artist).StoreValue())
-		}
-		album := meta.Album()
-		if album != "" {
-			doc.AddField(bluge.NewTextField(properties.AudioAlbum, album).StoreValue())
-		}
-		title := meta.Title()
-		if title != "" {
-			doc.AddField(bluge.NewTextField(properties.AudioTitle, title).StoreValue())
-		}
+		addAudioTags(meta, doc)
+	}
+	info, err := getAudioStreamInfo(fpath, fType)
+	if err != nil {
+		log.Logger.Error("error getting audio stream info",
+			zap.String("path", fpath), zap.Error(err))
+		return
+	}
+	if info.Duration > 0 {
+		doc.AddField(bluge.NewNumericField(properties.AudioDuration, info.Duration.Seconds()).StoreValue())
+	}
+	if info.Bitrate > 0 {
+		doc.AddField(bluge.NewNumericField(properties.AudioBitrate, float64(info.Bitrate)).StoreValue())
 	}
 }
@@ -0,0 +1,429 @@
+package idx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/fatalbanana/filetundra/internal/log"
+
+	"github.com/h2non/filetype/matchers"
+	"github.com/h2non/filetype/types"
+	"go.uber.org/zap"
+)
+
+const (
+	// how far into an MP3 file the first frame is looked for
+	mp3MaxSyncSearch = 64 << 10
+	// how much of the end of an Ogg file is searched for the last page
+	oggMaxLastPageSearch = 64 << 10
+)
+
+var (
+	errInvalidMp3  = errors.New("invalid mp3 file")
+	errInvalidFlac = errors.New("invalid flac file")
+	errInvalidOgg  = errors.New("invalid ogg file")
+
+	// kbit/s by MPEG version (1, 2 & 2.5), layer and index
+	mp3Bitrates = [2][3][15]int{
+		{
+			{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+			{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+			{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+		},
+		{
+			{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+			{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+			{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		},
+	}
+	// Hz by MPEG version (1, 2, 2.5) and index
+	mp3SampleRates = [3][3]int{
+		{44100, 48000, 32000},
+		{22050, 24000, 16000},
+		{11025, 12000, 8000},
+	}
+)
+
+// audioStreamInfo describes the audio stream of a file.
+type audioStreamInfo struct {
+	// average bits per second
+	Bitrate  int
+	Duration time.Duration
+}
+
+// newAudioStreamInfo computes the average bitrate of size bytes of audio
+// playing for duration.
+func newAudioStreamInfo(duration time.Duration, size int64) audioStreamInfo {
+	info := audioStreamInfo{Duration: duration}
+	if duration > 0 {
+		info.Bitrate = int(float64(size) * 8 / duration.Seconds())
+	}
+	return info
+}
+
+func samplesDuration(samples uint64, sampleRate int) time.Duration {
+	if sampleRate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(samples) / float64(sampleRate) * float64(time.Second))
+}
+
+// mp3Frame is a decoded MPEG audio frame header.
+type mp3Frame struct {
+	// 0 for MPEG 1, 1 for MPEG 2, 2 for MPEG 2.5
+	version int
+	// 0 for layer I, 1 for layer II, 2 for layer III
+	layer      int
+	bitrate    int
+	sampleRate int
+	mono       bool
+	padding    bool
+}
+
+func parseMp3Frame(header []byte) (mp3Frame, bool) {
+	var frame mp3Frame
+	if len(header) < 4 || header[0] != 0xff || header[1]&0xe0 != 0xe0 {
+		return frame, false
+	}
+	switch header[1] >> 3 & 3 {
+	case 3:
+		frame.version = 0
+	case 2:
+		frame.version = 1
+	case 0:
+		frame.version = 2
+	default:
+		return frame, false
+	}
+	layer := int(header[1] >> 1 & 3)
+	bitrateIndex := int(header[2] >> 4)
+	sampleRateIndex := int(header[2] >> 2 & 3)
+	if layer == 0 || bitrateIndex == 0 || bitrateIndex == 15 || sampleRateIndex == 3 {
+		return frame, false
+	}
+	frame.layer = 3 - layer
+	tableVersion := frame.version
+	if tableVersion > 1 {
+		tableVersion = 1
+	}
+	frame.bitrate = mp3Bitrates[tableVersion][frame.layer][bitrateIndex] * 1000
+	frame.sampleRate = mp3SampleRates[frame.version][sampleRateIndex]
+	frame.padding = header[2]&2 != 0
+	frame.mono = header[3]>>6 == 3
+	return frame, true
+}
+
+func (frame mp3Frame) samples() int {
+	switch {
+	case frame.layer == 0:
+		return 384
+	case frame.layer == 2 && frame.version > 0:
+		return 576
+	}
+	return 1152
+}
+
+func (frame mp3Frame) length() int {
+	var padding int
+	if frame.padding {
+		padding = 1
+	}
+	if frame.layer == 0 {
+		return (12*frame.bitrate/frame.sampleRate + padding) * 4
+	}
+	return frame.samples()/8*frame.bitrate/frame.sampleRate + padding
+}
+
+// sideInfoSize returns the size of the layer III side information which
+// precedes a Xing header.
+func (frame mp3Frame) sideInfoSize() int {
+	switch {
+	case frame.version == 0 && frame.mono:
+		return 17
+	case frame.version == 0:
+		return 32
+	case frame.mono:
+		return 9
+	}
+	return 17
+}
+
+// skipID3v2 returns the size of the ID3v2 tags at the start of f.
+func skipID3v2(f io.ReadSeeker) (int64, error) {
+	var offset int64
+	for {
+		header := make([]byte, 10)
+		_, err := io.ReadFull(f, header)
+		if err != nil {
+			return offset, err
+		}
+		if string(header[:3]) != "ID3" {
+			break
+		}
+		// the size is stored as a syncsafe integer
+		size := int64(header[6])<<21 | int64(header[7])<<14 | int64(header[8])<<7 | int64(header[9])
+		size += 10
+		if header[5]&0x10 != 0 {
+			// footer present
+			size += 10
+		}
+		offset += size
+		_, err = f.Seek(offset, io.SeekStart)
+		if err != nil {
+			return offset, err
+		}
+	}
+	_, err := f.Seek(offset, io.SeekStart)
+	return offset, err
+}
+
+func getMp3StreamInfo(f io.ReadSeeker, size int64) (audioStreamInfo, error) {
+	start, err := skipID3v2(f)
+	if err != nil {
+		return audioStreamInfo{}, err
+	}
+	buf := make([]byte, mp3MaxSyncSearch)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return audioStreamInfo{}, err
+	}
+	buf = buf[:n]
+
+	// look for two consecutive frames to avoid false syncs
+	var frame mp3Frame
+	offset := -1
+	for i := 0; i+4 <= len(buf); i++ {
+		candidate, ok := parseMp3Frame(buf[i:])
+		if !ok {
+			continue
+		}
+		next := i + candidate.length()
+		if next+4 <= len(buf) {
+			if _, ok := parseMp3Frame(buf[next:]); !ok {
+				continue
+			}
+		}
+		frame, offset = candidate, i
+		break
+	}
+	if offset < 0 {
+		return audioStreamInfo{}, errInvalidMp3
+	}
+	audioSize := size - start - int64(offset)
+
+	_, err = f.Seek(-128, io.SeekEnd)
+	if err == nil {
+		trailer := make([]byte, 3)
+		_, err = io.ReadFull(f, trailer)
+		if err == nil && string(trailer) == "TAG" {
+			audioSize -= 128
+		}
+	}
+
+	// VBR files announce their frame count in the first frame
+	var frames uint32
+	xing := buf[offset:]
+	if len(xing) > 4+frame.sideInfoSize()+12 {
+		xing = xing[4+frame.sideInfoSize():]
+		if tag := string(xing[:4]); tag == "Xing" || tag == "Info" {
+			flags := binary.BigEndian.Uint32(xing[4:8])
+			if flags&1 != 0 {
+				frames = binary.BigEndian.Uint32(xing[8:12])
+			}
+		}
+	}
+	vbri := buf[offset:]
+	if frames == 0 && len(vbri) >= 4+32+18 && string(vbri[36:40]) == "VBRI" {
+		frames = binary.BigEndian.Uint32(vbri[36+14 : 36+18])
+	}
+	if frames > 0 {
+		duration := samplesDuration(uint64(frames)*uint64(frame.samples()), frame.sampleRate)
+		return newAudioStreamInfo(duration, audioSize), nil
+	}
+	duration := time.Duration(float64(audioSize) * 8 / float64(frame.bitrate) * float64(time.Second))
+	return audioStreamInfo{Bitrate: frame.bitrate, Duration: duration}, nil
+}
+
+func getFlacStreamInfo(f io.ReadSeeker, size int64) (audioStreamInfo, error) {
+	header := make([]byte, 4)
+	_, err := io.ReadFull(f, header)
+	if err != nil {
+		return audioStreamInfo{}, err
+	}
+	if string(header) != "fLaC" {
+		return audioStreamInfo{}, errInvalidFlac
+	}
+	offset := int64(4)
+	var sampleRate int
+	var samples uint64
+	for {
+		_, err = io.ReadFull(f, header)
+		if err != nil {
+			return audioStreamInfo{}, err
+		}
+		last := header[0]&0x80 != 0
+		blockType := header[0] & 0x7f
+		length := int64(header[1])<<16 | int64(header[2])<<8 | int64(header[3])
+		offset += 4 + length
+		if blockType == 0 {
+			if length < 18 {
+				return audioStreamInfo{}, errInvalidFlac
+			}
+			streamInfo := make([]byte, length)
+			_, err = io.ReadFull(f, streamInfo)
+			if err != nil {
+				return audioStreamInfo{}, err
+			}
+			// 20 bits sample rate, 3 bits channels, 5 bits sample size
+			// and 36 bits total samples
+			packed := binary.BigEndian.Uint64(streamInfo[10:18])
+			sampleRate = int(packed >> 44)
+			samples = packed & (1<<36 - 1)
+		} else {
+			_, err = f.Seek(offset, io.SeekStart)
+			if err != nil {
+				return audioStreamInfo{}, err
+			}
+		}
+		if last {
+			break
+		}
+	}
+	if sampleRate == 0 {
+		return audioStreamInfo{}, errInvalidFlac
+	}
+	return newAudioStreamInfo(samplesDuration(samples, sampleRate), size-offset), nil
+}
+
+// oggPage is the header of an Ogg page.
+type oggPage struct {
+	granule int64
+	serial  uint32
+	// size of header and segment table
+	headerSize int
+	dataSize   int
+}
+
+func parseOggPage(buf []byte) (oggPage, bool) {
+	var page oggPage
+	if len(buf) < 27 || string(buf[:4]) != "OggS" || buf[4] != 0 {
+		return page, false
+	}
+	page.granule = int64(binary.LittleEndian.Uint64(buf[6:14]))
+	page.serial = binary.LittleEndian.Uint32(buf[14:18])
+	segments := int(buf[26])
+	page.headerSize = 27 + segments
+	if len(buf) < page.headerSize {
+		return page, false
+	}
+	for _, segment := range buf[27:page.headerSize] {
+		page.dataSize += int(segment)
+	}
+	return page, true
+}
+
+func getOggStreamInfo(f io.ReadSeeker, size int64) (audioStreamInfo, error) {
+	buf := make([]byte, 27+255+255)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return audioStreamInfo{}, err
+	}
+	buf = buf[:n]
+	first, ok := parseOggPage(buf)
+	if !ok || len(buf) < first.headerSize+first.dataSize {
+		return audioStreamInfo{}, errInvalidOgg
+	}
+	// the first page holds the codec identification header
+	packet := buf[first.headerSize : first.headerSize+first.dataSize]
+	var sampleRate int
+	var preSkip int64
+	switch {
+	case len(packet) >= 16 && string(packet[:7]) == "\x01vorbis":
+		sampleRate = int(binary.LittleEndian.Uint32(packet[12:16]))
+	case len(packet) >= 12 && string(packet[:8]) == "OpusHead":
+		// granule positions always count 48 kHz samples
+		sampleRate = 48000
+		preSkip = int64(binary.LittleEndian.Uint16(packet[10:12]))
+	default:
+		return audioStreamInfo{}, errUnhandledAudioFormat
+	}
+
+	searchSize := int64(oggMaxLastPageSearch)
+	if searchSize > size {
+		searchSize = size
+	}
+	_, err = f.Seek(-searchSize, io.SeekEnd)
+	if err != nil {
+		return audioStreamInfo{}, err
+	}
+	tail := make([]byte, searchSize)
+	_, err = io.ReadFull(f, tail)
+	if err != nil {
+		return audioStreamInfo{}, err
+	}
+	for i := bytes.LastIndex(tail, []byte("OggS")); i >= 0; i = bytes.LastIndex(tail[:i], []byte("OggS")) {
+		page, ok := parseOggPage(tail[i:])
+		if ok && page.serial == first.serial && page.granule > preSkip {
+			duration := samplesDuration(uint64(page.granule-preSkip), sampleRate)
+			return newAudioStreamInfo(duration, size), nil
+		}
+	}
+	return audioStreamInfo{}, errInvalidOgg
+}
+
+func getM4aStreamInfo(f io.ReadSeeker, size int64) (audioStreamInfo, error) {
+	moov, sizes, err := readBmffTopLevel(f, "moov", mp4MaxMoovSize)
+	if err != nil {
+		return audioStreamInfo{}, err
+	}
+	mvhd, ok := bmffChild(moov, "mvhd")
+	if !ok {
+		return audioStreamInfo{}, errInvalidBmff
+	}
+	r := bmffReader{data: mvhd.data}
+	timescale, duration := mp4TimeHeader(&r)
+	if r.err != nil {
+		return audioStreamInfo{}, r.err
+	}
+	audioSize := sizes["mdat"]
+	if audioSize == 0 {
+		audioSize = size
+	}
+	return newAudioStreamInfo(samplesDuration(duration, int(timescale)), audioSize), nil
+}
+
+// getAudioStreamInfo computes the duration and bitrate of the audio file
+// at fpath.
+func getAudioStreamInfo(fpath string, fType types.Type) (audioStreamInfo, error) {
+	f, err := os.Open(fpath) // #nosec: shut up
+	if err != nil {
+		return audioStreamInfo{}, err
+	}
+	defer func() {
+		err := f.Close()
+		if err != nil {
+			log.Logger.Error("error closing file",
+				zap.String("path", fpath), zap.Error(err))
+		}
+	}()
+	si, err := f.Stat()
+	if err != nil {
+		return audioStreamInfo{}, err
+	}
+
+	switch fType {
+	case matchers.TypeFlac:
+		return getFlacStreamInfo(f, si.Size())
+	case matchers.TypeMp3:
+		return getMp3StreamInfo(f, si.Size())
+	case matchers.TypeOgg:
+		return getOggStreamInfo(f, si.Size())
+	case matchers.TypeM4a:
+		return getM4aStreamInfo(f, si.Size())
+	}
+	return audioStreamInfo{}, errUnhandledAudioFormat
+}
@@ -0,0 +1,284 @@
+package idx
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/fatalbanana/filetundra/internal/env"
+	"github.com/fatalbanana/filetundra/internal/properties"
+
+	"github.com/blugelabs/bluge"
+	"github.com/h2non/filetype/matchers"
+	"github.com/h2non/filetype/types"
+)
+
+// makeTestID3 builds an ID3v2.3 tag of text frames.
+func makeTestID3(frames ...[2]string) []byte {
+	var body []byte
+	for _, frame := range frames {
+		body = append(body, frame[0]...)
+		body = appendUint32(binary.BigEndian, body, uint32(len(frame[1])+1))
+		body = append(body, 0, 0, 0)
+		body = append(body, frame[1]...)
+	}
+	size := len(body)
+	tag := []byte{'I', 'D', '3', 3, 0, 0, byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+	return append(tag, body...)
+}
+
+// makeTestMp3 builds an MPEG 1 layer III stream of 128 kbit/s at 44.1 kHz
+// following tag, optionally announcing xingFrames in a Xing header.
+func makeTestMp3(tag []byte, frames int, xingFrames uint32) []byte {
+	var buf bytes.Buffer
+	buf.Write(tag)
+	for i := 0; i < frames; i++ {
+		frame := make([]byte, 417)
+		copy(frame, "\xff\xfb\x90\x40")
+		if i == 0 && xingFrames > 0 {
+			copy(frame[36:], "Xing\x00\x00\x00\x01")
+			binary.BigEndian.PutUint32(frame[44:], xingFrames)
+		}
+		buf.Write(frame)
+	}
+	return buf.Bytes()
+}
+
+// makeTestFlac builds a FLAC file of samples at 44.1 kHz followed by
+// audioSize bytes.
+func makeTestFlac(samples uint64, audioSize int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("fLaC\x80\x00\x00\x22")
+	streamInfo := make([]byte, 34)
+	binary.BigEndian.PutUint64(streamInfo[10:], 44100<<44|1<<41|15<<36|samples)
+	buf.Write(streamInfo)
+	buf.Write(make([]byte, audioSize))
+	return buf.Bytes()
+}
+
+func oggPageBytes(granule int64, data []byte) []byte {
+	page := []byte("OggS\x00\x00")
+	page = appendUint32(binary.LittleEndian, page, uint32(granule))
+	page = appendUint32(binary.LittleEndian, page, uint32(granule>>32))
+	// serial, sequence number and checksum
+	page = append(page, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	page = append(page, 1, byte(len(data)))
+	return append(page, data...)
+}
+
+// makeTestOgg builds an Ogg stream starting with the given identification
+// header and ending at granule.
+func makeTestOgg(ident []byte, granule int64) []byte {
+	buf := oggPageBytes(0, ident)
+	buf = append(buf, oggPageBytes(granule/2, make([]byte, 100))...)
+	return append(buf, oggPageBytes(granule, make([]byte, 100))...)
+}
+
+// makeTestM4a builds an MPEG-4 file lasting duration milliseconds with
+// audioSize bytes of media data.
+func makeTestM4a(duration uint32, audioSize int) []byte {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:], duration)
+	buf := isoBox("ftyp", []byte("M4A \x00\x00\x00\x00M4A isom"))
+	buf = append(buf, isoBox("moov", isoBox("mvhd", mvhd))...)
+	return append(buf, isoBox("mdat", make([]byte, audioSize))...)
+}
+
+func TestGetAudioStreamInfo(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "filetundra_audio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	vorbisIdent := make([]byte, 30)
+	copy(vorbisIdent, "\x01vorbis")
+	binary.LittleEndian.PutUint32(vorbisIdent[12:], 44100)
+	opusIdent := make([]byte, 19)
+	copy(opusIdent, "OpusHead\x01\x02")
+	binary.LittleEndian.PutUint16(opusIdent[10:], 312)
+
+	tests := []struct {
+		name     string
+		fType    types.Type
+		data     []byte
+		expected audioStreamInfo
+	}{
+		{"mp3 cbr", matchers.TypeMp3, makeTestMp3(makeTestID3([2]string{"TIT2", "Silence"}), 100, 0),
+			audioStreamInfo{Bitrate: 128000, Duration: 2606250 * time.Microsecond}},
+		{"mp3 xing", matchers.TypeMp3, makeTestMp3(nil, 10, 441),
+			audioStreamInfo{Bitrate: 2895, Duration: 11520 * time.Millisecond}},
+		{"flac", matchers.TypeFlac, makeTestFlac(441000, 1000),
+			audioStreamInfo{Bitrate: 800, Duration: 10 * time.Second}},
+		{"vorbis", matchers.TypeOgg, makeTestOgg(vorbisIdent, 3*44100),
+			audioStreamInfo{Bitrate: 837, Duration: 3 * time.Second}},
+		{"opus", matchers.TypeOgg, makeTestOgg(opusIdent, 2*48000+312),
+			audioStreamInfo{Bitrate: 1212, Duration: 2 * time.Second}},
+		{"m4a", matchers.TypeM4a, makeTestM4a(5000, 4992),
+			audioStreamInfo{Bitrate: 8000, Duration: 5 * time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fpath := filepath.Join(tempDir, "audio")
+			err := ioutil.WriteFile(fpath, tt.data, 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, err := getAudioStreamInfo(fpath, tt.fType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info != tt.expected {
+				t.Fatalf("unexpected stream info: got %+v expected %+v", info, tt.expected)
+			}
+		})
+	}
+}
+
+func TestAudioIndexing(t *testing.T) {
+	_, filename, _, _ := runtime.Caller(0)
+	tone, err := ioutil.ReadFile(filepath.Join(filepath.Dir(filename), "..", "..", "testdata", "fileroot", "tone.mp3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataRoot, err := ioutil.TempDir("", "filetundra_root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataRoot)
+	env.Env.Root = dataRoot
+	tonePath := filepath.Join(dataRoot, "tone.mp3")
+	err = ioutil.WriteFile(tonePath, tone, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trackPath := filepath.Join(dataRoot, "track.mp3")
+	err = ioutil.WriteFile(trackPath, makeTestMp3(makeTestID3(
+		[2]string{"TIT2", "Silence"},
+		[2]string{"TPE1", "Nobody"},
+		[2]string{"TPE2", "Various Artists"},
+		[2]string{"TCOM", "John Cage"},
+		[2]string{"TCON", "Ambient"},
+		[2]string{"TYER", "1952"},
+		[2]string{"TRCK", "3/12"},
+		[2]string{"TPOS", "1/2"},
+	), 100, 0), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	introPath := filepath.Join(dataRoot, "intro.mp3")
+	err = ioutil.WriteFile(introPath, makeTestMp3(makeTestID3(
+		[2]string{"TIT2", "Intro"},
+		[2]string{"TYER", "1960"},
+		[2]string{"TRCK", "1/12"},
+	), 100, 0), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir, err := ioutil.TempDir("", "filetundra_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	Init(tempDir)
+	_, err = Initial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := bluge.OpenReader(BlugeConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	var query bluge.Query = bluge.NewNumericRangeQuery(0.4, 0.5).SetField(properties.AudioDuration)
+	searchResults, err := reader.Search(context.TODO(), bluge.NewAllMatches(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := searchResults.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next == nil {
+		t.Fatal("tone wasn't found")
+	}
+	fi, err := DocumentMatchToFileInfo(reader, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Filename != tonePath || fi.AudioArtist != "Andrew Lewis" || fi.AudioAlbum != "Tones of the DTMF" ||
+		fi.AudioBitrate != 8000 || fi.AudioDuration != 432*time.Millisecond {
+		t.Fatalf("unexpected file info: %+v", fi)
+	}
+
+	query = bluge.NewBooleanQuery().
+		AddMust(bluge.NewMatchQuery("ambient").SetField(properties.AudioGenre)).
+		AddMust(bluge.NewNumericRangeInclusiveQuery(1950, 1959, true, true).SetField(properties.AudioYear))
+	searchResults, err = reader.Search(context.TODO(), bluge.NewAllMatches(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err = searchResults.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next == nil {
+		t.Fatal("track wasn't found")
+	}
+	fi, err = DocumentMatchToFileInfo(reader, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Filename != trackPath || fi.AudioTitle != "Silence" || fi.AudioAlbumArtist != "Various Artists" ||
+		fi.AudioComposer != "John Cage" || fi.AudioGenre != "Ambient" || fi.AudioYear != 1952 ||
+		fi.AudioTrack != 3 || fi.AudioTracks != 12 || fi.AudioDisc != 1 || fi.AudioDiscs != 2 ||
+		fi.AudioBitrate != 128000 {
+		t.Fatalf("unexpected file info: %+v", fi)
+	}
+
+	// files without the field come last in either order
+	for _, tt := range []struct {
+		order    string
+		expected []string
+	}{
+		{properties.AudioTrack, []string{introPath, trackPath, tonePath}},
+		{"-" + properties.AudioTrack, []string{trackPath, introPath, tonePath}},
+		{properties.AudioYear, []string{trackPath, introPath, tonePath}},
+		{"-" + properties.AudioYear, []string{introPath, trackPath, tonePath}},
+	} {
+		query = bluge.NewNumericRangeQuery(0, bluge.MaxNumeric).SetField(properties.AudioBitrate)
+		searchResults, err = reader.Search(context.TODO(),
+			bluge.NewTopNSearch(10, query).SortBy([]string{tt.order}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		next, err = searchResults.Next()
+		for err == nil && next != nil {
+			fi, err = DocumentMatchToFileInfo(reader, next)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, fi.Filename)
+			next, err = searchResults.Next()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Fatalf("unexpected order by %s: got %v expected %v", tt.order, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package idx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+const (
+	// upper bound for the size of the moov box of MPEG-4 files
+	mp4MaxMoovSize = 64 << 20
+)
+
+var errInvalidBmff = errors.New("invalid iso base media file")
+
+// bmffBox is an ISO base media file format box read into memory.
+type bmffBox struct {
+	boxType string
+	data    []byte
+}
+
+// bmffChildren splits data into the boxes it contains.
+func bmffChildren(data []byte) ([]bmffBox, error) {
+	var boxes []bmffBox
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return boxes, errInvalidBmff
+		}
+		size := uint64(binary.BigEndian.Uint32(data))
+		boxType := string(data[4:8])
+		headerSize := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return boxes, errInvalidBmff
+			}
+			size = binary.BigEndian.Uint64(data[8:])
+			headerSize = 16
+		}
+		if size < headerSize || size > uint64(len(data)) {
+			return boxes, errInvalidBmff
+		}
+		boxes = append(boxes, bmffBox{boxType: boxType, data: data[headerSize:size]})
+		data = data[size:]
+	}
+	return boxes, nil
+}
+
+// bmffChild returns the first box of type boxType found by descending
+// through the given path of box types.
+func bmffChild(data []byte, path ...string) (bmffBox, bool) {
+	for i, boxType := range path {
+		boxes, err := bmffChildren(data)
+		if err != nil {
+			return bmffBox{}, false
+		}
+		found := false
+		for _, box := range boxes {
+			if box.boxType == boxType {
+				if i == len(path)-1 {
+					return box, true
+				}
+				data = box.data
+				found = true
+				break
+			}
+		}
+		if !found {
+			return bmffBox{}, false
+		}
+	}
+	return bmffBox{}, false
+}
+
+// bmffReader decodes big endian fields from box contents.
+type bmffReader struct {
+	data []byte
+	err  error
+}
+
+func (r *bmffReader) next(n int) []byte {
+	if r.err != nil || n > len(r.data) {
+		r.err = errInvalidBmff
+		return make([]byte, n)
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+// uint reads an unsigned integer of size bytes.
+func (r *bmffReader) uint(size int) uint64 {
+	var v uint64
+	for _, b := range r.next(size) {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+// fullBoxHeader reads the version and flags of a full box.
+func (r *bmffReader) fullBoxHeader() (version uint8, flags uint32) {
+	v := r.uint(4)
+	return uint8(v >> 24), uint32(v & 0xffffff)
+}
+
+func (r *bmffReader) cString() string {
+	i := bytes.IndexByte(r.data, 0)
+	if i < 0 {
+		r.err = errInvalidBmff
+		return ""
+	}
+	return string(r.next(i + 1)[:i])
+}
+
+// readBmffTopLevel reads the contents of the first top level box of type
+// boxType, which must not exceed maxSize, and sums up the sizes of all top
+// level boxes by type.
+func readBmffTopLevel(f io.ReadSeeker, boxType string, maxSize int64) (data []byte, sizes map[string]int64, err error) {
+	sizes = make(map[string]int64)
+	for {
+		var header [8]byte
+		_, err = io.ReadFull(f, header[:])
+		if err == io.EOF {
+			return data, sizes, nil
+		}
+		if err != nil {
+			return data, sizes, err
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		headerSize := int64(8)
+		switch size {
+		case 0:
+			// the box extends to the end of the file
+			pos, err := f.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return data, sizes, err
+			}
+			end, err := f.Seek(0, io.SeekEnd)
+			if err != nil {
+				return data, sizes, err
+			}
+			size = end - pos + headerSize
+			_, err = f.Seek(pos, io.SeekStart)
+			if err != nil {
+				return data, sizes, err
+			}
+		case 1:
+			var largeSize uint64
+			err = binary.Read(f, binary.BigEndian, &largeSize)
+			if err != nil {
+				return data, sizes, err
+			}
+			if largeSize > math.MaxInt64 {
+				return data, sizes, errInvalidBmff
+			}
+			size = int64(largeSize)
+			headerSize = 16
+		}
+		if size < headerSize {
+			return data, sizes, errInvalidBmff
+		}
+		currentType := string(header[4:])
+		sizes[currentType] += size
+		if currentType != boxType || data != nil {
+			_, err = f.Seek(size-headerSize, io.SeekCurrent)
+			if err != nil {
+				return data, sizes, err
+			}
+			continue
+		}
+		if size-headerSize > maxSize {
+			return data, sizes, errInvalidBmff
+		}
+		data = make([]byte, size-headerSize)
+		_, err = io.ReadFull(f, data)
+		if err != nil {
+			return data, sizes, err
+		}
+	}
+}
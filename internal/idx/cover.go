@@ -0,0 +1,103 @@
+package idx
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+
+	"github.com/fatalbanana/filetundra/internal/properties"
+
+	"github.com/blugelabs/bluge"
+	"github.com/h2non/filetype"
+)
+
+var (
+	ErrNoPicture = errors.New("file has no embedded picture")
+
+	// conventional names of album covers, in order of preference
+	coverNames      = []string{"cover", "folder", "front", "album"}
+	coverExtensions = []string{".jpg", ".jpeg", ".png"}
+)
+
+// coverRank returns the preference of name as album cover, or -1 if it
+// isn't one.
+func coverRank(name string) int {
+	name = strings.ToLower(name)
+	ext := filepath.Ext(name)
+	for i, coverName := range coverNames {
+		for j, coverExt := range coverExtensions {
+			if ext == coverExt && strings.TrimSuffix(name, ext) == coverName {
+				return i*len(coverExtensions) + j
+			}
+		}
+	}
+	return -1
+}
+
+// IsCoverImage reports whether name is a conventional album cover name
+// such as cover.jpg or folder.png.
+func IsCoverImage(name string) bool {
+	return coverRank(name) >= 0
+}
+
+// AudioPicture returns the picture embedded in the audio file at fpath and
+// its MIME type.
+func AudioPicture(fpath string) ([]byte, string, error) {
+	fType, err := filetype.MatchFile(fpath)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, ok := audioMetaMimeMap[fType]; !ok {
+		return nil, "", ErrNoPicture
+	}
+	meta, err := getAudioMetadata(fpath, fType)
+	if err != nil {
+		return nil, "", err
+	}
+	picture := meta.Picture()
+	if picture == nil || len(picture.Data) == 0 {
+		return nil, "", ErrNoPicture
+	}
+	mimeType := picture.MIMEType
+	if kind, err := filetype.Image(picture.Data); err == nil && kind != filetype.Unknown {
+		mimeType = kind.MIME.Value
+	}
+	return picture.Data, mimeType, nil
+}
+
+// FindCovers looks up the preferred cover images indexed in the given
+// directories and returns them by directory.
+func FindCovers(ctx context.Context, reader *bluge.Reader, dirs ...string) (map[string]FileInfo, error) {
+	covers := make(map[string]FileInfo)
+	if len(dirs) == 0 {
+		return covers, nil
+	}
+	dirQuery := bluge.NewBooleanQuery()
+	for _, dir := range dirs {
+		dirQuery.AddShould(bluge.NewTermQuery(dir).SetField(properties.Dirname))
+	}
+	query := bluge.NewBooleanQuery().
+		AddMust(dirQuery).
+		AddMust(bluge.NewTermQuery("true").SetField(properties.CoverImage))
+	searchResults, err := reader.Search(ctx, bluge.NewAllMatches(query))
+	if err != nil {
+		return covers, err
+	}
+	next, err := searchResults.Next()
+	for err == nil && next != nil {
+		var fi FileInfo
+		fi, err = DocumentMatchToFileInfo(reader, next)
+		if err != nil {
+			return covers, err
+		}
+		dir := filepath.Dir(fi.Filename)
+		current, ok := covers[dir]
+		rank, currentRank := coverRank(filepath.Base(fi.Filename)), coverRank(filepath.Base(current.Filename))
+		if !ok || rank < currentRank || rank == currentRank && fi.Filename < current.Filename {
+			covers[dir] = fi
+		}
+		next, err = searchResults.Next()
+	}
+	return covers, err
+}
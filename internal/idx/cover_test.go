@@ -0,0 +1,27 @@
+package idx
+
+import (
+	"testing"
+)
+
+func TestIsCoverImage(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected bool
+	}{
+		{"cover.jpg", true},
+		{"Folder.PNG", true},
+		{"front.jpeg", true},
+		{"cover.gif", false},
+		{"covers.jpg", false},
+		{"cover", false},
+	}
+	for _, tt := range tests {
+		if got := IsCoverImage(tt.name); got != tt.expected {
+			t.Fatalf("IsCoverImage(%q): got %v expected %v", tt.name, got, tt.expected)
+		}
+	}
+	if coverRank("cover.png") > coverRank("folder.jpg") {
+		t.Fatal("cover.png should be preferred over folder.jpg")
+	}
+}
@@ -0,0 +1,598 @@
+package idx
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fatalbanana/filetundra/internal/log"
+	"github.com/fatalbanana/filetundra/internal/properties"
+
+	"github.com/blugelabs/bluge"
+	"github.com/h2non/filetype"
+	"github.com/h2non/filetype/matchers"
+	"github.com/h2non/filetype/types"
+	"go.uber.org/zap"
+	"golang.org/x/text/encoding/charmap"
+)
+
+const (
+	BookFormatCBZ  = "cbz"
+	BookFormatEPUB = "epub"
+	BookFormatMOBI = "mobi"
+
+	// upper bound for the size of cover images and mobipocket headers
+	bookMaxCoverSize = 32 << 20
+
+	mobiHeaderSize     = 78
+	mobiExthFlag       = 0x40
+	mobiEncodingCP1252 = 1252
+	mobiNoImage        = 0xffffffff
+
+	exthAuthor      = 100
+	exthISBN        = 104
+	exthCoverOffset = 201
+	exthTitle       = 503
+	exthLanguage    = 524
+)
+
+var (
+	TypeMobi = filetype.NewType("mobi", "application/x-mobipocket-ebook")
+
+	errInvalidMobi = errors.New("invalid mobipocket file")
+	errNoPackage   = errors.New("epub has no package document")
+
+	comicImageExtensions = map[string]struct{}{
+		".gif":  {},
+		".jpeg": {},
+		".jpg":  {},
+		".png":  {},
+		".webp": {},
+	}
+)
+
+func init() {
+	// the built in matcher expects the mimetype member right at the start
+	filetype.AddMatcher(matchers.TypeEpub, zipMimetypeMatcher(matchers.TypeEpub.MIME.Value))
+	filetype.AddMatcher(TypeMobi, func(buf []byte) bool {
+		return len(buf) >= 68 && string(buf[60:68]) == "BOOKMOBI"
+	})
+}
+
+type bookMetadata struct {
+	Authors     []string
+	Format      string
+	ISBN        string
+	Language    string
+	Series      string
+	SeriesIndex float64
+	Title       string
+
+	// zip member or mobipocket record holding the cover image
+	coverMember string
+	coverRecord int
+}
+
+func (m bookMetadata) hasCover() bool {
+	return m.coverMember != "" || m.coverRecord > 0
+}
+
+// bookFormat returns the e-book format of a file, or an empty string if it
+// isn't an e-book. Comic book archives are only told apart by extension.
+func bookFormat(fpath string, fType types.Type) string {
+	switch {
+	case fType == matchers.TypeEpub:
+		return BookFormatEPUB
+	case fType == TypeMobi:
+		return BookFormatMOBI
+	case fType == matchers.TypeZip && strings.EqualFold(filepath.Ext(fpath), ".cbz"):
+		return BookFormatCBZ
+	}
+	return ""
+}
+
+// parseISBN returns the normalized ISBN of an identifier with a valid check
+// digit. Identifiers without an ISBN scheme or prefix must be ISBN-13.
+func parseISBN(value, scheme string) string {
+	value = strings.TrimSpace(value)
+	explicit := strings.EqualFold(scheme, "isbn")
+	for _, prefix := range []string{"urn:isbn:", "isbn:", "isbn "} {
+		if len(value) > len(prefix) && strings.EqualFold(value[:len(prefix)], prefix) {
+			value = value[len(prefix):]
+			explicit = true
+			break
+		}
+	}
+	var isbn []byte
+	for _, r := range value {
+		switch {
+		case r >= '0' && r <= '9':
+			isbn = append(isbn, byte(r))
+		case r == 'x' || r == 'X':
+			isbn = append(isbn, 'X')
+		case r == '-' || r == ' ':
+		default:
+			return ""
+		}
+	}
+	switch len(isbn) {
+	case 10:
+		if !explicit || strings.IndexByte(string(isbn[:9]), 'X') >= 0 {
+			return ""
+		}
+		sum := 0
+		for i, c := range isbn {
+			digit := int(c - '0')
+			if c == 'X' {
+				digit = 10
+			}
+			sum += (10 - i) * digit
+		}
+		if sum%11 != 0 {
+			return ""
+		}
+	case 13:
+		if strings.IndexByte(string(isbn), 'X') >= 0 {
+			return ""
+		}
+		if !explicit && !strings.HasPrefix(string(isbn), "978") && !strings.HasPrefix(string(isbn), "979") {
+			return ""
+		}
+		sum := 0
+		for i, c := range isbn {
+			weight := 1
+			if i%2 == 1 {
+				weight = 3
+			}
+			sum += weight * int(c-'0')
+		}
+		if sum%10 != 0 {
+			return ""
+		}
+	default:
+		return ""
+	}
+	return string(isbn)
+}
+
+type epubContainer struct {
+	Rootfiles []struct {
+		FullPath  string `xml:"full-path,attr"`
+		MediaType string `xml:"media-type,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+type opfMeta struct {
+	Content  string `xml:"content,attr"`
+	ID       string `xml:"id,attr"`
+	Name     string `xml:"name,attr"`
+	Property string `xml:"property,attr"`
+	Refines  string `xml:"refines,attr"`
+	Value    string `xml:",chardata"`
+}
+
+type opfPackage struct {
+	Metadata struct {
+		Creators []struct {
+			ID   string `xml:"id,attr"`
+			Name string `xml:",chardata"`
+			Role string `xml:"role,attr"`
+		} `xml:"creator"`
+		Identifiers []struct {
+			Scheme string `xml:"scheme,attr"`
+			Value  string `xml:",chardata"`
+		} `xml:"identifier"`
+		Languages []string  `xml:"language"`
+		Metas     []opfMeta `xml:"meta"`
+		Titles    []string  `xml:"title"`
+	} `xml:"metadata"`
+	Manifest []struct {
+		Href       string `xml:"href,attr"`
+		ID         string `xml:"id,attr"`
+		Properties string `xml:"properties,attr"`
+	} `xml:"manifest>item"`
+}
+
+// getEpubMetadata reads the Dublin Core metadata of the package document,
+// along with the Calibre and EPUB 3 series conventions.
+func getEpubMetadata(z *zip.Reader) (meta bookMetadata, err error) {
+	var container epubContainer
+	err = decodePart(z, "META-INF/container.xml", &container)
+	if err != nil {
+		return meta, err
+	}
+	var packagePath string
+	for _, rootfile := range container.Rootfiles {
+		if rootfile.MediaType == "application/oebps-package+xml" || packagePath == "" {
+			packagePath = rootfile.FullPath
+		}
+	}
+	if packagePath == "" {
+		return meta, errNoPackage
+	}
+	var pkg opfPackage
+	err = decodePart(z, packagePath, &pkg)
+	if err != nil {
+		return meta, err
+	}
+
+	// EPUB 3 attaches properties to elements by refining their ids
+	refinements := make(map[string]map[string]string)
+	for _, m := range pkg.Metadata.Metas {
+		if !strings.HasPrefix(m.Refines, "#") {
+			continue
+		}
+		id := strings.TrimPrefix(m.Refines, "#")
+		if refinements[id] == nil {
+			refinements[id] = make(map[string]string)
+		}
+		refinements[id][m.Property] = strings.TrimSpace(m.Value)
+	}
+
+	for _, title := range pkg.Metadata.Titles {
+		if title = strings.TrimSpace(title); title != "" {
+			meta.Title = title
+			break
+		}
+	}
+	for _, creator := range pkg.Metadata.Creators {
+		role := creator.Role
+		if role == "" {
+			role = refinements[creator.ID]["role"]
+		}
+		if role == "" || role == "aut" {
+			meta.Authors = appendUnique(meta.Authors, strings.TrimSpace(creator.Name))
+		}
+	}
+	for _, lang := range pkg.Metadata.Languages {
+		if lang = normalizeLanguage(lang); lang != "" {
+			meta.Language = lang
+			break
+		}
+	}
+	for _, identifier := range pkg.Metadata.Identifiers {
+		if meta.ISBN = parseISBN(identifier.Value, identifier.Scheme); meta.ISBN != "" {
+			break
+		}
+	}
+	var coverID string
+	for _, m := range pkg.Metadata.Metas {
+		switch {
+		case m.Name == "calibre:series":
+			meta.Series = strings.TrimSpace(m.Content)
+		case m.Name == "calibre:series_index":
+			meta.SeriesIndex, _ = strconv.ParseFloat(strings.TrimSpace(m.Content), 64)
+		case m.Name == "cover":
+			coverID = m.Content
+		case m.Property == "belongs-to-collection" && meta.Series == "":
+			collectionType := refinements[m.ID]["collection-type"]
+			if collectionType != "" && collectionType != "series" {
+				continue
+			}
+			meta.Series = strings.TrimSpace(m.Value)
+			meta.SeriesIndex, _ = strconv.ParseFloat(refinements[m.ID]["group-position"], 64)
+		}
+	}
+	for _, item := range pkg.Manifest {
+		isCover := coverID != "" && item.ID == coverID
+		if coverID == "" {
+			for _, property := range strings.Fields(item.Properties) {
+				isCover = isCover || property == "cover-image"
+			}
+		}
+		if !isCover {
+			continue
+		}
+		href, err := url.PathUnescape(item.Href)
+		if err != nil {
+			href = item.Href
+		}
+		meta.coverMember = path.Join(path.Dir(packagePath), href)
+		break
+	}
+	return meta, nil
+}
+
+type comicInfo struct {
+	LanguageISO string `xml:"LanguageISO"`
+	GTIN        string `xml:"GTIN"`
+	Number      string `xml:"Number"`
+	Pages       []struct {
+		Image int    `xml:"Image,attr"`
+		Type  string `xml:"Type,attr"`
+	} `xml:"Pages>Page"`
+	Series string `xml:"Series"`
+	Title  string `xml:"Title"`
+	Writer string `xml:"Writer"`
+}
+
+// getComicMetadata reads the ComicInfo.xml of a comic book archive, taking
+// the front cover page or else the first image as cover.
+func getComicMetadata(z *zip.Reader) (meta bookMetadata, err error) {
+	var images []string
+	for _, zf := range z.File {
+		if _, ok := comicImageExtensions[strings.ToLower(path.Ext(zf.Name))]; ok && !zf.FileInfo().IsDir() {
+			images = append(images, zf.Name)
+		}
+	}
+	sort.Strings(images)
+
+	var info comicInfo
+	err = decodePart(z, "ComicInfo.xml", &info)
+	if err != nil && err != ErrMemberNotFound {
+		return meta, err
+	}
+	meta.Title = strings.TrimSpace(info.Title)
+	meta.Series = strings.TrimSpace(info.Series)
+	meta.SeriesIndex, _ = strconv.ParseFloat(strings.TrimSpace(info.Number), 64)
+	meta.Language = normalizeLanguage(info.LanguageISO)
+	meta.ISBN = parseISBN(info.GTIN, "")
+	for _, writer := range strings.Split(info.Writer, ",") {
+		meta.Authors = appendUnique(meta.Authors, strings.TrimSpace(writer))
+	}
+	if len(images) > 0 {
+		meta.coverMember = images[0]
+	}
+	for _, page := range info.Pages {
+		if page.Type == "FrontCover" && page.Image >= 0 && page.Image < len(images) {
+			meta.coverMember = images[page.Image]
+			break
+		}
+	}
+	return meta, nil
+}
+
+// readMobiRecords returns the offsets of the records of a Palm database,
+// followed by its size.
+func readMobiRecords(r io.ReaderAt, size int64) ([]int64, error) {
+	header := make([]byte, mobiHeaderSize)
+	_, err := r.ReadAt(header, 0)
+	if err != nil {
+		return nil, err
+	}
+	count := int(binary.BigEndian.Uint16(header[76:]))
+	list := make([]byte, 8*count)
+	_, err = r.ReadAt(list, mobiHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	offsets := make([]int64, count+1)
+	for i := 0; i < count; i++ {
+		offsets[i] = int64(binary.BigEndian.Uint32(list[8*i:]))
+		if offsets[i] > size || i > 0 && offsets[i] < offsets[i-1] {
+			return nil, errInvalidMobi
+		}
+	}
+	offsets[count] = size
+	return offsets, nil
+}
+
+func readMobiRecord(r io.ReaderAt, offsets []int64, i int) ([]byte, error) {
+	if i < 0 || i >= len(offsets)-1 {
+		return nil, errInvalidMobi
+	}
+	size := offsets[i+1] - offsets[i]
+	if size > bookMaxCoverSize {
+		return nil, errInvalidMobi
+	}
+	record := make([]byte, size)
+	_, err := r.ReadAt(record, offsets[i])
+	return record, err
+}
+
+// getMobiMetadata reads the full name and EXTH records of the first record
+// of a Mobipocket file.
+func getMobiMetadata(r io.ReaderAt, size int64) (meta bookMetadata, err error) {
+	offsets, err := readMobiRecords(r, size)
+	if err != nil {
+		return meta, err
+	}
+	record, err := readMobiRecord(r, offsets, 0)
+	if err != nil {
+		return meta, err
+	}
+	// the MOBI header follows the 16 byte PalmDOC header
+	if len(record) < 132 || string(record[16:20]) != "MOBI" {
+		return meta, errInvalidMobi
+	}
+	headerLength := int(binary.BigEndian.Uint32(record[20:]))
+	encoding := binary.BigEndian.Uint32(record[28:])
+	decode := func(b []byte) string {
+		s := string(b)
+		if encoding == mobiEncodingCP1252 {
+			s, _ = charmap.Windows1252.NewDecoder().String(s)
+		}
+		return strings.TrimSpace(s)
+	}
+	nameOffset := int(binary.BigEndian.Uint32(record[84:]))
+	nameLength := int(binary.BigEndian.Uint32(record[88:]))
+	if nameOffset+nameLength <= len(record) {
+		meta.Title = decode(record[nameOffset : nameOffset+nameLength])
+	}
+	firstImage := binary.BigEndian.Uint32(record[108:])
+	if binary.BigEndian.Uint32(record[128:])&mobiExthFlag == 0 {
+		return meta, nil
+	}
+
+	if 16+headerLength+12 > len(record) {
+		return meta, errInvalidMobi
+	}
+	exth := record[16+headerLength:]
+	if string(exth[:4]) != "EXTH" {
+		return meta, errInvalidMobi
+	}
+	count := int(binary.BigEndian.Uint32(exth[8:]))
+	exth = exth[12:]
+	for i := 0; i < count && len(exth) >= 8; i++ {
+		recordType := binary.BigEndian.Uint32(exth)
+		recordLength := int(binary.BigEndian.Uint32(exth[4:]))
+		if recordLength < 8 || recordLength > len(exth) {
+			return meta, errInvalidMobi
+		}
+		data := exth[8:recordLength]
+		exth = exth[recordLength:]
+		switch recordType {
+		case exthAuthor:
+			meta.Authors = appendUnique(meta.Authors, decode(data))
+		case exthISBN:
+			meta.ISBN = parseISBN(decode(data), "isbn")
+		case exthTitle:
+			meta.Title = decode(data)
+		case exthLanguage:
+			meta.Language = normalizeLanguage(decode(data))
+		case exthCoverOffset:
+			if len(data) == 4 && firstImage != mobiNoImage {
+				coverRecord := int64(firstImage) + int64(binary.BigEndian.Uint32(data))
+				if coverRecord < int64(len(offsets)-1) {
+					meta.coverRecord = int(coverRecord)
+				}
+			}
+		}
+	}
+	return meta, nil
+}
+
+func getBookMetadata(fpath string, fType types.Type) (meta bookMetadata, err error) {
+	format := bookFormat(fpath, fType)
+	f, err := os.Open(fpath) // #nosec: shut up
+	if err != nil {
+		return meta, err
+	}
+	defer func() {
+		err := f.Close()
+		if err != nil {
+			log.Logger.Error("error closing file",
+				zap.String("path", fpath), zap.Error(err))
+		}
+	}()
+	si, err := f.Stat()
+	if err != nil {
+		return meta, err
+	}
+
+	if format == BookFormatMOBI {
+		meta, err = getMobiMetadata(f, si.Size())
+		meta.Format = format
+		return meta, err
+	}
+	z, err := zip.NewReader(f, si.Size())
+	if err != nil {
+		return meta, err
+	}
+	if format == BookFormatEPUB {
+		meta, err = getEpubMetadata(z)
+	} else {
+		meta, err = getComicMetadata(z)
+	}
+	meta.Format = format
+	return meta, err
+}
+
+// BookCover returns the cover image of the e-book at fpath and its MIME
+// type.
+func BookCover(fpath string) ([]byte, string, error) {
+	fType, err := filetype.MatchFile(fpath)
+	if err != nil {
+		return nil, "", err
+	}
+	if bookFormat(fpath, fType) == "" {
+		return nil, "", ErrNoPicture
+	}
+	meta, err := getBookMetadata(fpath, fType)
+	if err != nil {
+		return nil, "", err
+	}
+	var data []byte
+	switch {
+	case meta.coverMember != "":
+		z, err := zip.OpenReader(fpath)
+		if err != nil {
+			return nil, "", err
+		}
+		defer z.Close()
+		rc, err := openPart(&z.Reader, meta.coverMember)
+		if err != nil {
+			return nil, "", err
+		}
+		defer rc.Close()
+		data, err = io.ReadAll(io.LimitReader(rc, bookMaxCoverSize))
+		if err != nil {
+			return nil, "", err
+		}
+	case meta.coverRecord > 0:
+		f, err := os.Open(fpath) // #nosec: shut up
+		if err != nil {
+			return nil, "", err
+		}
+		defer f.Close()
+		si, err := f.Stat()
+		if err != nil {
+			return nil, "", err
+		}
+		offsets, err := readMobiRecords(f, si.Size())
+		if err != nil {
+			return nil, "", err
+		}
+		data, err = readMobiRecord(f, offsets, meta.coverRecord)
+		if err != nil {
+			return nil, "", err
+		}
+	default:
+		return nil, "", ErrNoPicture
+	}
+	kind, err := filetype.Image(data)
+	if err != nil || kind == filetype.Unknown {
+		return nil, "", ErrNoPicture
+	}
+	return data, kind.MIME.Value, nil
+}
+
+func maybeProcessBook(fpath string, fType types.Type, doc *bluge.Document) {
+	if bookFormat(fpath, fType) == "" {
+		return
+	}
+	meta, err := getBookMetadata(fpath, fType)
+	if err != nil {
+		log.Logger.Error("error getting book metadata",
+			zap.String("path", fpath), zap.Error(err))
+		return
+	}
+	doc.AddField(bluge.NewKeywordField(properties.BookFormat, meta.Format).StoreValue())
+	// catalogs list books by series, position and title
+	sortTitle := meta.Title
+	if sortTitle == "" {
+		sortTitle = filepath.Base(fpath)
+	}
+	doc.AddField(bluge.NewKeywordField(properties.SortTitle, strings.ToLower(sortTitle)).Sortable())
+	if meta.Title != "" {
+		doc.AddField(bluge.NewTextField(properties.BookTitle, meta.Title).WithAnalyzer(BlugeAnalyzer).StoreValue().HighlightMatches())
+	}
+	for _, author := range meta.Authors {
+		doc.AddField(bluge.NewTextField(properties.BookAuthor, author).StoreValue().HighlightMatches()).
+			AddField(bluge.NewKeywordField(properties.FacetBookAuthor, author).Aggregatable())
+	}
+	if meta.Series != "" {
+		doc.AddField(bluge.NewTextField(properties.BookSeries, meta.Series).StoreValue().HighlightMatches()).
+			AddField(bluge.NewKeywordField(properties.FacetBookSeries, meta.Series).Aggregatable())
+		if meta.SeriesIndex > 0 {
+			doc.AddField(bluge.NewNumericField(properties.BookSeriesIndex, meta.SeriesIndex).StoreValue().Sortable())
+		}
+	}
+	if meta.ISBN != "" {
+		doc.AddField(bluge.NewKeywordField(properties.BookISBN, meta.ISBN).StoreValue())
+	}
+	if meta.Language != "" {
+		doc.AddField(bluge.NewKeywordField(properties.BookLanguage, meta.Language).StoreValue())
+	}
+	if meta.hasCover() {
+		doc.AddField(bluge.NewKeywordField(properties.BookCover, "true").StoreValue())
+	}
+}
@@ -0,0 +1,221 @@
+package idx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/h2non/filetype"
+	"github.com/h2non/filetype/matchers"
+	"github.com/h2non/filetype/types"
+)
+
+const (
+	testContainerXML = `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+<rootfiles><rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/></rootfiles></container>`
+	testOPF2 = `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0" unique-identifier="uid">
+<metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf">
+<dc:title>The Colour of Magic</dc:title>
+<dc:creator opf:role="aut">Terry Pratchett</dc:creator>
+<dc:creator opf:role="ill">Josh Kirby</dc:creator>
+<dc:language>en</dc:language>
+<dc:identifier id="uid" opf:scheme="uuid">0b1c2d3e</dc:identifier>
+<dc:identifier opf:scheme="ISBN">0-552-12475-3</dc:identifier>
+<meta name="calibre:series" content="Discworld"/>
+<meta name="calibre:series_index" content="1.0"/>
+<meta name="cover" content="cover-img"/>
+</metadata>
+<manifest><item id="cover-img" href="images/cover%20front.png" media-type="image/png"/></manifest></package>`
+	testOPF3 = `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uid">
+<metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+<dc:title>Leviathan Wakes</dc:title>
+<dc:creator id="a1">Daniel Abraham</dc:creator>
+<meta refines="#a1" property="role" scheme="marc:relators">aut</meta>
+<dc:creator id="a2">Ty Franck</dc:creator>
+<dc:creator id="e1">Some Editor</dc:creator>
+<meta refines="#e1" property="role" scheme="marc:relators">edt</meta>
+<dc:language>en-US</dc:language>
+<dc:identifier id="uid">urn:isbn:978-0-316-12908-4</dc:identifier>
+<meta property="belongs-to-collection" id="c1">The Expanse</meta>
+<meta refines="#c1" property="collection-type">series</meta>
+<meta refines="#c1" property="group-position">1</meta>
+</metadata>
+<manifest><item id="c" href="cover.png" properties="cover-image" media-type="image/png"/></manifest></package>`
+	testComicInfo = `<?xml version="1.0"?>
+<ComicInfo><Title>Origins</Title><Series>Astro Kid</Series><Number>3</Number>
+<Writer>Ann Writer, Bob Writer</Writer><LanguageISO>fr</LanguageISO>
+<Pages><Page Image="0" Type="InnerCover"/><Page Image="1" Type="FrontCover"/></Pages></ComicInfo>`
+)
+
+func makeTestEpub(t *testing.T, opf string, coverPath string, cover []byte) []byte {
+	return makeTestOfficeZip(t,
+		[2]string{"mimetype", matchers.TypeEpub.MIME.Value},
+		[2]string{"META-INF/container.xml", testContainerXML},
+		[2]string{"OEBPS/content.opf", opf},
+		[2]string{coverPath, string(cover)},
+	)
+}
+
+func makeTestCbz(t *testing.T, cover []byte) []byte {
+	return makeTestOfficeZip(t,
+		[2]string{"page02.png", "last page"},
+		[2]string{"page00.png", "inner cover"},
+		[2]string{"ComicInfo.xml", testComicInfo},
+		[2]string{"page01.png", string(cover)},
+	)
+}
+
+func exthRecord(recordType uint32, data []byte) []byte {
+	record := appendUint32(binary.BigEndian, nil, recordType)
+	record = appendUint32(binary.BigEndian, record, uint32(len(data)+8))
+	return append(record, data...)
+}
+
+// makeTestMobi builds a Mobipocket file of a header, a text and an image
+// record.
+func makeTestMobi(cover []byte) []byte {
+	exth := append(exthRecord(exthAuthor, []byte("Mary Shelley")),
+		exthRecord(exthISBN, []byte("978-0-14-143947-1"))...)
+	exth = append(exth, exthRecord(exthLanguage, []byte("en"))...)
+	exth = append(exth, exthRecord(exthCoverOffset, []byte{0, 0, 0, 0})...)
+	exth = append(append([]byte("EXTH"), appendUint32(binary.BigEndian, nil, uint32(len(exth)+12))...),
+		append(appendUint32(binary.BigEndian, nil, 4), exth...)...)
+
+	const headerLength = 232
+	record0 := make([]byte, 16+headerLength)
+	copy(record0[16:], "MOBI")
+	binary.BigEndian.PutUint32(record0[20:], headerLength)
+	binary.BigEndian.PutUint32(record0[28:], mobiEncodingCP1252)
+	binary.BigEndian.PutUint32(record0[108:], 2)
+	binary.BigEndian.PutUint32(record0[128:], mobiExthFlag)
+	record0 = append(record0, exth...)
+	name := []byte("Frankenstein; or, The Modern Prometheus \xe9")
+	binary.BigEndian.PutUint32(record0[84:], uint32(len(record0)))
+	binary.BigEndian.PutUint32(record0[88:], uint32(len(name)))
+	record0 = append(record0, name...)
+
+	records := [][]byte{record0, []byte("text"), cover}
+	header := make([]byte, mobiHeaderSize)
+	copy(header, "Frankenstein")
+	copy(header[60:], "BOOKMOBI")
+	binary.BigEndian.PutUint16(header[76:], uint16(len(records)))
+	offset := uint32(mobiHeaderSize + 8*len(records))
+	for _, record := range records {
+		header = appendUint32(binary.BigEndian, header, offset)
+		header = appendUint32(binary.BigEndian, header, 0)
+		offset += uint32(len(record))
+	}
+	return append(header, bytes.Join(records, nil)...)
+}
+
+func TestParseISBN(t *testing.T) {
+	tests := []struct {
+		value    string
+		scheme   string
+		expected string
+	}{
+		{"978-0-316-12908-4", "", "9780316129084"},
+		{"urn:isbn:0-552-12475-3", "", "0552124753"},
+		{"0-8044-2957-X", "ISBN", "080442957X"},
+		{"0552124753", "", ""},
+		{"978-0-316-12908-5", "", ""},
+		{"1234567890123", "", ""},
+		{"0b1c2d3e", "uuid", ""},
+	}
+	for _, tt := range tests {
+		if got := parseISBN(tt.value, tt.scheme); got != tt.expected {
+			t.Fatalf("unexpected ISBN of %q: got %q expected %q", tt.value, got, tt.expected)
+		}
+	}
+}
+
+func TestGetBookMetadata(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "filetundra_books")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cover := makeTestPng(t)
+	tests := []struct {
+		name     string
+		fType    types.Type
+		data     []byte
+		expected bookMetadata
+	}{
+		{"magic.epub", matchers.TypeEpub, makeTestEpub(t, testOPF2, "OEBPS/images/cover front.png", cover), bookMetadata{
+			Authors:     []string{"Terry Pratchett"},
+			Format:      BookFormatEPUB,
+			ISBN:        "0552124753",
+			Language:    "en",
+			Series:      "Discworld",
+			SeriesIndex: 1,
+			Title:       "The Colour of Magic",
+			coverMember: "OEBPS/images/cover front.png",
+		}},
+		{"leviathan.epub", matchers.TypeEpub, makeTestEpub(t, testOPF3, "OEBPS/cover.png", cover), bookMetadata{
+			Authors:     []string{"Daniel Abraham", "Ty Franck"},
+			Format:      BookFormatEPUB,
+			ISBN:        "9780316129084",
+			Language:    "en-us",
+			Series:      "The Expanse",
+			SeriesIndex: 1,
+			Title:       "Leviathan Wakes",
+			coverMember: "OEBPS/cover.png",
+		}},
+		{"astro.cbz", matchers.TypeZip, makeTestCbz(t, cover), bookMetadata{
+			Authors:     []string{"Ann Writer", "Bob Writer"},
+			Format:      BookFormatCBZ,
+			Language:    "fr",
+			Series:      "Astro Kid",
+			SeriesIndex: 3,
+			Title:       "Origins",
+			coverMember: "page01.png",
+		}},
+		{"frankenstein.mobi", TypeMobi, makeTestMobi(cover), bookMetadata{
+			Authors:     []string{"Mary Shelley"},
+			Format:      BookFormatMOBI,
+			ISBN:        "9780141439471",
+			Language:    "en",
+			Title:       "Frankenstein; or, The Modern Prometheus é",
+			coverRecord: 2,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fpath := filepath.Join(tempDir, tt.name)
+			err := ioutil.WriteFile(fpath, tt.data, 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fType, err := filetype.MatchFile(fpath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fType != tt.fType {
+				t.Fatalf("unexpected file type: got %v expected %v", fType, tt.fType)
+			}
+			meta, err := getBookMetadata(fpath, fType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(meta, tt.expected) {
+				t.Fatalf("unexpected book metadata: got %+v expected %+v", meta, tt.expected)
+			}
+			data, mimeType, err := BookCover(fpath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mimeType != "image/png" || !bytes.Equal(data, cover) {
+				t.Fatalf("unexpected cover: got %d bytes of %s", len(data), mimeType)
+			}
+		})
+	}
+}
@@ -2,38 +2,139 @@ package idx
 
 import (
 	"context"
-	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/fatalbanana/filetundra/internal/env"
+	"github.com/fatalbanana/filetundra/internal/log"
 	"github.com/fatalbanana/filetundra/internal/properties"
 
 	"github.com/blugelabs/bluge"
+	"github.com/blugelabs/bluge/index"
 	"github.com/h2non/filetype"
 	"github.com/h2non/filetype/types"
+	"go.uber.org/zap"
 )
 
 var (
 	ErrNeedsUpdate = errors.New("file is already indexed but needs update")
+
+	// bluge allows only one writer per index
+	writerMu sync.Mutex
 )
 
+// FileInfo is the metadata of an indexed file. Its JSON encoding leaves out
+// the absolute paths of the file on the server.
 type FileInfo struct {
-	ArchiveFilename []string
-	AudioAlbum      string
-	AudioArtist     string
-	AudioTitle      string
-	BareBasename    string
-	Extname         string
-	Dirname         string
-	Filename        string
-	MimeType        string
-	ModTime         time.Time
-	Size            int64
+	ArchiveFilename        []string      `json:"archive_filename,omitempty"`
+	AudioAlbum             string        `json:"audio_album,omitempty"`
+	AudioAlbumArtist       string        `json:"audio_album_artist,omitempty"`
+	AudioArtist            string        `json:"audio_artist,omitempty"`
+	AudioArtwork           bool          `json:"audio_artwork,omitempty"`
+	AudioBitrate           int           `json:"audio_bitrate,omitempty"`
+	AudioComposer          string        `json:"audio_composer,omitempty"`
+	AudioDisc              int           `json:"audio_disc,omitempty"`
+	AudioDiscs             int           `json:"audio_discs,omitempty"`
+	AudioDuration          time.Duration `json:"audio_duration,omitempty"`
+	AudioGenre             string        `json:"audio_genre,omitempty"`
+	AudioTitle             string        `json:"audio_title,omitempty"`
+	AudioTrack             int           `json:"audio_track,omitempty"`
+	AudioTracks            int           `json:"audio_tracks,omitempty"`
+	AudioYear              int           `json:"audio_year,omitempty"`
+	BareBasename           string        `json:"bare_basename"`
+	BookAuthors            []string      `json:"book_authors,omitempty"`
+	BookCover              bool          `json:"book_cover,omitempty"`
+	BookFormat             string        `json:"book_format,omitempty"`
+	BookISBN               string        `json:"book_isbn,omitempty"`
+	BookLanguage           string        `json:"book_language,omitempty"`
+	BookSeries             string        `json:"book_series,omitempty"`
+	BookSeriesIndex        float64       `json:"book_series_index,omitempty"`
+	BookTitle              string        `json:"book_title,omitempty"`
+	Extname                string        `json:"extname"`
+	Dirname                string        `json:"-"`
+	Filename               string        `json:"-"`
+	ImageDateTaken         time.Time     `json:"image_date_taken,omitempty"`
+	ImageHeight            int           `json:"image_height,omitempty"`
+	ImageLens              string        `json:"image_lens,omitempty"`
+	ImageLocation          *GeoPoint     `json:"image_location,omitempty"`
+	ImageMake              string        `json:"image_make,omitempty"`
+	ImageModel             string        `json:"image_model,omitempty"`
+	ImageOrientation       int           `json:"image_orientation,omitempty"`
+	ImageWidth             int           `json:"image_width,omitempty"`
+	MimeType               string        `json:"mime_type"`
+	ModTime                time.Time     `json:"mod_time"`
+	OfficeCreated          time.Time     `json:"office_created,omitempty"`
+	OfficeCreator          string        `json:"office_creator,omitempty"`
+	OfficeLastModifiedBy   string        `json:"office_last_modified_by,omitempty"`
+	OfficeTitle            string        `json:"office_title,omitempty"`
+	PDFAuthor              string        `json:"pdf_author,omitempty"`
+	PDFPages               int           `json:"pdf_pages,omitempty"`
+	PDFSubject             string        `json:"pdf_subject,omitempty"`
+	PDFTitle               string        `json:"pdf_title,omitempty"`
+	Size                   int64         `json:"size"`
+	VideoAudioCodecs       []string      `json:"video_audio_codecs,omitempty"`
+	VideoAudioLanguages    []string      `json:"video_audio_languages,omitempty"`
+	VideoCodec             string        `json:"video_codec,omitempty"`
+	VideoDuration          time.Duration `json:"video_duration,omitempty"`
+	VideoFrameRate         float64       `json:"video_frame_rate,omitempty"`
+	VideoHeight            int           `json:"video_height,omitempty"`
+	VideoResolution        string        `json:"video_resolution,omitempty"`
+	VideoSubtitleLanguages []string      `json:"video_subtitle_languages,omitempty"`
+	VideoTitle             string        `json:"video_title,omitempty"`
+	VideoWidth             int           `json:"video_width,omitempty"`
+}
+
+// MarshalJSON encodes durations in seconds and leaves out unknown times and
+// sizes.
+func (fi FileInfo) MarshalJSON() ([]byte, error) {
+	type fileInfo FileInfo
+	optionalTime := func(t time.Time) *time.Time {
+		if t.IsZero() {
+			return nil
+		}
+		return &t
+	}
+	var size *int64
+	if fi.Size >= 0 {
+		size = &fi.Size
+	}
+	return json.Marshal(struct {
+		fileInfo
+		AudioDuration  float64    `json:"audio_duration,omitempty"`
+		ImageDateTaken *time.Time `json:"image_date_taken,omitempty"`
+		OfficeCreated  *time.Time `json:"office_created,omitempty"`
+		Size           *int64     `json:"size,omitempty"`
+		VideoDuration  float64    `json:"video_duration,omitempty"`
+	}{
+		fileInfo:       fileInfo(fi),
+		AudioDuration:  fi.AudioDuration.Seconds(),
+		ImageDateTaken: optionalTime(fi.ImageDateTaken),
+		OfficeCreated:  optionalTime(fi.OfficeCreated),
+		Size:           size,
+		VideoDuration:  fi.VideoDuration.Seconds(),
+	})
+}
+
+// ancestors returns the directories containing fpath up to and including
+// the root, so that searches can be limited to a subtree with a term query.
+func ancestors(fpath string) []string {
+	var res []string
+	root := filepath.Clean(env.Env.Root)
+	for dir := filepath.Dir(fpath); strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		res = append(res, dir)
+		if dir == root {
+			break
+		}
+	}
+	return res
 }
 
 func FileToDocument(fpath string, d fs.DirEntry) (*bluge.Document, error) {
@@ -42,39 +143,53 @@ func FileToDocument(fpath string, d fs.DirEntry) (*bluge.Document, error) {
 	if err != nil {
 		return doc, err
 	}
-	encodedSize := make([]byte, binary.MaxVarintLen64)
-	encodedModTime := make([]byte, binary.MaxVarintLen64)
-	n := binary.PutVarint(encodedSize, statInfo.Size())
-	encodedSize = encodedSize[:n]
-	n = binary.PutVarint(encodedModTime, statInfo.ModTime().Unix())
-	encodedModTime = encodedModTime[:n]
-	doc.AddField(bluge.NewKeywordField(properties.Size, string(encodedSize)).StoreValue()).
-		AddField(bluge.NewKeywordField(properties.ModifiedTime, string(encodedModTime)).StoreValue())
+	doc.AddField(bluge.NewNumericField(properties.Size, float64(statInfo.Size())).StoreValue().Sortable()).
+		AddField(bluge.NewDateTimeField(properties.ModifiedTime, statInfo.ModTime()).StoreValue().Sortable()).
+		AddField(bluge.NewKeywordField(properties.FacetYear, strconv.Itoa(statInfo.ModTime().Year())).Aggregatable())
 	basename := filepath.Base(fpath)
 	extName := filepath.Ext(basename)
 	if extName != "" {
 		basename = strings.TrimSuffix(basename, extName)
-		doc.AddField(bluge.NewKeywordField(properties.Extname, extName).StoreValue())
+		doc.AddField(bluge.NewKeywordField(properties.Extname, extName).StoreValue()).
+			AddField(bluge.NewKeywordField(properties.FacetExtension, strings.ToLower(extName)).Aggregatable())
+	}
+	doc.AddField(bluge.NewTextField(properties.BareBasename, basename).WithAnalyzer(BlugeAnalyzer).StoreValue().HighlightMatches()).
+		AddField(bluge.NewKeywordField(properties.SortName, filepath.Base(fpath)).Sortable()).
+		AddField(bluge.NewKeywordField(properties.Dirname, filepath.Dir(fpath)).HighlightMatches()).
+		AddField(newSuggestField(properties.SuggestName, basename, basename))
+	for _, dir := range ancestors(fpath) {
+		doc.AddField(bluge.NewKeywordField(properties.Ancestor, dir))
 	}
-	doc.AddField(bluge.NewTextField(properties.BareBasename, basename).WithAnalyzer(BlugeAnalyzer).StoreValue()).
-		AddField(bluge.NewKeywordField(properties.Dirname, filepath.Dir(fpath)))
 	var fType types.Type
+	mimeType := "inode/directory"
 	if d.IsDir() {
-		doc.AddField(bluge.NewTextField(properties.MimeType, "inode/directory").StoreValue())
+		if rel := filepath.ToSlash(strings.TrimPrefix(fpath, env.Env.Root)); rel != "" {
+			doc.AddField(newSuggestField(properties.SuggestDirectory, filepath.Base(fpath), rel))
+		}
 	} else {
 		fType, err = filetype.MatchFile(fpath)
 		if err != nil {
 			return doc, err
-		} else {
-			if fType.MIME.Value == "" {
-				doc.AddField(bluge.NewTextField(properties.MimeType, "application/octet-stream").StoreValue()) // XXX: text?
-			} else {
-				doc.AddField(bluge.NewTextField(properties.MimeType, fType.MIME.Value).StoreValue())
+		}
+		mimeType = fType.MIME.Value
+		if mimeType == "" {
+			mimeType = "application/octet-stream"
+			if maybeProcessText(fpath, doc) {
+				mimeType = TextMimeType
 			}
 		}
 	}
+	doc.AddField(bluge.NewTextField(properties.MimeType, mimeType).StoreValue()).
+		AddField(bluge.NewKeywordField(properties.SortType, mimeType).Sortable())
+	majorType, _, _ := strings.Cut(mimeType, "/")
+	doc.AddField(bluge.NewKeywordField(properties.FacetType, majorType).Aggregatable())
 	maybeProcessAudio(fpath, fType, doc)
+	maybeProcessImage(fpath, fType, doc)
 	maybeProcessArchive(fpath, fType, doc)
+	maybeProcessPDF(fpath, fType, doc)
+	maybeProcessOffice(fpath, fType, doc)
+	maybeProcessBook(fpath, fType, doc)
+	maybeProcessVideo(fpath, fType, doc)
 	return doc, nil
 }
 
@@ -95,7 +210,7 @@ func haveExisting(rdr *bluge.Reader, fpath string, d fs.DirEntry) (bool, error)
 		if err != nil {
 			return false, err
 		}
-		if si.ModTime().After(fi.ModTime) {
+		if !si.ModTime().Equal(fi.ModTime) || si.Size() != fi.Size {
 			return true, ErrNeedsUpdate
 		}
 		return true, nil
@@ -107,41 +222,88 @@ func haveExistingNone(rdr *bluge.Reader, fpath string, d fs.DirEntry) (bool, err
 	return false, nil
 }
 
-func walk(reader *bluge.Reader, haveExisting func(*bluge.Reader, string, fs.DirEntry) (bool, error)) error {
-	batch := bluge.NewBatch()
-	err := filepath.WalkDir(env.Env.Root, func(fpath string, d fs.DirEntry, err error) error {
-		var needsUpdate bool
-		if err != nil {
-			return err
+// UpdateStats counts the documents changed by an indexing run.
+type UpdateStats struct {
+	Added   int `json:"added"`
+	Updated int `json:"updated"`
+	Removed int `json:"removed"`
+}
+
+func walk(reader *bluge.Reader, haveExisting func(*bluge.Reader, string, fs.DirEntry) (bool, error)) (stats UpdateStats, err error) {
+	startRun()
+	defer func() { finishRun(stats, err) }()
+	bw := newBatchWriter()
+	err = runPipeline(reader, haveExisting, func(res indexResult) error {
+		if res.needsUpdate {
+			stats.Updated++
+		} else {
+			stats.Added++
 		}
-		if fpath == env.Env.Root {
-			return nil
+		if reader != nil {
+			// the watcher may have indexed the file since reader was opened
+			return bw.Update(res.doc)
 		}
-		doHaveExisting, err := haveExisting(reader, fpath, d)
+		return bw.Insert(res.doc)
+	})
+	if err != nil {
+		return stats, err
+	}
+	if reader != nil {
+		stats.Removed, err = prune(reader, bw)
 		if err != nil {
-			if err == ErrNeedsUpdate {
-				needsUpdate = true
-			} else {
-				return err
-			}
+			return stats, err
 		}
-		if doHaveExisting && !needsUpdate {
-			return nil
-		}
-		doc, err := FileToDocument(fpath, d)
+	}
+	return stats, bw.Flush()
+}
+
+// prune deletes documents whose files no longer exist below the root.
+func prune(reader *bluge.Reader, bw *batchWriter) (int, error) {
+	var removed int
+	rootPrefix := strings.TrimSuffix(env.Env.Root, string(filepath.Separator)) + string(filepath.Separator)
+	searchResults, err := reader.Search(context.TODO(), bluge.NewAllMatches(bluge.NewMatchAllQuery()))
+	if err != nil {
+		return removed, err
+	}
+	next, err := searchResults.Next()
+	for err == nil && next != nil {
+		var fpath string
+		err = next.VisitStoredFields(func(field string, value []byte) bool {
+			if field == "_id" {
+				fpath = string(value)
+				return false
+			}
+			return true
+		})
 		if err != nil {
-			return err
+			return removed, err
 		}
-		if needsUpdate {
-			batch.Update(doc.ID(), doc)
-		} else {
-			batch.Insert(doc)
+		_, err = os.Stat(fpath)
+		if !strings.HasPrefix(fpath, rootPrefix) || isGone(err) {
+			err = bw.Delete(bluge.Identifier(fpath))
+			if err != nil {
+				return removed, err
+			}
+			removed++
+		} else if err != nil {
+			// keep files which can't be checked right now
+			log.Logger.Error("error checking indexed file",
+				zap.String("path", fpath), zap.Error(err))
 		}
-		return nil
-	})
-	if err != nil {
-		return err
+		next, err = searchResults.Next()
 	}
+	return removed, err
+}
+
+// isGone reports whether a stat error means that the file doesn't exist,
+// which includes a part of its path having become a file.
+func isGone(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR)
+}
+
+func writeBatch(batch *index.Batch) error {
+	writerMu.Lock()
+	defer writerMu.Unlock()
 	writer, err := bluge.OpenWriter(BlugeConfig)
 	if err != nil {
 		return err
@@ -150,14 +312,16 @@ func walk(reader *bluge.Reader, haveExisting func(*bluge.Reader, string, fs.DirE
 	return writer.Batch(batch)
 }
 
-func Initial() error {
+func Initial() (UpdateStats, error) {
 	return walk(nil, haveExistingNone)
 }
 
-func Update() error {
+// Update indexes new and modified files and removes documents for files
+// which have disappeared from the root.
+func Update() (UpdateStats, error) {
 	reader, err := bluge.OpenReader(BlugeConfig)
 	if err != nil {
-		return err
+		return UpdateStats{}, err
 	}
 	defer reader.Close()
 	return walk(reader, haveExisting)
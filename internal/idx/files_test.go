@@ -1,14 +1,21 @@
 package idx
 
 import (
+	"context"
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"testing"
+	"time"
 
 	"github.com/fatalbanana/filetundra/internal/env"
 	"github.com/fatalbanana/filetundra/internal/log"
+	"github.com/fatalbanana/filetundra/internal/properties"
+
+	"github.com/blugelabs/bluge"
 )
 
 func TestMain(m *testing.M) {
@@ -33,13 +40,272 @@ func TestMakeUpdateIndex(t *testing.T) {
 	defer os.RemoveAll(tempDir)
 
 	Init(tempDir)
-	err = Initial()
+	_, err = Initial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := GetStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Indexing || status.LastRun == nil || status.LastError != "" {
+		t.Fatalf("unexpected status after update: %+v", status)
+	}
+	if status.LastStats != stats {
+		t.Fatalf("unexpected last stats: got %+v expected %+v", status.LastStats, stats)
+	}
+	if status.Documents == 0 {
+		t.Fatal("status counted no documents")
+	}
+}
+
+func TestUpdatePrune(t *testing.T) {
+	dataRoot, err := ioutil.TempDir("", "filetundra_root")
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer os.RemoveAll(dataRoot)
+	env.Env.Root = dataRoot
 
-	err = Update()
+	subDir := filepath.Join(dataRoot, "sub")
+	err = os.MkdirAll(filepath.Join(subDir, "deeper"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fpath := range []string{
+		filepath.Join(dataRoot, "keep.txt"),
+		filepath.Join(subDir, "a.txt"),
+		filepath.Join(subDir, "deeper", "b.txt"),
+	} {
+		err = ioutil.WriteFile(fpath, []byte("hello"), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tempDir, err := ioutil.TempDir("", "filetundra_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	Init(tempDir)
+	stats, err := Initial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Added != 5 {
+		t.Fatalf("unexpected number of added documents: got %d expected 5", stats.Added)
+	}
+
+	err = os.RemoveAll(subDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dataRoot, "new.txt"), []byte("hello"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err = Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := UpdateStats{Added: 1, Removed: 4}
+	if stats != expected {
+		t.Fatalf("unexpected update stats: got %+v expected %+v", stats, expected)
+	}
+}
+
+func TestUpdatePruneReplacedDirectory(t *testing.T) {
+	dataRoot, err := ioutil.TempDir("", "filetundra_root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataRoot)
+	env.Env.Root = dataRoot
+
+	subDir := filepath.Join(dataRoot, "sub")
+	err = os.Mkdir(subDir, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(subDir, "a.txt"), []byte("hello"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir, err := ioutil.TempDir("", "filetundra_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	Init(tempDir)
+	_, err = Initial()
 	if err != nil {
 		t.Fatal(err)
 	}
+
+	// stat fails with ENOTDIR for files in a directory replaced by a file
+	err = os.RemoveAll(subDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(subDir, []byte("hello"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Removed != 1 {
+		t.Fatalf("unexpected update stats: got %+v expected 1 removed", stats)
+	}
+}
+
+func TestSizeAndModTimeFields(t *testing.T) {
+	dataRoot, err := ioutil.TempDir("", "filetundra_root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataRoot)
+	tempDir, err := ioutil.TempDir("", "filetundra_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	Init(tempDir)
+
+	fpath := filepath.Join(dataRoot, "hello.txt")
+	err = ioutil.WriteFile(fpath, []byte("hello"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2021, 6, 15, 10, 30, 0, 123456789, time.Local)
+	err = os.Chtimes(fpath, modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dataRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := FileToDocument(fpath, entries[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer, err := bluge.OpenWriter(bluge.InMemoryOnlyConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	err = writer.Insert(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := writer.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	tests := []struct {
+		query   bluge.Query
+		matches bool
+	}{
+		{bluge.NewNumericRangeQuery(5, 6).SetField(properties.Size), true},
+		{bluge.NewNumericRangeQuery(6, bluge.MaxNumeric).SetField(properties.Size), false},
+		{bluge.NewDateRangeQuery(time.Date(2021, 6, 1, 0, 0, 0, 0, time.Local), time.Date(2021, 7, 1, 0, 0, 0, 0, time.Local)).
+			SetField(properties.ModifiedTime), true},
+		{bluge.NewDateRangeQuery(time.Date(2021, 7, 1, 0, 0, 0, 0, time.Local), time.Time{}).
+			SetField(properties.ModifiedTime), false},
+	}
+	for i, tt := range tests {
+		results, err := reader.Search(context.Background(), bluge.NewAllMatches(tt.query))
+		if err != nil {
+			t.Fatal(err)
+		}
+		match, err := results.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (match != nil) != tt.matches {
+			t.Fatalf("unexpected result of query %d: got %v expected %v", i, match != nil, tt.matches)
+		}
+		if match == nil {
+			continue
+		}
+		fi, err := DocumentMatchToFileInfo(reader, match)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size != 5 || !fi.ModTime.Equal(modTime) {
+			t.Fatalf("unexpected size and modification time: got %d %v expected 5 %v", fi.Size, fi.ModTime, modTime)
+		}
+	}
+}
+
+func TestFileInfoJSON(t *testing.T) {
+	fi := FileInfo{
+		AudioDuration: 90 * time.Second,
+		BareBasename:  "song",
+		Extname:       ".mp3",
+		Filename:      "/share/music/song.mp3",
+		MimeType:      "audio/mpeg",
+		ModTime:       time.Date(2021, 6, 15, 10, 30, 0, 0, time.UTC),
+		Size:          1024,
+	}
+	b, err := json.Marshal(fi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"bare_basename":"song","extname":".mp3","mime_type":"audio/mpeg",` +
+		`"mod_time":"2021-06-15T10:30:00Z","audio_duration":90,"size":1024}`
+	if string(b) != expected {
+		t.Fatalf("unexpected JSON: got %s expected %s", b, expected)
+	}
+
+	// unknown sizes are left out
+	fi.Size = -1
+	b, err = json.Marshal(fi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `{"bare_basename":"song","extname":".mp3","mime_type":"audio/mpeg",` +
+		`"mod_time":"2021-06-15T10:30:00Z","audio_duration":90}`
+	if string(b) != expected {
+		t.Fatalf("unexpected JSON: got %s expected %s", b, expected)
+	}
+}
+
+func TestAncestors(t *testing.T) {
+	defer func(root string) { env.Env.Root = root }(env.Env.Root)
+
+	tests := []struct {
+		root     string
+		fpath    string
+		expected []string
+	}{
+		{"/share", "/share/music/song.mp3", []string{"/share/music", "/share"}},
+		{"/share/", "/share/music/song.mp3", []string{"/share/music", "/share"}},
+		{"/share/", "/share/song.mp3", []string{"/share"}},
+		{"/", "/music/song.mp3", []string{"/music", "/"}},
+	}
+	for _, tt := range tests {
+		env.Env.Root = tt.root
+		if res := ancestors(tt.fpath); !reflect.DeepEqual(res, tt.expected) {
+			t.Fatalf("unexpected ancestors of %s below %s: got %v expected %v",
+				tt.fpath, tt.root, res, tt.expected)
+		}
+	}
 }
@@ -1,9 +1,10 @@
 package idx
 
 import (
-	"encoding/binary"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 	"unicode"
 
@@ -30,6 +31,32 @@ func GetBlugeDir() (string, error) {
 	return filepath.Join(cacheDir, "filetundra", "filetundra.bluge"), nil
 }
 
+// SchemaVersion is incremented whenever documents are indexed differently,
+// so that existing indexes are rebuilt.
+const SchemaVersion = 9
+
+func schemaVersionPath(blugeDir string) string {
+	return blugeDir + ".version"
+}
+
+// ReadSchemaVersion returns the schema version of the index in blugeDir.
+// Indexes created before versioning have version 1.
+func ReadSchemaVersion(blugeDir string) (int, error) {
+	data, err := os.ReadFile(schemaVersionPath(blugeDir))
+	if os.IsNotExist(err) {
+		return 1, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// WriteSchemaVersion records that the index in blugeDir uses the current
+// schema.
+func WriteSchemaVersion(blugeDir string) error {
+	return os.WriteFile(schemaVersionPath(blugeDir), []byte(strconv.Itoa(SchemaVersion)+"\n"), 0o644)
+}
+
 func Init(blugeDir string) {
 	BlugeAnalyzer = newAnalyzer()
 	BlugeConfig = bluge.DefaultConfig(blugeDir)
@@ -65,19 +92,166 @@ func DocumentMatchToFileInfo(reader *bluge.Reader, match *search.DocumentMatch)
 			fi.MimeType = string(value)
 		case properties.AudioAlbum:
 			fi.AudioAlbum = string(value)
+		case properties.AudioAlbumArtist:
+			fi.AudioAlbumArtist = string(value)
 		case properties.AudioArtist:
 			fi.AudioArtist = string(value)
+		case properties.AudioArtwork:
+			fi.AudioArtwork = string(value) == "true"
+		case properties.AudioBitrate:
+			v, err := bluge.DecodeNumericFloat64(value)
+			if err == nil {
+				fi.AudioBitrate = int(v)
+			}
+		case properties.AudioComposer:
+			fi.AudioComposer = string(value)
+		case properties.AudioDisc:
+			v, err := bluge.DecodeNumericFloat64(value)
+			if err == nil {
+				fi.AudioDisc = int(v)
+			}
+		case properties.AudioDiscs:
+			v, err := bluge.DecodeNumericFloat64(value)
+			if err == nil {
+				fi.AudioDiscs = int(v)
+			}
+		case properties.AudioDuration:
+			v, err := bluge.DecodeNumericFloat64(value)
+			if err == nil {
+				fi.AudioDuration = time.Duration(v * float64(time.Second))
+			}
+		case properties.AudioGenre:
+			fi.AudioGenre = string(value)
 		case properties.AudioTitle:
 			fi.AudioTitle = string(value)
+		case properties.AudioTrack:
+			v, err := bluge.DecodeNumericFloat64(value)
+			if err == nil {
+				fi.AudioTrack = int(v)
+			}
+		case properties.AudioTracks:
+			v, err := bluge.DecodeNumericFloat64(value)
+			if err == nil {
+				fi.AudioTracks = int(v)
+			}
+		case properties.AudioYear:
+			v, err := bluge.DecodeNumericFloat64(value)
+			if err == nil {
+				fi.AudioYear = int(v)
+			}
+		case properties.BookAuthor:
+			fi.BookAuthors = append(fi.BookAuthors, string(value))
+		case properties.BookCover:
+			fi.BookCover = string(value) == "true"
+		case properties.BookFormat:
+			fi.BookFormat = string(value)
+		case properties.BookISBN:
+			fi.BookISBN = string(value)
+		case properties.BookLanguage:
+			fi.BookLanguage = string(value)
+		case properties.BookSeries:
+			fi.BookSeries = string(value)
+		case properties.BookSeriesIndex:
+			v, err := bluge.DecodeNumericFloat64(value)
+			if err == nil {
+				fi.BookSeriesIndex = v
+			}
+		case properties.BookTitle:
+			fi.BookTitle = string(value)
+		case properties.ImageDateTaken:
+			dt, err := bluge.DecodeDateTime(value)
+			if err == nil {
+				fi.ImageDateTaken = dt.Local()
+			}
+		case properties.ImageHeight:
+			height, err := bluge.DecodeNumericFloat64(value)
+			if err == nil {
+				fi.ImageHeight = int(height)
+			}
+		case properties.ImageLens:
+			fi.ImageLens = string(value)
+		case properties.ImageLocation:
+			lon, lat, err := bluge.DecodeGeoLonLat(value)
+			if err == nil {
+				fi.ImageLocation = &GeoPoint{Lat: lat, Lon: lon}
+			}
+		case properties.ImageMake:
+			fi.ImageMake = string(value)
+		case properties.ImageModel:
+			fi.ImageModel = string(value)
+		case properties.ImageOrientation:
+			orientation, err := bluge.DecodeNumericFloat64(value)
+			if err == nil {
+				fi.ImageOrientation = int(orientation)
+			}
+		case properties.ImageWidth:
+			width, err := bluge.DecodeNumericFloat64(value)
+			if err == nil {
+				fi.ImageWidth = int(width)
+			}
+		case properties.OfficeCreated:
+			created, err := bluge.DecodeDateTime(value)
+			if err == nil {
+				fi.OfficeCreated = created.Local()
+			}
+		case properties.OfficeCreator:
+			fi.OfficeCreator = string(value)
+		case properties.OfficeLastModifiedBy:
+			fi.OfficeLastModifiedBy = string(value)
+		case properties.OfficeTitle:
+			fi.OfficeTitle = string(value)
+		case properties.PDFAuthor:
+			fi.PDFAuthor = string(value)
+		case properties.PDFPages:
+			pages, err := bluge.DecodeNumericFloat64(value)
+			if err == nil {
+				fi.PDFPages = int(pages)
+			}
+		case properties.PDFSubject:
+			fi.PDFSubject = string(value)
+		case properties.PDFTitle:
+			fi.PDFTitle = string(value)
 		case properties.Size:
-			sz, bytesRead := binary.Varint(value)
-			if bytesRead != 0 {
-				fi.Size = sz
+			sz, err := bluge.DecodeNumericFloat64(value)
+			if err == nil {
+				fi.Size = int64(sz)
 			}
 		case properties.ModifiedTime:
-			mt, bytesRead := binary.Varint(value)
-			if bytesRead != 0 {
-				fi.ModTime = time.Unix(mt, 0)
+			mt, err := bluge.DecodeDateTime(value)
+			if err == nil {
+				fi.ModTime = mt.Local()
+			}
+		case properties.VideoAudioCodec:
+			fi.VideoAudioCodecs = append(fi.VideoAudioCodecs, string(value))
+		case properties.VideoAudioLanguage:
+			fi.VideoAudioLanguages = append(fi.VideoAudioLanguages, string(value))
+		case properties.VideoCodec:
+			fi.VideoCodec = string(value)
+		case properties.VideoDuration:
+			v, err := bluge.DecodeNumericFloat64(value)
+			if err == nil {
+				fi.VideoDuration = time.Duration(v * float64(time.Second))
+			}
+		case properties.VideoFrameRate:
+			v, err := bluge.DecodeNumericFloat64(value)
+			if err == nil {
+				fi.VideoFrameRate = v
+			}
+		case properties.VideoHeight:
+			v, err := bluge.DecodeNumericFloat64(value)
+			if err == nil {
+				fi.VideoHeight = int(v)
+			}
+		case properties.VideoResolution:
+			fi.VideoResolution = string(value)
+		case properties.VideoSubtitleLanguage:
+			fi.VideoSubtitleLanguages = append(fi.VideoSubtitleLanguages, string(value))
+		case properties.VideoTitle:
+			fi.VideoTitle = string(value)
+		case properties.VideoWidth:
+			v, err := bluge.DecodeNumericFloat64(value)
+			if err == nil {
+				fi.VideoWidth = int(v)
 			}
 		}
 		return true
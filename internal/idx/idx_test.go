@@ -1,6 +1,9 @@
 package idx
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -10,3 +13,31 @@ func TestGetBlugeDir(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestSchemaVersion(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "filetundra_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	blugeDir := filepath.Join(tempDir, "filetundra.bluge")
+
+	version, err := ReadSchemaVersion(blugeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 {
+		t.Fatalf("unexpected version of unversioned index: got %d expected 1", version)
+	}
+	err = WriteSchemaVersion(blugeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err = ReadSchemaVersion(blugeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != SchemaVersion {
+		t.Fatalf("unexpected version: got %d expected %d", version, SchemaVersion)
+	}
+}
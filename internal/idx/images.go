@@ -0,0 +1,452 @@
+package idx
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatalbanana/filetundra/internal/log"
+	"github.com/fatalbanana/filetundra/internal/properties"
+
+	"github.com/blugelabs/bluge"
+	"github.com/h2non/filetype/matchers"
+	"github.com/h2non/filetype/types"
+	"github.com/rwcarlsen/goexif/exif"
+	"go.uber.org/zap"
+)
+
+const (
+	// TIFF tag holding an XMP packet
+	tiffTagXMP = 0x02bc
+
+	pngSignature  = "\x89PNG\r\n\x1a\n"
+	xmpJpegHeader = "http://ns.adobe.com/xap/1.0/\x00"
+	xmpPngKeyword = "XML:com.adobe.xmp"
+)
+
+var (
+	imageMetaMimeMap = map[types.Type]struct{}{
+		matchers.TypeCR2:  {},
+		matchers.TypeHeif: {},
+		matchers.TypeJpeg: {},
+		matchers.TypePng:  {},
+		matchers.TypeTiff: {},
+	}
+
+	errUnhandledImageFormat = errors.New("unhandled image format")
+
+	// matches simple XMP properties in either attribute or element form
+	xmpPropertyRegexp = regexp.MustCompile(`([A-Za-z]+:[A-Za-z]+)(?:="([^"]*)"|>([^<]*)</)`)
+
+	xmpDateLayouts = []string{
+		time.RFC3339Nano,
+		"2006-01-02T15:04:05",
+		"2006-01-02T15:04Z07:00",
+		"2006-01-02T15:04",
+		"2006-01-02",
+	}
+)
+
+// GeoPoint is a position in degrees.
+type GeoPoint struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+type imageMetadata struct {
+	DateTaken   time.Time
+	Height      int
+	Lens        string
+	Location    *GeoPoint
+	Make        string
+	Model       string
+	Orientation int
+	Width       int
+}
+
+// merge fills fields of meta which are unset from other.
+func (meta *imageMetadata) merge(other imageMetadata) {
+	if meta.DateTaken.IsZero() {
+		meta.DateTaken = other.DateTaken
+	}
+	if meta.Width == 0 || meta.Height == 0 {
+		meta.Width, meta.Height = other.Width, other.Height
+	}
+	if meta.Lens == "" {
+		meta.Lens = other.Lens
+	}
+	if meta.Location == nil {
+		meta.Location = other.Location
+	}
+	if meta.Make == "" {
+		meta.Make = other.Make
+	}
+	if meta.Model == "" {
+		meta.Model = other.Model
+	}
+	if meta.Orientation == 0 {
+		meta.Orientation = other.Orientation
+	}
+}
+
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	s, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+func exifInt(x *exif.Exif, name exif.FieldName) int {
+	tag, err := x.Get(name)
+	if err != nil {
+		return 0
+	}
+	i, err := tag.Int(0)
+	if err != nil {
+		return 0
+	}
+	return i
+}
+
+// parseExif extracts metadata from EXIF data, which may be a TIFF file or
+// JPEG file, and returns the XMP packet found in the TIFF structure if any.
+func parseExif(r io.Reader) (meta imageMetadata, xmp []byte, err error) {
+	x, err := exif.Decode(r)
+	if err != nil && (x == nil || exif.IsCriticalError(err)) {
+		return meta, nil, err
+	}
+	meta.DateTaken, _ = x.DateTime()
+	meta.Make = exifString(x, exif.Make)
+	meta.Model = exifString(x, exif.Model)
+	meta.Lens = exifString(x, exif.LensModel)
+	meta.Orientation = exifInt(x, exif.Orientation)
+	meta.Width = exifInt(x, exif.PixelXDimension)
+	meta.Height = exifInt(x, exif.PixelYDimension)
+	if meta.Width == 0 || meta.Height == 0 {
+		meta.Width = exifInt(x, exif.ImageWidth)
+		meta.Height = exifInt(x, exif.ImageLength)
+	}
+	lat, lon, err := x.LatLong()
+	if err == nil {
+		meta.Location = &GeoPoint{Lat: lat, Lon: lon}
+	}
+	if x.Tiff != nil && len(x.Tiff.Dirs) > 0 {
+		for _, tag := range x.Tiff.Dirs[0].Tags {
+			if tag.Id == tiffTagXMP {
+				xmp = tag.Val
+			}
+		}
+	}
+	return meta, xmp, nil
+}
+
+// parseXMPCoordinate parses coordinates like "51,30.5N" or "0,7,39W".
+func parseXMPCoordinate(s string) (float64, bool) {
+	if len(s) < 2 {
+		return 0, false
+	}
+	ref := s[len(s)-1]
+	var deg float64
+	for i, part := range strings.Split(s[:len(s)-1], ",") {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil || i > 2 {
+			return 0, false
+		}
+		deg += v / [...]float64{1, 60, 3600}[i]
+	}
+	switch ref {
+	case 'N', 'E':
+		return deg, true
+	case 'S', 'W':
+		return -deg, true
+	}
+	return 0, false
+}
+
+func parseXMPDate(s string) time.Time {
+	for _, layout := range xmpDateLayouts {
+		t, err := time.ParseInLocation(layout, s, time.Local)
+		if err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// parseXMP extracts metadata from the simple properties of an XMP packet.
+func parseXMP(packet []byte) imageMetadata {
+	var meta imageMetadata
+	props := make(map[string]string)
+	for _, m := range xmpPropertyRegexp.FindAllSubmatch(packet, -1) {
+		name := string(m[1])
+		if _, ok := props[name]; ok {
+			continue
+		}
+		value := m[2]
+		if value == nil {
+			value = m[3]
+		}
+		props[name] = strings.TrimSpace(string(value))
+	}
+	for _, name := range []string{"exif:DateTimeOriginal", "xmp:CreateDate", "photoshop:DateCreated"} {
+		if meta.DateTaken.IsZero() && props[name] != "" {
+			meta.DateTaken = parseXMPDate(props[name])
+		}
+	}
+	meta.Make = props["tiff:Make"]
+	meta.Model = props["tiff:Model"]
+	meta.Lens = props["exifEX:LensModel"]
+	if meta.Lens == "" {
+		meta.Lens = props["aux:Lens"]
+	}
+	meta.Orientation, _ = strconv.Atoi(props["tiff:Orientation"])
+	meta.Width, _ = strconv.Atoi(props["exif:PixelXDimension"])
+	meta.Height, _ = strconv.Atoi(props["exif:PixelYDimension"])
+	lat, latOk := parseXMPCoordinate(props["exif:GPSLatitude"])
+	lon, lonOk := parseXMPCoordinate(props["exif:GPSLongitude"])
+	if latOk && lonOk {
+		meta.Location = &GeoPoint{Lat: lat, Lon: lon}
+	}
+	return meta
+}
+
+// findJpegXMP returns the XMP packet from the APP1 segments of a JPEG file.
+func findJpegXMP(r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(r)
+	var marker [2]byte
+	_, err := io.ReadFull(br, marker[:])
+	if err != nil {
+		return nil, err
+	}
+	if marker != [2]byte{0xff, 0xd8} {
+		return nil, errUnhandledImageFormat
+	}
+	for {
+		_, err = io.ReadFull(br, marker[:])
+		if err != nil {
+			return nil, err
+		}
+		if marker[0] != 0xff {
+			return nil, errUnhandledImageFormat
+		}
+		// metadata segments precede the start of scan
+		if marker[1] == 0xda || marker[1] == 0xd9 {
+			return nil, nil
+		}
+		var length uint16
+		err = binary.Read(br, binary.BigEndian, &length)
+		if err != nil {
+			return nil, err
+		}
+		if length < 2 {
+			return nil, errUnhandledImageFormat
+		}
+		segment := io.LimitReader(br, int64(length)-2)
+		if marker[1] == 0xe1 && length-2 > uint16(len(xmpJpegHeader)) {
+			data, err := io.ReadAll(segment)
+			if err != nil {
+				return nil, err
+			}
+			if bytes.HasPrefix(data, []byte(xmpJpegHeader)) {
+				return data[len(xmpJpegHeader):], nil
+			}
+			continue
+		}
+		_, err = io.Copy(io.Discard, segment)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readPngChunks returns the EXIF data and XMP packet of a PNG file.
+func readPngChunks(r io.Reader) (exifData, xmp []byte, err error) {
+	var signature [len(pngSignature)]byte
+	_, err = io.ReadFull(r, signature[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	if string(signature[:]) != pngSignature {
+		return nil, nil, errUnhandledImageFormat
+	}
+	for {
+		var header [8]byte
+		_, err = io.ReadFull(r, header[:])
+		if err != nil {
+			return exifData, xmp, err
+		}
+		length := binary.BigEndian.Uint32(header[:4])
+		chunkType := string(header[4:])
+		// image data follows the metadata chunks in practice
+		if chunkType == "IDAT" || chunkType == "IEND" {
+			return exifData, xmp, nil
+		}
+		chunk := io.LimitReader(r, int64(length))
+		switch chunkType {
+		case "eXIf":
+			exifData, err = io.ReadAll(chunk)
+		case "iTXt":
+			var data []byte
+			data, err = io.ReadAll(chunk)
+			keyword, rest, _ := bytes.Cut(data, []byte{0})
+			// skip compression flag, method, language and translated keyword
+			if err == nil && string(keyword) == xmpPngKeyword && len(rest) > 2 && rest[0] == 0 {
+				parts := bytes.SplitN(rest[2:], []byte{0}, 3)
+				if len(parts) == 3 {
+					xmp = parts[2]
+				}
+			}
+		default:
+			_, err = io.Copy(io.Discard, chunk)
+		}
+		if err != nil {
+			return exifData, xmp, err
+		}
+		// skip CRC
+		_, err = io.CopyN(io.Discard, r, 4)
+		if err != nil {
+			return exifData, xmp, err
+		}
+	}
+}
+
+func getImageMetadata(fpath string, fType types.Type) (meta imageMetadata, err error) {
+	f, err := os.Open(fpath) // #nosec: shut up
+	if err != nil {
+		return meta, err
+	}
+	defer func() {
+		err := f.Close()
+		if err != nil {
+			log.Logger.Error("error closing file",
+				zap.String("path", fpath), zap.Error(err))
+		}
+	}()
+
+	var exifData io.Reader
+	var xmp []byte
+	checkDimensions := true
+	switch fType {
+	case matchers.TypeJpeg:
+		exifData = f
+		xmp, err = findJpegXMP(f)
+		if err != nil {
+			// the rest of the metadata may still be readable
+			log.Logger.Debug("error finding xmp",
+				zap.String("path", fpath), zap.Error(err))
+			xmp = nil
+		}
+	case matchers.TypePng:
+		var data []byte
+		data, xmp, err = readPngChunks(bufio.NewReader(f))
+		if err != nil {
+			return meta, err
+		}
+		if data != nil {
+			exifData = bytes.NewReader(data)
+		}
+	case matchers.TypeTiff, matchers.TypeCR2:
+		exifData = f
+		checkDimensions = false
+	case matchers.TypeHeif:
+		var data []byte
+		meta.Width, meta.Height, data, xmp, err = readHeifMetadata(f)
+		if err != nil {
+			return meta, err
+		}
+		if data != nil {
+			exifData = bytes.NewReader(data)
+		}
+		checkDimensions = false
+	default:
+		return meta, errUnhandledImageFormat
+	}
+
+	if checkDimensions {
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return meta, err
+		}
+		config, _, err := image.DecodeConfig(bufio.NewReader(f))
+		if err != nil {
+			return meta, err
+		}
+		meta.Width, meta.Height = config.Width, config.Height
+	}
+
+	if exifData != nil {
+		if exifData == f {
+			_, err = f.Seek(0, io.SeekStart)
+			if err != nil {
+				return meta, err
+			}
+		}
+		exifMeta, tiffXMP, err := parseExif(exifData)
+		if err != nil && !errors.Is(err, io.EOF) {
+			log.Logger.Debug("error decoding exif",
+				zap.String("path", fpath), zap.Error(err))
+		}
+		meta.merge(exifMeta)
+		if xmp == nil {
+			xmp = tiffXMP
+		}
+	}
+	if xmp != nil {
+		meta.merge(parseXMP(xmp))
+	}
+	return meta, nil
+}
+
+func maybeProcessImage(fpath string, fType types.Type, doc *bluge.Document) {
+	_, ok := imageMetaMimeMap[fType]
+	if !ok {
+		return
+	}
+	if IsCoverImage(filepath.Base(fpath)) {
+		doc.AddField(bluge.NewKeywordField(properties.CoverImage, "true"))
+	}
+	meta, err := getImageMetadata(fpath, fType)
+	if err != nil {
+		log.Logger.Error("error getting image metadata",
+			zap.String("path", fpath), zap.Error(err))
+		return
+	}
+	if !meta.DateTaken.IsZero() {
+		doc.AddField(bluge.NewDateTimeField(properties.ImageDateTaken, meta.DateTaken).StoreValue())
+	}
+	if meta.Make != "" {
+		doc.AddField(bluge.NewTextField(properties.ImageMake, meta.Make).StoreValue().HighlightMatches())
+	}
+	if meta.Model != "" {
+		doc.AddField(bluge.NewTextField(properties.ImageModel, meta.Model).StoreValue().HighlightMatches())
+	}
+	if meta.Lens != "" {
+		doc.AddField(bluge.NewTextField(properties.ImageLens, meta.Lens).StoreValue().HighlightMatches())
+	}
+	if meta.Width > 0 && meta.Height > 0 {
+		doc.AddField(bluge.NewNumericField(properties.ImageWidth, float64(meta.Width)).StoreValue()).
+			AddField(bluge.NewNumericField(properties.ImageHeight, float64(meta.Height)).StoreValue())
+	}
+	if meta.Orientation > 0 {
+		doc.AddField(bluge.NewNumericField(properties.ImageOrientation, float64(meta.Orientation)).StoreValue())
+	}
+	if meta.Location != nil {
+		doc.AddField(bluge.NewGeoPointField(properties.ImageLocation, meta.Location.Lon, meta.Location.Lat).StoreValue())
+	}
+}
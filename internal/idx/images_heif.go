@@ -0,0 +1,280 @@
+package idx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+const (
+	// upper bound for the size of the meta box and of metadata items
+	heifMaxMetaSize = 16 << 20
+)
+
+var errInvalidHeif = errors.New("invalid heif file")
+
+type heifExtent struct {
+	offset uint64
+	length uint64
+}
+
+// heifItems holds the parts of the meta box needed to find metadata.
+type heifItems struct {
+	primary      uint32
+	types        map[uint32]string
+	contentTypes map[uint32]string
+	locations    map[uint32][]heifExtent
+	properties   []bmffBox
+	associations map[uint32][]int
+}
+
+func parseHeifInfo(data []byte, items *heifItems) error {
+	r := bmffReader{data: data}
+	version, _ := r.fullBoxHeader()
+	if version == 0 {
+		r.uint(2)
+	} else {
+		r.uint(4)
+	}
+	if r.err != nil {
+		return r.err
+	}
+	entries, err := bmffChildren(r.data)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.boxType != "infe" {
+			continue
+		}
+		er := bmffReader{data: entry.data}
+		version, _ := er.fullBoxHeader()
+		if version < 2 {
+			continue
+		}
+		var id uint32
+		if version == 2 {
+			id = uint32(er.uint(2))
+		} else {
+			id = uint32(er.uint(4))
+		}
+		er.uint(2)
+		itemType := string(er.next(4))
+		er.cString()
+		if itemType == "mime" {
+			items.contentTypes[id] = er.cString()
+		}
+		if er.err != nil {
+			return er.err
+		}
+		items.types[id] = itemType
+	}
+	return nil
+}
+
+func parseHeifLocations(data []byte, items *heifItems) error {
+	r := bmffReader{data: data}
+	version, _ := r.fullBoxHeader()
+	sizes := r.uint(2)
+	offsetSize := int(sizes >> 12 & 0xf)
+	lengthSize := int(sizes >> 8 & 0xf)
+	baseOffsetSize := int(sizes >> 4 & 0xf)
+	indexSize := 0
+	if version == 1 || version == 2 {
+		indexSize = int(sizes & 0xf)
+	}
+	idSize := 2
+	if version == 2 {
+		idSize = 4
+	}
+	count := r.uint(idSize)
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		id := uint32(r.uint(idSize))
+		constructionMethod := uint64(0)
+		if version == 1 || version == 2 {
+			constructionMethod = r.uint(2) & 0xf
+		}
+		r.uint(2)
+		baseOffset := r.uint(baseOffsetSize)
+		extentCount := r.uint(2)
+		var extents []heifExtent
+		for j := uint64(0); j < extentCount && r.err == nil; j++ {
+			r.uint(indexSize)
+			offset := r.uint(offsetSize)
+			length := r.uint(lengthSize)
+			extents = append(extents, heifExtent{offset: baseOffset + offset, length: length})
+		}
+		// only items stored in the file itself are supported
+		if constructionMethod == 0 {
+			items.locations[id] = extents
+		}
+	}
+	return r.err
+}
+
+func parseHeifProperties(data []byte, items *heifItems) error {
+	boxes, err := bmffChildren(data)
+	if err != nil {
+		return err
+	}
+	for _, box := range boxes {
+		switch box.boxType {
+		case "ipco":
+			items.properties, err = bmffChildren(box.data)
+			if err != nil {
+				return err
+			}
+		case "ipma":
+			r := bmffReader{data: box.data}
+			version, flags := r.fullBoxHeader()
+			count := r.uint(4)
+			for i := uint64(0); i < count && r.err == nil; i++ {
+				var id uint32
+				if version < 1 {
+					id = uint32(r.uint(2))
+				} else {
+					id = uint32(r.uint(4))
+				}
+				associations := r.uint(1)
+				for j := uint64(0); j < associations && r.err == nil; j++ {
+					// the high bit marks essential properties
+					if flags&1 != 0 {
+						items.associations[id] = append(items.associations[id], int(r.uint(2)&0x7fff))
+					} else {
+						items.associations[id] = append(items.associations[id], int(r.uint(1)&0x7f))
+					}
+				}
+			}
+			if r.err != nil {
+				return r.err
+			}
+		}
+	}
+	return nil
+}
+
+// ispe returns the dimensions from an image spatial extents property.
+func ispe(box bmffBox) (width, height int, ok bool) {
+	if box.boxType != "ispe" {
+		return 0, 0, false
+	}
+	r := bmffReader{data: box.data}
+	r.fullBoxHeader()
+	w, h := r.uint(4), r.uint(4)
+	if r.err != nil || w > math.MaxInt32 || h > math.MaxInt32 {
+		return 0, 0, false
+	}
+	return int(w), int(h), true
+}
+
+// dimensions returns the size of the primary image, falling back to the
+// largest image in the file.
+func (items *heifItems) dimensions() (width, height int) {
+	for _, index := range items.associations[items.primary] {
+		if index > 0 && index <= len(items.properties) {
+			w, h, ok := ispe(items.properties[index-1])
+			if ok {
+				return w, h
+			}
+		}
+	}
+	for _, prop := range items.properties {
+		w, h, ok := ispe(prop)
+		if ok && w*h > width*height {
+			width, height = w, h
+		}
+	}
+	return width, height
+}
+
+func readHeifItem(r io.ReaderAt, extents []heifExtent) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, extent := range extents {
+		if extent.length == 0 || uint64(buf.Len())+extent.length > heifMaxMetaSize ||
+			extent.offset > math.MaxInt64 {
+			return nil, errInvalidHeif
+		}
+		_, err := io.Copy(&buf, io.NewSectionReader(r, int64(extent.offset), int64(extent.length)))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// readHeifMetadata returns the dimensions of the primary image of a HEIF
+// file as well as its EXIF data and XMP packet.
+func readHeifMetadata(f io.ReadSeeker) (width, height int, exifData, xmp []byte, err error) {
+	meta, _, err := readBmffTopLevel(f, "meta", heifMaxMetaSize)
+	if err != nil {
+		return 0, 0, nil, nil, err
+	}
+	if len(meta) < 4 {
+		return 0, 0, nil, nil, errInvalidHeif
+	}
+	boxes, err := bmffChildren(meta[4:])
+	if err != nil {
+		return 0, 0, nil, nil, err
+	}
+
+	items := heifItems{
+		types:        make(map[uint32]string),
+		contentTypes: make(map[uint32]string),
+		locations:    make(map[uint32][]heifExtent),
+		associations: make(map[uint32][]int),
+	}
+	for _, box := range boxes {
+		switch box.boxType {
+		case "pitm":
+			r := bmffReader{data: box.data}
+			version, _ := r.fullBoxHeader()
+			if version == 0 {
+				items.primary = uint32(r.uint(2))
+			} else {
+				items.primary = uint32(r.uint(4))
+			}
+			err = r.err
+		case "iinf":
+			err = parseHeifInfo(box.data, &items)
+		case "iloc":
+			err = parseHeifLocations(box.data, &items)
+		case "iprp":
+			err = parseHeifProperties(box.data, &items)
+		}
+		if err != nil {
+			return 0, 0, nil, nil, err
+		}
+	}
+	width, height = items.dimensions()
+
+	ra, ok := f.(io.ReaderAt)
+	if !ok {
+		return width, height, nil, nil, nil
+	}
+	for id, itemType := range items.types {
+		extents, ok := items.locations[id]
+		if !ok {
+			continue
+		}
+		switch {
+		case itemType == "Exif" && exifData == nil:
+			data, err := readHeifItem(ra, extents)
+			if err != nil {
+				return width, height, nil, nil, err
+			}
+			// the payload starts with the offset to the TIFF header
+			if len(data) < 4 || uint64(binary.BigEndian.Uint32(data))+4 > uint64(len(data)) {
+				return width, height, nil, nil, errInvalidHeif
+			}
+			exifData = data[4+binary.BigEndian.Uint32(data):]
+		case itemType == "mime" && items.contentTypes[id] == "application/rdf+xml" && xmp == nil:
+			xmp, err = readHeifItem(ra, extents)
+			if err != nil {
+				return width, height, nil, nil, err
+			}
+		}
+	}
+	return width, height, exifData, xmp, nil
+}
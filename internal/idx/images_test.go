@@ -0,0 +1,359 @@
+package idx
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fatalbanana/filetundra/internal/env"
+	"github.com/fatalbanana/filetundra/internal/properties"
+
+	"github.com/blugelabs/bluge"
+	"github.com/h2non/filetype/matchers"
+	"github.com/h2non/filetype/types"
+)
+
+const testXMP = `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+	`<rdf:Description rdf:about="" tiff:Make="NIKON CORPORATION" tiff:Model="NIKON Z 6" tiff:Orientation="1"` +
+	` exif:DateTimeOriginal="2020-02-03T04:05:06" exif:GPSLatitude="48,51.5N" exif:GPSLongitude="2,21W">` +
+	`<exifEX:LensModel>NIKKOR Z 50mm f/1.8 S</exifEX:LensModel></rdf:Description></rdf:RDF></x:xmpmeta>`
+
+func appendUint16(order binary.ByteOrder, b []byte, v uint16) []byte {
+	buf := make([]byte, 2)
+	order.PutUint16(buf, v)
+	return append(b, buf...)
+}
+
+func appendUint32(order binary.ByteOrder, b []byte, v uint32) []byte {
+	buf := make([]byte, 4)
+	order.PutUint32(buf, v)
+	return append(b, buf...)
+}
+
+type tiffEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+func tiffASCII(tag uint16, s string) tiffEntry {
+	return tiffEntry{tag, 2, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+func tiffShort(tag uint16, v uint16) tiffEntry {
+	return tiffEntry{tag, 3, 1, appendUint16(binary.LittleEndian, nil, v)}
+}
+
+func tiffLong(tag uint16, v uint32) tiffEntry {
+	return tiffEntry{tag, 4, 1, appendUint32(binary.LittleEndian, nil, v)}
+}
+
+func tiffRationals(tag uint16, vs ...uint32) tiffEntry {
+	var data []byte
+	for _, v := range vs {
+		data = appendUint32(binary.LittleEndian, data, v)
+		data = appendUint32(binary.LittleEndian, data, 1)
+	}
+	return tiffEntry{tag, 5, uint32(len(vs)), data}
+}
+
+// tiffIFD encodes an image file directory located at offset, followed by
+// the values which don't fit into its entries.
+func tiffIFD(offset uint32, entries []tiffEntry) []byte {
+	var ifd, values []byte
+	valuesOffset := offset + 2 + 12*uint32(len(entries)) + 4
+	ifd = appendUint16(binary.LittleEndian, ifd, uint16(len(entries)))
+	for _, e := range entries {
+		ifd = appendUint16(binary.LittleEndian, ifd, e.tag)
+		ifd = appendUint16(binary.LittleEndian, ifd, e.typ)
+		ifd = appendUint32(binary.LittleEndian, ifd, e.count)
+		if len(e.data) <= 4 {
+			ifd = append(ifd, e.data...)
+			ifd = append(ifd, make([]byte, 4-len(e.data))...)
+			continue
+		}
+		ifd = appendUint32(binary.LittleEndian, ifd, valuesOffset+uint32(len(values)))
+		values = append(values, e.data...)
+		if len(values)%2 != 0 {
+			values = append(values, 0)
+		}
+	}
+	ifd = appendUint32(binary.LittleEndian, ifd, 0)
+	return append(ifd, values...)
+}
+
+// makeTestExif builds TIFF structured EXIF data.
+func makeTestExif() []byte {
+	exifEntries := []tiffEntry{
+		tiffASCII(0x9003, "2021:06:01 14:03:00"),
+		tiffLong(0xa002, 4000),
+		tiffLong(0xa003, 3000),
+		tiffASCII(0xa434, "RF24-105mm F4 L IS USM"),
+	}
+	gpsEntries := []tiffEntry{
+		tiffASCII(0x0001, "N"),
+		tiffRationals(0x0002, 51, 30, 0),
+		tiffASCII(0x0003, "W"),
+		tiffRationals(0x0004, 0, 7, 30),
+	}
+	ifd0 := func(exifOffset, gpsOffset uint32) []tiffEntry {
+		return []tiffEntry{
+			tiffASCII(0x010f, "Canon"),
+			tiffASCII(0x0110, "Canon EOS R5"),
+			tiffShort(0x0112, 6),
+			tiffLong(0x8769, exifOffset),
+			tiffLong(0x8825, gpsOffset),
+		}
+	}
+	exifOffset := 8 + uint32(len(tiffIFD(8, ifd0(0, 0))))
+	gpsOffset := exifOffset + uint32(len(tiffIFD(exifOffset, exifEntries)))
+	buf := []byte("II*\x00\x08\x00\x00\x00")
+	buf = append(buf, tiffIFD(8, ifd0(exifOffset, gpsOffset))...)
+	buf = append(buf, tiffIFD(exifOffset, exifEntries)...)
+	return append(buf, tiffIFD(gpsOffset, gpsEntries)...)
+}
+
+func testImage() image.Image {
+	return image.NewGray(image.Rect(0, 0, 8, 6))
+}
+
+// makeTestJpeg builds a JPEG file with the given APP1 segments.
+func makeTestJpeg(t *testing.T, segments ...[]byte) []byte {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, testImage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+	res := append([]byte{}, encoded[:2]...)
+	for _, segment := range segments {
+		res = append(res, 0xff, 0xe1)
+		res = appendUint16(binary.BigEndian, res, uint16(len(segment)+2))
+		res = append(res, segment...)
+	}
+	return append(res, encoded[2:]...)
+}
+
+func pngChunk(chunkType string, data []byte) []byte {
+	chunk := appendUint32(binary.BigEndian, nil, uint32(len(data)))
+	chunk = append(chunk, chunkType...)
+	chunk = append(chunk, data...)
+	return appendUint32(binary.BigEndian, chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// makeTestPng builds a PNG file with the given chunks following IHDR.
+func makeTestPng(t *testing.T, chunks ...[]byte) []byte {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, testImage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+	// signature and IHDR chunk
+	headerLen := len(pngSignature) + 25
+	res := append([]byte{}, encoded[:headerLen]...)
+	for _, chunk := range chunks {
+		res = append(res, chunk...)
+	}
+	return append(res, encoded[headerLen:]...)
+}
+
+func isoBox(boxType string, contents ...[]byte) []byte {
+	var size uint32 = 8
+	for _, c := range contents {
+		size += uint32(len(c))
+	}
+	box := appendUint32(binary.BigEndian, nil, size)
+	box = append(box, boxType...)
+	for _, c := range contents {
+		box = append(box, c...)
+	}
+	return box
+}
+
+// makeTestHeif builds a HEIF file with an EXIF item, a thumbnail and a
+// primary image of 640x480.
+func makeTestHeif(exifData []byte) []byte {
+	fullBox := []byte{0, 0, 0, 0}
+	infe := func(id uint16, itemType string) []byte {
+		entry := appendUint16(binary.BigEndian, []byte{2, 0, 0, 0}, id)
+		entry = append(entry, 0, 0)
+		entry = append(entry, itemType...)
+		return isoBox("infe", append(entry, 0))
+	}
+	ispe := func(width, height uint32) []byte {
+		return isoBox("ispe", fullBox, appendUint32(binary.BigEndian, appendUint32(binary.BigEndian, nil, width), height))
+	}
+	exifItem := append([]byte{0, 0, 0, 6}, "Exif\x00\x00"...)
+	exifItem = append(exifItem, exifData...)
+	meta := func(exifOffset uint32) []byte {
+		iloc := append([]byte{}, fullBox...)
+		iloc = append(iloc, 0x44, 0x00, 0, 1)
+		iloc = appendUint16(binary.BigEndian, iloc, 3)
+		iloc = append(iloc, 0, 0, 0, 1)
+		iloc = appendUint32(binary.BigEndian, iloc, exifOffset)
+		iloc = appendUint32(binary.BigEndian, iloc, uint32(len(exifItem)))
+		ipma := append([]byte{}, fullBox...)
+		ipma = appendUint32(binary.BigEndian, ipma, 2)
+		ipma = append(ipma, 0, 1, 1, 0x82, 0, 2, 1, 0x81)
+		return isoBox("meta", fullBox,
+			isoBox("pitm", fullBox, []byte{0, 1}),
+			isoBox("iinf", fullBox, []byte{0, 3}, infe(1, "hvc1"), infe(2, "hvc1"), infe(3, "Exif")),
+			isoBox("iloc", iloc),
+			isoBox("iprp", isoBox("ipco", ispe(160, 120), ispe(640, 480)), isoBox("ipma", ipma)))
+	}
+	ftyp := isoBox("ftyp", []byte("heic\x00\x00\x00\x00mif1heic"))
+	exifOffset := uint32(len(ftyp)+len(meta(0))) + 8
+	buf := append(ftyp, meta(exifOffset)...)
+	return append(buf, isoBox("mdat", exifItem)...)
+}
+
+func TestGetImageMetadata(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "filetundra_images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	exifData := makeTestExif()
+	exifMeta := imageMetadata{
+		DateTaken:   time.Date(2021, 6, 1, 14, 3, 0, 0, time.Local),
+		Lens:        "RF24-105mm F4 L IS USM",
+		Location:    &GeoPoint{Lat: 51.5, Lon: -0.125},
+		Make:        "Canon",
+		Model:       "Canon EOS R5",
+		Orientation: 6,
+	}
+	xmpMeta := imageMetadata{
+		DateTaken:   time.Date(2020, 2, 3, 4, 5, 6, 0, time.Local),
+		Lens:        "NIKKOR Z 50mm f/1.8 S",
+		Location:    &GeoPoint{Lat: 48 + 51.5/60, Lon: -(2 + 21.0/60)},
+		Make:        "NIKON CORPORATION",
+		Model:       "NIKON Z 6",
+		Orientation: 1,
+	}
+	withSize := func(meta imageMetadata, width, height int) imageMetadata {
+		meta.Width, meta.Height = width, height
+		return meta
+	}
+	xmpITXt := append([]byte(xmpPngKeyword), 0, 0, 0, 0, 0)
+	xmpITXt = append(xmpITXt, testXMP...)
+
+	tests := []struct {
+		name     string
+		fType    types.Type
+		data     []byte
+		expected imageMetadata
+	}{
+		{"jpeg exif", matchers.TypeJpeg, makeTestJpeg(t, append([]byte("Exif\x00\x00"), exifData...)),
+			withSize(exifMeta, 8, 6)},
+		{"jpeg xmp", matchers.TypeJpeg, makeTestJpeg(t, append([]byte(xmpJpegHeader), testXMP...)),
+			withSize(xmpMeta, 8, 6)},
+		{"jpeg plain", matchers.TypeJpeg, makeTestJpeg(t), imageMetadata{Width: 8, Height: 6}},
+		{"jpeg stray bytes", matchers.TypeJpeg, append([]byte{0xff, 0xd8, 0}, makeTestJpeg(t, append([]byte("Exif\x00\x00"), exifData...))[2:]...),
+			withSize(exifMeta, 8, 6)},
+		{"png", matchers.TypePng, makeTestPng(t, pngChunk("eXIf", exifData)), withSize(exifMeta, 8, 6)},
+		{"png xmp", matchers.TypePng, makeTestPng(t, pngChunk("iTXt", xmpITXt)), withSize(xmpMeta, 8, 6)},
+		{"tiff", matchers.TypeTiff, exifData, withSize(exifMeta, 4000, 3000)},
+		{"heif", matchers.TypeHeif, makeTestHeif(exifData), withSize(exifMeta, 640, 480)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fpath := filepath.Join(tempDir, "image")
+			err := ioutil.WriteFile(fpath, tt.data, 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			meta, err := getImageMetadata(fpath, tt.fType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			location, expectedLocation := meta.Location, tt.expected.Location
+			meta.Location, tt.expected.Location = nil, nil
+			if !meta.DateTaken.Equal(tt.expected.DateTaken) {
+				t.Fatalf("unexpected date taken: got %v expected %v", meta.DateTaken, tt.expected.DateTaken)
+			}
+			meta.DateTaken, tt.expected.DateTaken = time.Time{}, time.Time{}
+			if meta != tt.expected {
+				t.Fatalf("unexpected metadata: got %+v expected %+v", meta, tt.expected)
+			}
+			if (location == nil) != (expectedLocation == nil) ||
+				location != nil && (math.Abs(location.Lat-expectedLocation.Lat) > 1e-9 ||
+					math.Abs(location.Lon-expectedLocation.Lon) > 1e-9) {
+				t.Fatalf("unexpected location: got %v expected %v", location, expectedLocation)
+			}
+		})
+	}
+}
+
+func TestImageIndexing(t *testing.T) {
+	dataRoot, err := ioutil.TempDir("", "filetundra_root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataRoot)
+	env.Env.Root = dataRoot
+
+	photoPath := filepath.Join(dataRoot, "photo.jpg")
+	err = ioutil.WriteFile(photoPath, makeTestJpeg(t, append([]byte("Exif\x00\x00"), makeTestExif()...)), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir, err := ioutil.TempDir("", "filetundra_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	Init(tempDir)
+	_, err = Initial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := bluge.OpenReader(BlugeConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	query := bluge.NewBooleanQuery().
+		AddMust(bluge.NewMatchQuery("canon").SetField(properties.ImageMake)).
+		AddMust(bluge.NewNumericRangeQuery(8, 9).SetField(properties.ImageWidth)).
+		AddMust(bluge.NewDateRangeQuery(time.Date(2021, 1, 1, 0, 0, 0, 0, time.Local), time.Date(2022, 1, 1, 0, 0, 0, 0, time.Local)).
+			SetField(properties.ImageDateTaken))
+	searchResults, err := reader.Search(context.TODO(), bluge.NewAllMatches(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := searchResults.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next == nil {
+		t.Fatal("photo wasn't found")
+	}
+	fi, err := DocumentMatchToFileInfo(reader, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Filename != photoPath || fi.ImageMake != "Canon" || fi.ImageModel != "Canon EOS R5" ||
+		fi.ImageLens != "RF24-105mm F4 L IS USM" || fi.ImageWidth != 8 || fi.ImageHeight != 6 ||
+		fi.ImageOrientation != 6 || !fi.ImageDateTaken.Equal(time.Date(2021, 6, 1, 14, 3, 0, 0, time.Local)) {
+		t.Fatalf("unexpected file info: %+v", fi)
+	}
+	if fi.ImageLocation == nil || math.Abs(fi.ImageLocation.Lat-51.5) > 1e-5 || math.Abs(fi.ImageLocation.Lon+0.125) > 1e-5 {
+		t.Fatalf("unexpected location: %v", fi.ImageLocation)
+	}
+}
@@ -0,0 +1,390 @@
+package idx
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatalbanana/filetundra/internal/env"
+	"github.com/fatalbanana/filetundra/internal/log"
+	"github.com/fatalbanana/filetundra/internal/properties"
+
+	"github.com/blugelabs/bluge"
+	"github.com/h2non/filetype"
+	"github.com/h2non/filetype/matchers"
+	"github.com/h2non/filetype/types"
+	"go.uber.org/zap"
+)
+
+const (
+	// upper bound for the uncompressed size of a document part
+	officeMaxPartSize = 256 << 20
+)
+
+var (
+	TypeOdt = filetype.NewType("odt", "application/vnd.oasis.opendocument.text")
+	TypeOds = filetype.NewType("ods", "application/vnd.oasis.opendocument.spreadsheet")
+	TypeOdp = filetype.NewType("odp", "application/vnd.oasis.opendocument.presentation")
+
+	officeMimeMap = map[types.Type]struct{}{
+		matchers.TypeDocx: {},
+		matchers.TypePptx: {},
+		matchers.TypeXlsx: {},
+		TypeOdp:           {},
+		TypeOds:           {},
+		TypeOdt:           {},
+	}
+
+	errStopText = errors.New("text limit reached")
+)
+
+func init() {
+	for _, t := range []types.Type{TypeOdt, TypeOds, TypeOdp} {
+		filetype.AddMatcher(t, zipMimetypeMatcher(t.MIME.Value))
+	}
+}
+
+// zipMimetypeMatcher matches OpenDocument and EPUB files, which start with
+// an uncompressed mimetype member.
+func zipMimetypeMatcher(mimeType string) matchers.Matcher {
+	signature := []byte("PK\x03\x04")
+	return func(buf []byte) bool {
+		return len(buf) >= 38+len(mimeType) &&
+			bytes.HasPrefix(buf, signature) &&
+			string(buf[30:38]) == "mimetype" &&
+			string(buf[38:38+len(mimeType)]) == mimeType
+	}
+}
+
+type officeMetadata struct {
+	Created        time.Time
+	Creator        string
+	LastModifiedBy string
+	Text           string
+	Title          string
+}
+
+// officeText collects up to max bytes of document text.
+type officeText struct {
+	strings.Builder
+	max int64
+}
+
+func (t *officeText) add(s string) error {
+	if int64(t.Len()+len(s)) >= t.max {
+		t.WriteString(truncateText(s, int(t.max-int64(t.Len()))))
+		return errStopText
+	}
+	t.WriteString(s)
+	return nil
+}
+
+// endLine terminates the current line unless it is empty.
+func (t *officeText) endLine() error {
+	s := t.String()
+	if s == "" || strings.HasSuffix(s, "\n") {
+		return nil
+	}
+	return t.add("\n")
+}
+
+// xmlTextRules select the text of a document part by element local names.
+type xmlTextRules struct {
+	// elements whose character data, including that of their children, is text
+	text map[string]bool
+	// text inserted for empty elements such as tabs and line breaks
+	insert map[string]string
+	// elements which end a line
+	lines map[string]bool
+	// elements whose contents are ignored, such as formatting properties
+	skip map[string]bool
+}
+
+var (
+	ooxmlTextRules = xmlTextRules{
+		text:   map[string]bool{"t": true},
+		insert: map[string]string{"br": "\n", "cr": "\n", "tab": "\t"},
+		lines:  map[string]bool{"p": true, "si": true},
+		skip:   map[string]bool{"pPr": true, "rPr": true, "sectPr": true},
+	}
+	odfTextRules = xmlTextRules{
+		text:   map[string]bool{"h": true, "p": true},
+		insert: map[string]string{"line-break": "\n", "s": " ", "tab": "\t"},
+		lines:  map[string]bool{"h": true, "p": true},
+	}
+)
+
+// extractXMLText appends the text of the XML document in r to text.
+func extractXMLText(r io.Reader, rules xmlTextRules, text *officeText) error {
+	d := xml.NewDecoder(r)
+	depth := 0
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			if rules.skip[tok.Name.Local] {
+				err = d.Skip()
+				break
+			}
+			if rules.text[tok.Name.Local] {
+				depth++
+			}
+			if s, ok := rules.insert[tok.Name.Local]; ok {
+				err = text.add(s)
+			}
+		case xml.EndElement:
+			if rules.text[tok.Name.Local] {
+				depth--
+			}
+			if rules.lines[tok.Name.Local] {
+				err = text.endLine()
+			}
+		case xml.CharData:
+			if depth > 0 {
+				err = text.add(string(tok))
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// extractSheetText appends the values of the cells of a worksheet which are
+// not references to shared strings.
+func extractSheetText(r io.Reader, text *officeText) error {
+	d := xml.NewDecoder(r)
+	var cellType string
+	inValue := false
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			switch tok.Name.Local {
+			case "c":
+				cellType = ""
+				for _, attr := range tok.Attr {
+					if attr.Name.Local == "t" {
+						cellType = attr.Value
+					}
+				}
+			case "v", "t":
+				inValue = cellType != "s"
+			}
+		case xml.EndElement:
+			switch tok.Name.Local {
+			case "v", "t":
+				inValue = false
+			case "row":
+				err = text.endLine()
+			case "c":
+				err = text.add("\t")
+			}
+		case xml.CharData:
+			if inValue {
+				err = text.add(string(tok))
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// matchingParts returns the members of z matching pattern ordered by the
+// number in their name, as in ppt/slides/slide10.xml.
+func matchingParts(z *zip.Reader, pattern string) []*zip.File {
+	var parts []*zip.File
+	for _, zf := range z.File {
+		if ok, _ := path.Match(pattern, zf.Name); ok {
+			parts = append(parts, zf)
+		}
+	}
+	number := func(name string) int {
+		name = strings.TrimSuffix(path.Base(name), ".xml")
+		n, _ := strconv.Atoi(strings.TrimLeft(name, "abcdefghijklmnopqrstuvwxyz"))
+		return n
+	}
+	sort.SliceStable(parts, func(i, j int) bool {
+		return number(parts[i].Name) < number(parts[j].Name)
+	})
+	return parts
+}
+
+func openPart(z *zip.Reader, name string) (io.ReadCloser, error) {
+	for _, zf := range z.File {
+		if zf.Name == name {
+			return openZipFile(zf)
+		}
+	}
+	return nil, ErrMemberNotFound
+}
+
+func openZipFile(zf *zip.File) (io.ReadCloser, error) {
+	rc, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(rc, officeMaxPartSize), rc}, nil
+}
+
+// readParts feeds the given members to extract until the text is complete.
+func readParts(parts []*zip.File, extract func(io.Reader) error) error {
+	for _, zf := range parts {
+		rc, err := openZipFile(zf)
+		if err != nil {
+			return err
+		}
+		err = extract(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type ooxmlCoreProperties struct {
+	Created        string `xml:"created"`
+	Creator        string `xml:"creator"`
+	LastModifiedBy string `xml:"lastModifiedBy"`
+	Title          string `xml:"title"`
+}
+
+type odfMeta struct {
+	Meta struct {
+		CreationDate   string `xml:"creation-date"`
+		Creator        string `xml:"creator"`
+		InitialCreator string `xml:"initial-creator"`
+		Title          string `xml:"title"`
+	} `xml:"meta"`
+}
+
+func decodePart(z *zip.Reader, name string, v interface{}) error {
+	rc, err := openPart(z, name)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return xml.NewDecoder(rc).Decode(v)
+}
+
+// getOfficeMetadata reads the document properties and up to maxText bytes of
+// text from an Office Open XML or OpenDocument file.
+func getOfficeMetadata(fpath string, fType types.Type, maxText int64) (meta officeMetadata, err error) {
+	z, err := zip.OpenReader(fpath)
+	if err != nil {
+		return meta, err
+	}
+	defer func() {
+		err := z.Close()
+		if err != nil {
+			log.Logger.Error("error closing file",
+				zap.String("path", fpath), zap.Error(err))
+		}
+	}()
+
+	text := &officeText{max: maxText}
+	switch fType {
+	case TypeOdt, TypeOds, TypeOdp:
+		var props odfMeta
+		err = decodePart(&z.Reader, "meta.xml", &props)
+		if err != nil && err != ErrMemberNotFound {
+			return meta, err
+		}
+		meta.Created = parseXMPDate(props.Meta.CreationDate)
+		meta.Creator = props.Meta.InitialCreator
+		meta.LastModifiedBy = props.Meta.Creator
+		if meta.Creator == "" {
+			meta.Creator = meta.LastModifiedBy
+		}
+		meta.Title = props.Meta.Title
+		err = readParts(matchingParts(&z.Reader, "content.xml"), func(r io.Reader) error {
+			return extractXMLText(r, odfTextRules, text)
+		})
+	default:
+		var props ooxmlCoreProperties
+		err = decodePart(&z.Reader, "docProps/core.xml", &props)
+		if err != nil && err != ErrMemberNotFound {
+			return meta, err
+		}
+		meta.Created = parseXMPDate(props.Created)
+		meta.Creator = props.Creator
+		meta.LastModifiedBy = props.LastModifiedBy
+		meta.Title = props.Title
+		extractOOXML := func(r io.Reader) error {
+			return extractXMLText(r, ooxmlTextRules, text)
+		}
+		switch fType {
+		case matchers.TypeDocx:
+			err = readParts(matchingParts(&z.Reader, "word/document.xml"), extractOOXML)
+		case matchers.TypePptx:
+			err = readParts(matchingParts(&z.Reader, "ppt/slides/slide*.xml"), extractOOXML)
+		case matchers.TypeXlsx:
+			err = readParts(matchingParts(&z.Reader, "xl/sharedStrings.xml"), extractOOXML)
+			if err == nil {
+				err = readParts(matchingParts(&z.Reader, "xl/worksheets/sheet*.xml"), func(r io.Reader) error {
+					return extractSheetText(r, text)
+				})
+			}
+		}
+	}
+	if err != nil && err != errStopText {
+		return meta, err
+	}
+	meta.Text = strings.ToValidUTF8(text.String(), "")
+	meta.Creator = strings.TrimSpace(meta.Creator)
+	meta.LastModifiedBy = strings.TrimSpace(meta.LastModifiedBy)
+	meta.Title = strings.TrimSpace(meta.Title)
+	return meta, nil
+}
+
+func maybeProcessOffice(fpath string, fType types.Type, doc *bluge.Document) {
+	_, ok := officeMimeMap[fType]
+	if !ok {
+		return
+	}
+	meta, err := getOfficeMetadata(fpath, fType, env.Env.ContentMaxSize)
+	if err != nil {
+		log.Logger.Error("error getting office metadata",
+			zap.String("path", fpath), zap.Error(err))
+		return
+	}
+	if meta.Title != "" {
+		doc.AddField(bluge.NewTextField(properties.OfficeTitle, meta.Title).WithAnalyzer(BlugeAnalyzer).StoreValue().HighlightMatches())
+	}
+	if meta.Creator != "" {
+		doc.AddField(bluge.NewTextField(properties.OfficeCreator, meta.Creator).StoreValue().HighlightMatches())
+	}
+	if meta.LastModifiedBy != "" {
+		doc.AddField(bluge.NewTextField(properties.OfficeLastModifiedBy, meta.LastModifiedBy).StoreValue().HighlightMatches())
+	}
+	if !meta.Created.IsZero() {
+		doc.AddField(bluge.NewDateTimeField(properties.OfficeCreated, meta.Created).StoreValue())
+	}
+	if strings.TrimSpace(meta.Text) != "" {
+		addContent(doc, meta.Text)
+	}
+}
@@ -0,0 +1,303 @@
+package idx
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fatalbanana/filetundra/internal/env"
+	"github.com/fatalbanana/filetundra/internal/properties"
+
+	"github.com/blugelabs/bluge"
+	"github.com/h2non/filetype"
+	"github.com/h2non/filetype/matchers"
+	"github.com/h2non/filetype/types"
+)
+
+const (
+	testCoreXML = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<cp:coreProperties xmlns:cp="http://schemas.openxmlformats.org/package/2006/metadata/core-properties" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:dcterms="http://purl.org/dc/terms/" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+<dc:title>Quarterly Report</dc:title><dc:creator>Alice</dc:creator><cp:lastModifiedBy>Bob</cp:lastModifiedBy>
+<dcterms:created xsi:type="dcterms:W3CDTF">2021-03-04T05:06:07Z</dcterms:created></cp:coreProperties>`
+	testDocumentXML = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>
+<w:p><w:pPr><w:tabs><w:tab w:val="left" w:pos="720"/></w:tabs></w:pPr><w:r><w:t>Sales</w:t></w:r><w:r><w:t xml:space="preserve"> grew</w:t></w:r></w:p>
+<w:p><w:r><w:t>by</w:t><w:tab/><w:t>ten percent</w:t></w:r></w:p></w:body></w:document>`
+	testSharedStringsXML = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<sst xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" count="2" uniqueCount="2">
+<si><t>Invoice</t></si><si><r><t>Total</t></r><r><t xml:space="preserve"> due</t></r></si></sst>`
+	testSheetXML = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>
+<row r="1"><c r="A1" t="s"><v>0</v></c><c r="B1"><v>4711</v></c></row>
+<row r="2"><c r="A2" t="s"><v>1</v></c><c r="B2" t="inlineStr"><is><t>overdue</t></is></c></row>
+</sheetData></worksheet>`
+	testSlideXML = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<p:sld xmlns:a="http://schemas.openxmlformats.org/drawingml/2006/main" xmlns:p="http://schemas.openxmlformats.org/presentationml/2006/main">
+<p:cSld><p:spTree><p:sp><p:txBody><a:p><a:r><a:t>Slide %s</a:t></a:r></a:p></p:txBody></p:sp></p:spTree></p:cSld></p:sld>`
+	testODFMetaXML = `<?xml version="1.0" encoding="UTF-8"?>
+<office:document-meta xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" xmlns:meta="urn:oasis:names:tc:opendocument:xmlns:meta:1.0" xmlns:dc="http://purl.org/dc/elements/1.1/">
+<office:meta><meta:initial-creator>Carol</meta:initial-creator><dc:creator>Dave</dc:creator>
+<meta:creation-date>2020-01-02T03:04:05.123456789</meta:creation-date><dc:title>Minutes</dc:title></office:meta></office:document-meta>`
+	testODFContentXML = `<?xml version="1.0" encoding="UTF-8"?>
+<office:document-content xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0" xmlns:table="urn:oasis:names:tc:opendocument:xmlns:table:1.0">
+<office:body><office:text><text:h>Agenda</text:h><text:p>Budget<text:s/><text:span>approval</text:span></text:p>
+<table:table><table:table-row><table:table-cell><text:p>Item</text:p></table:table-cell></table:table-row></table:table>
+</office:text></office:body></office:document-content>`
+)
+
+// makeTestOfficeZip builds a document package, storing the first part
+// uncompressed as OpenDocument requires for the mimetype.
+func makeTestOfficeZip(t *testing.T, parts ...[2]string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for i, part := range parts {
+		method := zip.Deflate
+		if i == 0 {
+			method = zip.Store
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: part[0], Method: method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write([]byte(part[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func makeTestDocx(t *testing.T) []byte {
+	return makeTestOfficeZip(t,
+		[2]string{"[Content_Types].xml", "<Types/>"},
+		[2]string{"_rels/.rels", "<Relationships/>"},
+		[2]string{"word/document.xml", testDocumentXML},
+		[2]string{"docProps/core.xml", testCoreXML},
+	)
+}
+
+func makeTestXlsx(t *testing.T) []byte {
+	return makeTestOfficeZip(t,
+		[2]string{"[Content_Types].xml", "<Types/>"},
+		[2]string{"_rels/.rels", "<Relationships/>"},
+		[2]string{"xl/workbook.xml", "<workbook/>"},
+		[2]string{"xl/sharedStrings.xml", testSharedStringsXML},
+		[2]string{"xl/worksheets/sheet1.xml", testSheetXML},
+		[2]string{"docProps/core.xml", testCoreXML},
+	)
+}
+
+func makeTestPptx(t *testing.T) []byte {
+	return makeTestOfficeZip(t,
+		[2]string{"[Content_Types].xml", "<Types/>"},
+		[2]string{"_rels/.rels", "<Relationships/>"},
+		[2]string{"ppt/presentation.xml", "<presentation/>"},
+		[2]string{"ppt/slides/slide10.xml", fmt.Sprintf(testSlideXML, "ten")},
+		[2]string{"ppt/slides/slide2.xml", fmt.Sprintf(testSlideXML, "two")},
+	)
+}
+
+func makeTestOdt(t *testing.T) []byte {
+	return makeTestOfficeZip(t,
+		[2]string{"mimetype", TypeOdt.MIME.Value},
+		[2]string{"content.xml", testODFContentXML},
+		[2]string{"meta.xml", testODFMetaXML},
+	)
+}
+
+func TestOfficeFileType(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		expected types.Type
+	}{
+		{"docx", makeTestDocx(t), matchers.TypeDocx},
+		{"xlsx", makeTestXlsx(t), matchers.TypeXlsx},
+		{"pptx", makeTestPptx(t), matchers.TypePptx},
+		{"odt", makeTestOdt(t), TypeOdt},
+		{"zip", makeTestZip(t), matchers.TypeZip},
+	}
+	for _, tt := range tests {
+		fType, err := filetype.Match(tt.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fType != tt.expected {
+			t.Fatalf("unexpected type of %s: got %v expected %v", tt.name, fType, tt.expected)
+		}
+	}
+}
+
+func TestOfficeTextLimit(t *testing.T) {
+	text := officeText{max: 7}
+	err := text.add("grü")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the limit falls after the first byte of ü
+	err = text.add("ßüe")
+	if err != errStopText {
+		t.Fatalf("unexpected error: got %v expected %v", err, errStopText)
+	}
+	if s := text.String(); s != "grüß" {
+		t.Fatalf("unexpected text: got %q expected %q", s, "grüß")
+	}
+}
+
+func TestGetOfficeMetadata(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "filetundra_office")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	ooxmlCreated := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	odfCreated := time.Date(2020, 1, 2, 3, 4, 5, 123456789, time.Local)
+	tests := []struct {
+		name     string
+		fType    types.Type
+		data     []byte
+		maxText  int64
+		expected officeMetadata
+	}{
+		{"docx", matchers.TypeDocx, makeTestDocx(t), 1024, officeMetadata{
+			Created:        ooxmlCreated,
+			Creator:        "Alice",
+			LastModifiedBy: "Bob",
+			Text:           "Sales grew\nby\tten percent\n",
+			Title:          "Quarterly Report",
+		}},
+		{"docx truncated", matchers.TypeDocx, makeTestDocx(t), 8, officeMetadata{
+			Created:        ooxmlCreated,
+			Creator:        "Alice",
+			LastModifiedBy: "Bob",
+			Text:           "Sales gr",
+			Title:          "Quarterly Report",
+		}},
+		{"xlsx", matchers.TypeXlsx, makeTestXlsx(t), 1024, officeMetadata{
+			Created:        ooxmlCreated,
+			Creator:        "Alice",
+			LastModifiedBy: "Bob",
+			Text:           "Invoice\nTotal due\n\t4711\t\n\toverdue\t\n",
+			Title:          "Quarterly Report",
+		}},
+		{"pptx", matchers.TypePptx, makeTestPptx(t), 1024, officeMetadata{
+			Text: "Slide two\nSlide ten\n",
+		}},
+		{"odt", TypeOdt, makeTestOdt(t), 1024, officeMetadata{
+			Created:        odfCreated,
+			Creator:        "Carol",
+			LastModifiedBy: "Dave",
+			Text:           "Agenda\nBudget approval\nItem\n",
+			Title:          "Minutes",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fpath := filepath.Join(tempDir, "document")
+			err := ioutil.WriteFile(fpath, tt.data, 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			meta, err := getOfficeMetadata(fpath, tt.fType, tt.maxText)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !meta.Created.Equal(tt.expected.Created) {
+				t.Fatalf("unexpected creation date: got %v expected %v", meta.Created, tt.expected.Created)
+			}
+			meta.Created = tt.expected.Created
+			if meta != tt.expected {
+				t.Fatalf("unexpected office metadata: got %+v expected %+v", meta, tt.expected)
+			}
+		})
+	}
+}
+
+func TestOfficeIndexing(t *testing.T) {
+	dataRoot, err := ioutil.TempDir("", "filetundra_root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataRoot)
+	env.Env.Root = dataRoot
+	defer func(size int64) {
+		env.Env.ContentMaxSize = size
+	}(env.Env.ContentMaxSize)
+	env.Env.ContentMaxSize = 1024
+	xlsxPath := filepath.Join(dataRoot, "invoices.xlsx")
+	err = ioutil.WriteFile(xlsxPath, makeTestXlsx(t), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	odtPath := filepath.Join(dataRoot, "minutes.odt")
+	err = ioutil.WriteFile(odtPath, makeTestOdt(t), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir, err := ioutil.TempDir("", "filetundra_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	Init(tempDir)
+	_, err = Initial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := bluge.OpenReader(BlugeConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	tests := []struct {
+		query    bluge.Query
+		expected string
+	}{
+		{bluge.NewMatchQuery("4711").SetField(properties.Content).SetAnalyzer(BlugeAnalyzer), xlsxPath},
+		{bluge.NewMatchQuery("approval").SetField(properties.Content).SetAnalyzer(BlugeAnalyzer), odtPath},
+		{bluge.NewMatchQuery("carol").SetField(properties.OfficeCreator), odtPath},
+	}
+	for _, tt := range tests {
+		searchResults, err := reader.Search(context.TODO(), bluge.NewAllMatches(tt.query))
+		if err != nil {
+			t.Fatal(err)
+		}
+		next, err := searchResults.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next == nil {
+			t.Fatalf("%s wasn't found", tt.expected)
+		}
+		fi, err := DocumentMatchToFileInfo(reader, next)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Filename != tt.expected {
+			t.Fatalf("unexpected result: got %s expected %s", fi.Filename, tt.expected)
+		}
+		if fi.Filename == xlsxPath && (fi.OfficeTitle != "Quarterly Report" || fi.OfficeLastModifiedBy != "Bob" ||
+			fi.MimeType != matchers.TypeXlsx.MIME.Value) {
+			t.Fatalf("unexpected file info: %+v", fi)
+		}
+		if fi.Filename == odtPath && (fi.MimeType != TypeOdt.MIME.Value ||
+			!fi.OfficeCreated.Equal(time.Date(2020, 1, 2, 3, 4, 5, 123456789, time.Local))) {
+			t.Fatalf("unexpected file info: %+v", fi)
+		}
+	}
+}
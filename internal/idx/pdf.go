@@ -0,0 +1,108 @@
+package idx
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/fatalbanana/filetundra/internal/env"
+	"github.com/fatalbanana/filetundra/internal/log"
+	"github.com/fatalbanana/filetundra/internal/properties"
+
+	"github.com/blugelabs/bluge"
+	"github.com/h2non/filetype/matchers"
+	"github.com/h2non/filetype/types"
+	"github.com/ledongthuc/pdf"
+	"go.uber.org/zap"
+)
+
+type pdfMetadata struct {
+	Author  string
+	Pages   int
+	Subject string
+	Text    string
+	Title   string
+}
+
+// getPDFMetadata reads the document information and up to maxText bytes
+// of text from the PDF at fpath.
+func getPDFMetadata(fpath string, maxText int64) (meta pdfMetadata, err error) {
+	f, err := os.Open(fpath) // #nosec: shut up
+	if err != nil {
+		return meta, err
+	}
+	defer func() {
+		err := f.Close()
+		if err != nil {
+			log.Logger.Error("error closing file",
+				zap.String("path", fpath), zap.Error(err))
+		}
+	}()
+	si, err := f.Stat()
+	if err != nil {
+		return meta, err
+	}
+
+	// the pdf package panics on malformed input
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed pdf: %v", r)
+		}
+	}()
+
+	r, err := pdf.NewReader(f, si.Size())
+	if err != nil {
+		return meta, err
+	}
+	info := r.Trailer().Key("Info")
+	meta.Author = info.Key("Author").Text()
+	meta.Subject = info.Key("Subject").Text()
+	meta.Title = info.Key("Title").Text()
+	meta.Pages = r.NumPage()
+
+	var text strings.Builder
+	for i := 1; i <= meta.Pages && int64(text.Len()) < maxText; i++ {
+		page := r.Page(i)
+		if page.V.IsNull() {
+			continue
+		}
+		fonts := make(map[string]*pdf.Font)
+		for _, name := range page.Fonts() {
+			font := page.Font(name)
+			fonts[name] = &font
+		}
+		pageText, err := page.GetPlainText(fonts)
+		if err != nil {
+			return meta, err
+		}
+		text.WriteString(pageText)
+		text.WriteString("\n")
+	}
+	meta.Text = truncateText(text.String(), int(maxText))
+	return meta, nil
+}
+
+func maybeProcessPDF(fpath string, fType types.Type, doc *bluge.Document) {
+	if fType != matchers.TypePdf {
+		return
+	}
+	meta, err := getPDFMetadata(fpath, env.Env.ContentMaxSize)
+	if err != nil {
+		log.Logger.Error("error getting pdf metadata",
+			zap.String("path", fpath), zap.Error(err))
+		return
+	}
+	if meta.Title != "" {
+		doc.AddField(bluge.NewTextField(properties.PDFTitle, meta.Title).WithAnalyzer(BlugeAnalyzer).StoreValue().HighlightMatches())
+	}
+	if meta.Author != "" {
+		doc.AddField(bluge.NewTextField(properties.PDFAuthor, meta.Author).StoreValue().HighlightMatches())
+	}
+	if meta.Subject != "" {
+		doc.AddField(bluge.NewTextField(properties.PDFSubject, meta.Subject).WithAnalyzer(BlugeAnalyzer).StoreValue().HighlightMatches())
+	}
+	doc.AddField(bluge.NewNumericField(properties.PDFPages, float64(meta.Pages)).StoreValue())
+	if strings.TrimSpace(meta.Text) != "" {
+		addContent(doc, meta.Text)
+	}
+}
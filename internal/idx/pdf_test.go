@@ -0,0 +1,82 @@
+package idx
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// makeTestPDF builds a single page PDF showing text.
+func makeTestPDF(title, author, subject, text string) []byte {
+	content := fmt.Sprintf("BT /F1 12 Tf 72 712 Td (%s) Tj ET", text)
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Contents 4 0 R /Resources << /Font << /F1 5 0 R >> >> >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+		fmt.Sprintf("<< /Title (%s) /Author (%s) /Subject (%s) >>", title, author, subject),
+	}
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R /Info 6 0 R >>\nstartxref\n%d\n%%%%EOF\n",
+		len(objects)+1, xref)
+	return buf.Bytes()
+}
+
+func TestGetPDFMetadata(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "filetundra_pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	fpath := filepath.Join(tempDir, "test.pdf")
+	err = ioutil.WriteFile(fpath, makeTestPDF("Annual Report", "Jane Doe", "Finances", "Quarterly figures"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := getPDFMetadata(fpath, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Title != "Annual Report" || meta.Author != "Jane Doe" || meta.Subject != "Finances" || meta.Pages != 1 {
+		t.Fatalf("unexpected metadata: %+v", meta)
+	}
+	if !strings.Contains(meta.Text, "Quarterly figures") {
+		t.Fatalf("unexpected text: %q", meta.Text)
+	}
+
+	meta, err = getPDFMetadata(fpath, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Text != "Quart" {
+		t.Fatalf("text wasn't capped: %q", meta.Text)
+	}
+
+	// malformed files must not panic
+	err = ioutil.WriteFile(fpath, []byte("%PDF-1.4\ngarbage"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = getPDFMetadata(fpath, 1024)
+	if err == nil {
+		t.Fatal("expected error for malformed pdf")
+	}
+}
@@ -0,0 +1,183 @@
+package idx
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"github.com/fatalbanana/filetundra/internal/env"
+
+	"github.com/blugelabs/bluge"
+	"github.com/blugelabs/bluge/index"
+)
+
+type indexJob struct {
+	fpath       string
+	d           fs.DirEntry
+	needsUpdate bool
+}
+
+type indexResult struct {
+	doc         *bluge.Document
+	needsUpdate bool
+}
+
+// batchWriter accumulates changes and writes them to the index whenever the
+// configured number of documents or bytes is exceeded. A limit which isn't
+// positive doesn't apply.
+type batchWriter struct {
+	batch *index.Batch
+	docs  int
+	bytes int
+}
+
+func newBatchWriter() *batchWriter {
+	return &batchWriter{batch: bluge.NewBatch()}
+}
+
+func (bw *batchWriter) Insert(doc *bluge.Document) error {
+	bw.batch.Insert(doc)
+	return bw.added(doc.Size())
+}
+
+func (bw *batchWriter) Update(doc *bluge.Document) error {
+	bw.batch.Update(doc.ID(), doc)
+	return bw.added(doc.Size())
+}
+
+func (bw *batchWriter) Delete(id bluge.Identifier) error {
+	bw.batch.Delete(id)
+	return bw.added(len(id))
+}
+
+func (bw *batchWriter) added(size int) error {
+	bw.docs++
+	bw.bytes += size
+	if (env.Env.IndexBatchDocs > 0 && bw.docs >= env.Env.IndexBatchDocs) ||
+		(env.Env.IndexBatchBytes > 0 && bw.bytes >= env.Env.IndexBatchBytes) {
+		return bw.Flush()
+	}
+	return nil
+}
+
+// Flush writes out pending changes.
+func (bw *batchWriter) Flush() error {
+	err := writeBatch(bw.batch)
+	bw.batch.Reset()
+	bw.docs = 0
+	bw.bytes = 0
+	return err
+}
+
+func numIndexWorkers() int {
+	if env.Env.IndexWorkers > 0 {
+		return env.Env.IndexWorkers
+	}
+	return runtime.NumCPU()
+}
+
+// walkPaths walks the root directory and sends paths which need indexing to
+// jobs.
+func walkPaths(ctx context.Context, reader *bluge.Reader, haveExisting func(*bluge.Reader, string, fs.DirEntry) (bool, error), jobs chan<- indexJob) error {
+	defer close(jobs)
+	return filepath.WalkDir(env.Env.Root, func(fpath string, d fs.DirEntry, err error) error {
+		var needsUpdate bool
+		if err != nil {
+			return err
+		}
+		if fpath == env.Env.Root {
+			return nil
+		}
+		doHaveExisting, err := haveExisting(reader, fpath, d)
+		if err != nil {
+			if err == ErrNeedsUpdate {
+				needsUpdate = true
+			} else {
+				return err
+			}
+		}
+		if doHaveExisting && !needsUpdate {
+			return nil
+		}
+		select {
+		case jobs <- indexJob{fpath: fpath, d: d, needsUpdate: needsUpdate}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+// extractDocuments turns jobs into documents until jobs is closed.
+func extractDocuments(ctx context.Context, jobs <-chan indexJob, results chan<- indexResult) error {
+	for job := range jobs {
+		doc, err := FileToDocument(job.fpath, job.d)
+		if err != nil {
+			return err
+		}
+		select {
+		case results <- indexResult{doc: doc, needsUpdate: job.needsUpdate}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// runPipeline feeds files from the walker through a pool of extractors and
+// hands the resulting documents to consume, returning the first error
+// encountered by any stage.
+func runPipeline(reader *bluge.Reader, haveExisting func(*bluge.Reader, string, fs.DirEntry) (bool, error), consume func(indexResult) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var firstErr error
+	var errOnce sync.Once
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	workers := numIndexWorkers()
+	jobs := make(chan indexJob, workers*2)
+	results := make(chan indexResult, workers*2)
+
+	go func() {
+		err := walkPaths(ctx, reader, haveExisting, jobs)
+		if err != nil {
+			fail(err)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			err := extractDocuments(ctx, jobs, results)
+			if err != nil {
+				fail(err)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	for res := range results {
+		if ctx.Err() != nil {
+			// drain so that extractors can exit
+			continue
+		}
+		err := consume(res)
+		if err != nil {
+			fail(err)
+		}
+	}
+	return firstErr
+}
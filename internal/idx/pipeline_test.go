@@ -0,0 +1,86 @@
+package idx
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fatalbanana/filetundra/internal/env"
+
+	"github.com/blugelabs/bluge"
+)
+
+func TestPipeline(t *testing.T) {
+	dataRoot, err := ioutil.TempDir("", "filetundra_root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataRoot)
+	env.Env.Root = dataRoot
+	defer func(workers, docs, bytes int) {
+		env.Env.IndexWorkers = workers
+		env.Env.IndexBatchDocs = docs
+		env.Env.IndexBatchBytes = bytes
+	}(env.Env.IndexWorkers, env.Env.IndexBatchDocs, env.Env.IndexBatchBytes)
+	env.Env.IndexWorkers = 3
+	env.Env.IndexBatchDocs = 4
+	env.Env.IndexBatchBytes = 1 << 20
+
+	const numFiles = 25
+	for i := 0; i < numFiles; i++ {
+		err = ioutil.WriteFile(filepath.Join(dataRoot, fmt.Sprintf("%02d.txt", i)), []byte("hello"), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tempDir, err := ioutil.TempDir("", "filetundra_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	Init(tempDir)
+	stats, err := Initial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Added != numFiles {
+		t.Fatalf("unexpected number of added documents: got %d expected %d", stats.Added, numFiles)
+	}
+
+	reader, err := bluge.OpenReader(BlugeConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	count, err := reader.Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != numFiles {
+		t.Fatalf("unexpected document count: got %d expected %d", count, numFiles)
+	}
+}
+
+func TestBatchWriterUnlimited(t *testing.T) {
+	defer func(docs, bytes int) {
+		env.Env.IndexBatchDocs = docs
+		env.Env.IndexBatchBytes = bytes
+	}(env.Env.IndexBatchDocs, env.Env.IndexBatchBytes)
+	env.Env.IndexBatchDocs = 0
+	env.Env.IndexBatchBytes = 0
+
+	bw := newBatchWriter()
+	for i := 0; i < 3; i++ {
+		err := bw.Delete(bluge.Identifier(fmt.Sprintf("%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bw.docs != 3 {
+		t.Fatalf("unexpected number of pending changes: got %d expected 3", bw.docs)
+	}
+}
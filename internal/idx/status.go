@@ -0,0 +1,61 @@
+package idx
+
+import (
+	"sync"
+	"time"
+
+	"github.com/blugelabs/bluge"
+)
+
+// Status describes the index and its most recent indexing run.
+type Status struct {
+	Documents     uint64 `json:"documents"`
+	SchemaVersion int    `json:"schema_version"`
+	// whether a full indexing run is in progress
+	Indexing bool `json:"indexing"`
+	// when the last full indexing run finished, nil if none has
+	LastRun   *time.Time  `json:"last_run,omitempty"`
+	LastStats UpdateStats `json:"last_stats"`
+	LastError string      `json:"last_error,omitempty"`
+}
+
+var (
+	statusMu sync.Mutex
+	status   Status
+)
+
+func startRun() {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	status.Indexing = true
+}
+
+func finishRun(stats UpdateStats, err error) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	status.Indexing = false
+	now := time.Now()
+	status.LastRun = &now
+	status.LastStats = stats
+	status.LastError = ""
+	if err != nil {
+		status.LastError = err.Error()
+	}
+}
+
+// GetStatus returns the status of the index with its current number of
+// documents.
+func GetStatus() (Status, error) {
+	statusMu.Lock()
+	res := status
+	statusMu.Unlock()
+	res.SchemaVersion = SchemaVersion
+
+	reader, err := bluge.OpenReader(BlugeConfig)
+	if err != nil {
+		return res, err
+	}
+	defer reader.Close()
+	res.Documents, err = reader.Count()
+	return res, err
+}
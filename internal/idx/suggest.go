@@ -0,0 +1,52 @@
+package idx
+
+import (
+	"strings"
+
+	"github.com/blugelabs/bluge"
+)
+
+const (
+	// separates the lower case key of a suggestion term from its value
+	suggestSeparator = "\x00"
+
+	// number of dictionary terms looked at per field and prefix
+	suggestScanLimit = 1000
+)
+
+// Suggestion is a value of a suggestion field with the number of documents
+// which have it.
+type Suggestion struct {
+	Value string
+	Count uint64
+}
+
+// newSuggestField returns a suggestion field offering value to prefix
+// lookups on key, ignoring case.
+func newSuggestField(field string, key string, value string) *bluge.TermField {
+	return bluge.NewKeywordField(field, strings.ToLower(key)+suggestSeparator+value)
+}
+
+// Suggest returns the values of a suggestion field whose keys start with
+// prefix, in the order of their keys.
+func Suggest(reader *bluge.Reader, field string, prefix string) ([]Suggestion, error) {
+	start := []byte(strings.ToLower(prefix))
+	// the end is exclusive, and no key contains the separator
+	end := append(append([]byte{}, start...), 0xff)
+	it, err := reader.DictionaryIterator(field, nil, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	var res []Suggestion
+	entry, err := it.Next()
+	for err == nil && entry != nil && len(res) < suggestScanLimit {
+		_, value, found := strings.Cut(entry.Term(), suggestSeparator)
+		if found && entry.Count() > 0 {
+			res = append(res, Suggestion{Value: value, Count: entry.Count()})
+		}
+		entry, err = it.Next()
+	}
+	return res, err
+}
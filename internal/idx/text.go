@@ -0,0 +1,137 @@
+package idx
+
+import (
+	"io"
+	"os"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/fatalbanana/filetundra/internal/env"
+	"github.com/fatalbanana/filetundra/internal/log"
+	"github.com/fatalbanana/filetundra/internal/properties"
+
+	"github.com/blugelabs/bluge"
+	"go.uber.org/zap"
+)
+
+const (
+	TextMimeType = "text/plain; charset=utf-8"
+
+	// tolerated share of control characters in text, in percent
+	maxControlPercent = 1
+
+	// bytes at the beginning of a file which decide whether it is text
+	textSniffSize = 8192
+
+	// bytes of content stored for highlighting search hits
+	contentExcerptSize = 4096
+)
+
+// looksLikeText reports whether buf is UTF-8 text, allowing for a rune
+// which was cut off at the end.
+func looksLikeText(buf []byte) bool {
+	if len(buf) == 0 {
+		return false
+	}
+	start := len(buf) - 1
+	for start > 0 && len(buf)-start < utf8.UTFMax && !utf8.RuneStart(buf[start]) {
+		start--
+	}
+	if !utf8.FullRune(buf[start:]) {
+		buf = buf[:start]
+	}
+	if !utf8.Valid(buf) {
+		return false
+	}
+	var runes, controls int
+	for _, r := range string(buf) {
+		runes++
+		switch r {
+		case 0:
+			return false
+		case '\t', '\n', '\v', '\f', '\r', '\x1b':
+			continue
+		}
+		if unicode.IsControl(r) {
+			controls++
+		}
+	}
+	return controls*100 <= runes*maxControlPercent
+}
+
+// readTextContent returns up to env.Env.ContentMaxSize bytes of the file at
+// fpath if they look like text. The rest is only read if the beginning of
+// the file does.
+func readTextContent(fpath string) (string, bool, error) {
+	f, err := os.Open(fpath) // #nosec: shut up
+	if err != nil {
+		return "", false, err
+	}
+	defer func() {
+		err := f.Close()
+		if err != nil {
+			log.Logger.Error("error closing file",
+				zap.String("path", fpath), zap.Error(err))
+		}
+	}()
+	sniffSize := env.Env.ContentMaxSize
+	if sniffSize > textSniffSize {
+		sniffSize = textSniffSize
+	}
+	buf, err := io.ReadAll(io.LimitReader(f, sniffSize))
+	if err != nil {
+		return "", false, err
+	}
+	if !looksLikeText(buf) {
+		return "", false, nil
+	}
+	if int64(len(buf)) < sniffSize {
+		return string(buf), true, nil
+	}
+	rest, err := io.ReadAll(io.LimitReader(f, env.Env.ContentMaxSize-sniffSize))
+	if err != nil {
+		return "", false, err
+	}
+	buf = append(buf, rest...)
+	if !looksLikeText(buf) {
+		return "", false, nil
+	}
+	return string(buf), true, nil
+}
+
+// maybeProcessText indexes the content of files which look like text and
+// reports whether they did.
+func maybeProcessText(fpath string, doc *bluge.Document) bool {
+	content, isText, err := readTextContent(fpath)
+	if err != nil {
+		log.Logger.Error("error reading text content",
+			zap.String("path", fpath), zap.Error(err))
+		return false
+	}
+	if !isText {
+		return false
+	}
+	addContent(doc, content)
+	return true
+}
+
+// addContent indexes the text content of a document. Only its beginning is
+// stored, to show matches in search results without loading whole documents
+// with every listing.
+func addContent(doc *bluge.Document, content string) {
+	doc.AddField(bluge.NewTextField(properties.Content, content).
+		WithAnalyzer(BlugeAnalyzer).HighlightMatches())
+	doc.AddField(bluge.NewStoredOnlyField(properties.ContentExcerpt,
+		[]byte(truncateText(content, contentExcerptSize))))
+}
+
+// truncateText shortens s to at most max bytes without cutting a rune.
+func truncateText(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
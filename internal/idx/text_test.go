@@ -0,0 +1,166 @@
+package idx
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fatalbanana/filetundra/internal/env"
+	"github.com/fatalbanana/filetundra/internal/properties"
+
+	"github.com/blugelabs/bluge"
+)
+
+func TestLooksLikeText(t *testing.T) {
+	tests := []struct {
+		name     string
+		buf      []byte
+		expected bool
+	}{
+		{"empty", []byte{}, false},
+		{"ascii", []byte("hello world\n"), true},
+		{"utf8", []byte("grüße, 世界\r\n\ttabbed"), true},
+		{"cut off rune", []byte("世界")[:5], true},
+		{"nul", []byte("hello\x00world"), false},
+		{"latin1", []byte("gr\xfc\xdfe"), false},
+		{"controls", []byte("\x01\x02\x03hello"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := looksLikeText(tt.buf); got != tt.expected {
+				t.Fatalf("looksLikeText(%q): got %v expected %v", tt.buf, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestTruncateText(t *testing.T) {
+	tests := []struct {
+		s        string
+		max      int
+		expected string
+	}{
+		{"hello", 10, "hello"},
+		{"hello", 5, "hello"},
+		{"hello", 3, "hel"},
+		{"grüße", 3, "gr"},
+		{"grüße", 4, "grü"},
+		{"世界", 2, ""},
+	}
+	for _, tt := range tests {
+		if got := truncateText(tt.s, tt.max); got != tt.expected {
+			t.Fatalf("truncateText(%q, %d): got %q expected %q", tt.s, tt.max, got, tt.expected)
+		}
+	}
+}
+
+func TestReadTextContent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filetundra_text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(size int64) {
+		env.Env.ContentMaxSize = size
+	}(env.Env.ContentMaxSize)
+	env.Env.ContentMaxSize = 2 * textSniffSize
+
+	text := strings.Repeat("a", textSniffSize)
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+		isText   bool
+	}{
+		{"short", "hello world\n", "hello world\n", true},
+		{"long", text + text + text, text + text, true},
+		{"binary", "\x00\x01" + text, "", false},
+		{"binary after beginning", text + strings.Repeat("\x00", textSniffSize), "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fpath := filepath.Join(dir, tt.name)
+			err := ioutil.WriteFile(fpath, []byte(tt.content), 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, isText, err := readTextContent(fpath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if isText != tt.isText || content != tt.expected {
+				t.Fatalf("unexpected content: got %d bytes, %v expected %d bytes, %v",
+					len(content), isText, len(tt.expected), tt.isText)
+			}
+		})
+	}
+}
+
+func TestContentIndexing(t *testing.T) {
+	dataRoot, err := ioutil.TempDir("", "filetundra_root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataRoot)
+	env.Env.Root = dataRoot
+	defer func(size int64) {
+		env.Env.ContentMaxSize = size
+	}(env.Env.ContentMaxSize)
+	env.Env.ContentMaxSize = 64
+
+	notesPath := filepath.Join(dataRoot, "notes")
+	err = ioutil.WriteFile(notesPath, []byte("remember the thermostat settings"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dataRoot, "binary"), []byte("\x00\x01thermostat"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir, err := ioutil.TempDir("", "filetundra_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	Init(tempDir)
+	_, err = Initial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := bluge.OpenReader(BlugeConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	query := bluge.NewMatchQuery("thermostat").SetField(properties.Content).SetAnalyzer(BlugeAnalyzer)
+	searchResults, err := reader.Search(context.TODO(), bluge.NewAllMatches(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var matches []FileInfo
+	next, err := searchResults.Next()
+	for err == nil && next != nil {
+		var fi FileInfo
+		fi, err = DocumentMatchToFileInfo(reader, next)
+		if err != nil {
+			t.Fatal(err)
+		}
+		matches = append(matches, fi)
+		next, err = searchResults.Next()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].Filename != notesPath {
+		t.Fatalf("unexpected matches: %+v", matches)
+	}
+	if matches[0].MimeType != TextMimeType {
+		t.Fatalf("unexpected MIME type: got %s expected %s", matches[0].MimeType, TextMimeType)
+	}
+}
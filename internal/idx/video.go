@@ -0,0 +1,159 @@
+package idx
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fatalbanana/filetundra/internal/log"
+	"github.com/fatalbanana/filetundra/internal/properties"
+
+	"github.com/blugelabs/bluge"
+	"github.com/h2non/filetype/matchers"
+	"github.com/h2non/filetype/types"
+	"go.uber.org/zap"
+)
+
+var (
+	videoMetaMimeMap = map[types.Type]struct{}{
+		matchers.Type3gp:  {},
+		matchers.TypeAvi:  {},
+		matchers.TypeM4v:  {},
+		matchers.TypeMkv:  {},
+		matchers.TypeMov:  {},
+		matchers.TypeMp4:  {},
+		matchers.TypeWebm: {},
+	}
+
+	errUnhandledVideoFormat = errors.New("unhandled video format")
+
+	// common names of video heights, in descending order
+	videoResolutions = []struct {
+		height int
+		name   string
+	}{
+		{4320, "4320p"},
+		{2160, "2160p"},
+		{1440, "1440p"},
+		{1080, "1080p"},
+		{720, "720p"},
+		{576, "576p"},
+		{480, "480p"},
+		{360, "360p"},
+		{240, "240p"},
+	}
+)
+
+type videoMetadata struct {
+	AudioCodecs       []string
+	AudioLanguages    []string
+	Codec             string
+	Duration          time.Duration
+	FrameRate         float64
+	Height            int
+	SubtitleLanguages []string
+	Title             string
+	Width             int
+}
+
+func appendUnique(values []string, value string) []string {
+	if value == "" {
+		return values
+	}
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
+
+// normalizeLanguage lower cases a language code, dropping undetermined ones.
+func normalizeLanguage(lang string) string {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if lang == "und" {
+		return ""
+	}
+	return lang
+}
+
+// videoResolution names the resolution of a video by the height it would
+// have in 16:9, so that letterboxed videos count as well.
+func videoResolution(width, height int) string {
+	if width*9/16 > height {
+		height = width * 9 / 16
+	}
+	for _, res := range videoResolutions {
+		// allow for cropping
+		if height >= res.height*9/10 {
+			return res.name
+		}
+	}
+	return ""
+}
+
+func getVideoMetadata(fpath string, fType types.Type) (meta videoMetadata, err error) {
+	f, err := os.Open(fpath) // #nosec: shut up
+	if err != nil {
+		return meta, err
+	}
+	defer func() {
+		err := f.Close()
+		if err != nil {
+			log.Logger.Error("error closing file",
+				zap.String("path", fpath), zap.Error(err))
+		}
+	}()
+
+	switch fType {
+	case matchers.Type3gp, matchers.TypeM4v, matchers.TypeMov, matchers.TypeMp4:
+		return getMp4Metadata(f)
+	case matchers.TypeMkv, matchers.TypeWebm:
+		return getMatroskaMetadata(f)
+	case matchers.TypeAvi:
+		return getAviMetadata(f)
+	}
+	return meta, errUnhandledVideoFormat
+}
+
+func maybeProcessVideo(fpath string, fType types.Type, doc *bluge.Document) {
+	_, ok := videoMetaMimeMap[fType]
+	if !ok {
+		return
+	}
+	meta, err := getVideoMetadata(fpath, fType)
+	if err != nil {
+		log.Logger.Error("error getting video metadata",
+			zap.String("path", fpath), zap.Error(err))
+		return
+	}
+	if meta.Duration > 0 {
+		doc.AddField(bluge.NewNumericField(properties.VideoDuration, meta.Duration.Seconds()).StoreValue())
+	}
+	if meta.Width > 0 && meta.Height > 0 {
+		doc.AddField(bluge.NewNumericField(properties.VideoWidth, float64(meta.Width)).StoreValue()).
+			AddField(bluge.NewNumericField(properties.VideoHeight, float64(meta.Height)).StoreValue())
+		if res := videoResolution(meta.Width, meta.Height); res != "" {
+			doc.AddField(bluge.NewKeywordField(properties.VideoResolution, res).StoreValue())
+		}
+	}
+	if meta.FrameRate > 0 {
+		doc.AddField(bluge.NewNumericField(properties.VideoFrameRate, meta.FrameRate).StoreValue())
+	}
+	if meta.Codec != "" {
+		doc.AddField(bluge.NewKeywordField(properties.VideoCodec, meta.Codec).StoreValue())
+	}
+	for _, codec := range meta.AudioCodecs {
+		doc.AddField(bluge.NewKeywordField(properties.VideoAudioCodec, codec).StoreValue())
+	}
+	for _, lang := range meta.AudioLanguages {
+		doc.AddField(bluge.NewKeywordField(properties.VideoAudioLanguage, lang).StoreValue())
+	}
+	for _, lang := range meta.SubtitleLanguages {
+		doc.AddField(bluge.NewKeywordField(properties.VideoSubtitleLanguage, lang).StoreValue())
+	}
+	if meta.Title != "" {
+		doc.AddField(bluge.NewTextField(properties.VideoTitle, meta.Title).WithAnalyzer(BlugeAnalyzer).StoreValue().HighlightMatches())
+	}
+}
@@ -0,0 +1,218 @@
+package idx
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	// upper bound for the size of the header lists read into memory
+	aviMaxListSize = 16 << 20
+)
+
+var (
+	errInvalidRiff = errors.New("invalid riff file")
+
+	// friendly names of video compression fourccs
+	aviVideoCodecs = map[string]string{
+		"avc1": "h264",
+		"divx": "mpeg4",
+		"dx50": "mpeg4",
+		"fmp4": "mpeg4",
+		"h264": "h264",
+		"h265": "hevc",
+		"hevc": "hevc",
+		"mjpg": "mjpeg",
+		"mp4v": "mpeg4",
+		"x264": "h264",
+		"xvid": "mpeg4",
+	}
+
+	// friendly names of wave format tags
+	aviAudioCodecs = map[uint16]string{
+		0x0001: "pcm",
+		0x0050: "mp2",
+		0x0055: "mp3",
+		0x00ff: "aac",
+		0x0161: "wma",
+		0x1610: "aac",
+		0x2000: "ac3",
+		0x2001: "dts",
+		0x706d: "aac",
+		0xf1ac: "flac",
+	}
+)
+
+// riffChunk is a RIFF chunk read into memory. The data of lists starts
+// with the list type.
+type riffChunk struct {
+	id   string
+	data []byte
+}
+
+// listType returns the type of a LIST chunk and its contents.
+func (c riffChunk) listType() (string, []byte) {
+	if c.id != "LIST" || len(c.data) < 4 {
+		return "", nil
+	}
+	return string(c.data[:4]), c.data[4:]
+}
+
+// riffChunks splits data into the chunks it contains.
+func riffChunks(data []byte) []riffChunk {
+	var chunks []riffChunk
+	for len(data) >= 8 {
+		size := uint64(binary.LittleEndian.Uint32(data[4:]))
+		if size > uint64(len(data)-8) {
+			size = uint64(len(data) - 8)
+		}
+		chunks = append(chunks, riffChunk{id: string(data[:4]), data: data[8 : 8+size]})
+		// chunks are padded to an even size
+		size += size & 1
+		if size > uint64(len(data)-8) {
+			break
+		}
+		data = data[8+size:]
+	}
+	return chunks
+}
+
+func parseAviStream(strl []byte, meta *videoMetadata) {
+	var strh, strf []byte
+	for _, chunk := range riffChunks(strl) {
+		switch chunk.id {
+		case "strh":
+			strh = chunk.data
+		case "strf":
+			strf = chunk.data
+		}
+	}
+	if len(strh) < 36 {
+		return
+	}
+	switch string(strh[:4]) {
+	case "vids":
+		if meta.Codec != "" {
+			return
+		}
+		scale := binary.LittleEndian.Uint32(strh[20:])
+		rate := binary.LittleEndian.Uint32(strh[24:])
+		length := binary.LittleEndian.Uint32(strh[32:])
+		if scale > 0 && rate > 0 {
+			meta.FrameRate = math.Round(float64(rate)/float64(scale)*1000) / 1000
+			if length > 0 {
+				meta.Duration = time.Duration(float64(length) * float64(scale) / float64(rate) * float64(time.Second))
+			}
+		}
+		fourcc := string(strh[4:8])
+		if len(strf) >= 20 {
+			fourcc = string(strf[16:20])
+		}
+		fourcc = strings.ToLower(strings.TrimRight(fourcc, "\x00 "))
+		if name, ok := aviVideoCodecs[fourcc]; ok {
+			meta.Codec = name
+		} else {
+			meta.Codec = fourcc
+		}
+	case "auds":
+		if len(strf) < 2 {
+			return
+		}
+		if name, ok := aviAudioCodecs[binary.LittleEndian.Uint16(strf)]; ok {
+			meta.AudioCodecs = appendUnique(meta.AudioCodecs, name)
+		}
+	}
+}
+
+func parseAviHeader(hdrl []byte, meta *videoMetadata) {
+	var usPerFrame, totalFrames uint32
+	for _, chunk := range riffChunks(hdrl) {
+		if chunk.id == "avih" && len(chunk.data) >= 40 {
+			usPerFrame = binary.LittleEndian.Uint32(chunk.data)
+			totalFrames = binary.LittleEndian.Uint32(chunk.data[16:])
+			meta.Width = int(binary.LittleEndian.Uint32(chunk.data[32:]))
+			meta.Height = int(binary.LittleEndian.Uint32(chunk.data[36:]))
+			continue
+		}
+		if listType, data := chunk.listType(); listType == "strl" {
+			parseAviStream(data, meta)
+		}
+	}
+	// the stream header is more accurate, and covers OpenDML files
+	if meta.Duration == 0 && usPerFrame > 0 {
+		meta.Duration = time.Duration(totalFrames) * time.Duration(usPerFrame) * time.Microsecond
+	}
+	if meta.FrameRate == 0 && usPerFrame > 0 {
+		meta.FrameRate = math.Round(float64(time.Second/time.Microsecond)/float64(usPerFrame)*1000) / 1000
+	}
+}
+
+func parseAviInfo(info []byte, meta *videoMetadata) {
+	for _, chunk := range riffChunks(info) {
+		if chunk.id == "INAM" {
+			meta.Title = strings.TrimSpace(strings.TrimRight(string(chunk.data), "\x00"))
+		}
+	}
+}
+
+// getAviMetadata reads the header and info lists of an AVI file, skipping
+// over the movie data.
+func getAviMetadata(f io.ReadSeeker) (meta videoMetadata, err error) {
+	var header [12]byte
+	_, err = io.ReadFull(f, header[:])
+	if err != nil {
+		return meta, err
+	}
+	if string(header[:4]) != "RIFF" || string(header[8:]) != "AVI " {
+		return meta, errInvalidRiff
+	}
+	end := int64(binary.LittleEndian.Uint32(header[4:])) + 8
+	pos := int64(len(header))
+
+	var haveHeader, haveInfo bool
+	for pos+12 <= end && (!haveHeader || !haveInfo) {
+		var chunkHeader [12]byte
+		_, err = io.ReadFull(f, chunkHeader[:])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return meta, err
+		}
+		size := int64(binary.LittleEndian.Uint32(chunkHeader[4:]))
+		size += size & 1
+		listType := string(chunkHeader[8:])
+		if string(chunkHeader[:4]) != "LIST" || listType != "hdrl" && listType != "INFO" {
+			pos += 8 + size
+			_, err = f.Seek(pos, io.SeekStart)
+			if err != nil {
+				return meta, err
+			}
+			continue
+		}
+		if size < 4 || size > aviMaxListSize {
+			return meta, errInvalidRiff
+		}
+		data := make([]byte, size-4)
+		_, err = io.ReadFull(f, data)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return meta, err
+		}
+		pos += 8 + size
+		if listType == "hdrl" {
+			haveHeader = true
+			parseAviHeader(data, &meta)
+		} else {
+			haveInfo = true
+			parseAviInfo(data, &meta)
+		}
+	}
+	if !haveHeader {
+		return meta, errInvalidRiff
+	}
+	return meta, nil
+}
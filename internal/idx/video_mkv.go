@@ -0,0 +1,346 @@
+package idx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	ebmlIDHeader         = 0x1a45dfa3
+	mkvIDSegment         = 0x18538067
+	mkvIDInfo            = 0x1549a966
+	mkvIDTracks          = 0x1654ae6b
+	mkvIDCluster         = 0x1f43b675
+	mkvIDTimecodeScale   = 0x2ad7b1
+	mkvIDDuration        = 0x4489
+	mkvIDTitle           = 0x7ba9
+	mkvIDTrackEntry      = 0xae
+	mkvIDTrackType       = 0x83
+	mkvIDCodecID         = 0x86
+	mkvIDLanguage        = 0x22b59c
+	mkvIDLanguageIETF    = 0x22b59d
+	mkvIDDefaultDuration = 0x23e383
+	mkvIDVideo           = 0xe0
+	mkvIDPixelWidth      = 0xb0
+	mkvIDPixelHeight     = 0xba
+	mkvIDDisplayWidth    = 0x54b0
+	mkvIDDisplayHeight   = 0x54ba
+
+	mkvTrackTypeVideo    = 1
+	mkvTrackTypeAudio    = 2
+	mkvTrackTypeSubtitle = 0x11
+
+	// upper bound for the size of the elements read into memory
+	mkvMaxElementSize = 16 << 20
+	// element size of all ones
+	ebmlUnknownSize = -1
+)
+
+var (
+	errInvalidEbml = errors.New("invalid ebml file")
+
+	// friendly names of codec IDs, matched by prefix
+	mkvCodecs = []struct {
+		prefix string
+		name   string
+	}{
+		{"A_AAC", "aac"},
+		{"A_AC3", "ac3"},
+		{"A_DTS", "dts"},
+		{"A_EAC3", "eac3"},
+		{"A_FLAC", "flac"},
+		{"A_MPEG/L3", "mp3"},
+		{"A_OPUS", "opus"},
+		{"A_PCM", "pcm"},
+		{"A_TRUEHD", "truehd"},
+		{"A_VORBIS", "vorbis"},
+		{"V_AV1", "av1"},
+		{"V_MPEG4/ISO/AVC", "h264"},
+		{"V_MPEG4/ISO", "mpeg4"},
+		{"V_MPEG2", "mpeg2"},
+		{"V_MPEGH/ISO/HEVC", "hevc"},
+		{"V_MS/VFW/FOURCC", "vfw"},
+		{"V_VP8", "vp8"},
+		{"V_VP9", "vp9"},
+	}
+)
+
+func mkvCodecName(codecID string) string {
+	for _, codec := range mkvCodecs {
+		if strings.HasPrefix(codecID, codec.prefix) {
+			return codec.name
+		}
+	}
+	_, name, _ := strings.Cut(codecID, "_")
+	return strings.ToLower(name)
+}
+
+// readEbmlVint reads a variable length integer, keeping the length marker
+// for element IDs. It returns ebmlUnknownSize for sizes of all ones.
+func readEbmlVint(r io.Reader, isID bool) (int64, error) {
+	var first [1]byte
+	_, err := io.ReadFull(r, first[:])
+	if err != nil {
+		return 0, err
+	}
+	length := 1
+	for length <= 8 && first[0]&(0x80>>(length-1)) == 0 {
+		length++
+	}
+	if length > 8 || isID && length > 4 {
+		return 0, errInvalidEbml
+	}
+	buf := make([]byte, 8)
+	buf[8-length] = first[0]
+	if !isID {
+		buf[8-length] &^= 0x80 >> (length - 1)
+	}
+	_, err = io.ReadFull(r, buf[9-length:])
+	if err != nil {
+		return 0, err
+	}
+	v := binary.BigEndian.Uint64(buf)
+	if !isID && v == 1<<(7*length)-1 {
+		return ebmlUnknownSize, nil
+	}
+	if v > math.MaxInt64 {
+		return 0, errInvalidEbml
+	}
+	return int64(v), nil
+}
+
+// ebmlElement is an EBML element read into memory.
+type ebmlElement struct {
+	id   int64
+	data []byte
+}
+
+// ebmlChildren splits data into the elements it contains.
+func ebmlChildren(data []byte) ([]ebmlElement, error) {
+	var elements []ebmlElement
+	for len(data) > 0 {
+		r := bytes.NewReader(data)
+		id, err := readEbmlVint(r, true)
+		if err != nil {
+			return elements, errInvalidEbml
+		}
+		size, err := readEbmlVint(r, false)
+		if err != nil {
+			return elements, errInvalidEbml
+		}
+		data = data[len(data)-r.Len():]
+		if size < 0 || size > int64(len(data)) {
+			return elements, errInvalidEbml
+		}
+		elements = append(elements, ebmlElement{id: id, data: data[:size]})
+		data = data[size:]
+	}
+	return elements, nil
+}
+
+func (e ebmlElement) uint() uint64 {
+	var v uint64
+	for _, b := range e.data {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+func (e ebmlElement) float() float64 {
+	switch len(e.data) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(e.data)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(e.data))
+	}
+	return 0
+}
+
+func (e ebmlElement) string() string {
+	return strings.TrimRight(string(e.data), "\x00")
+}
+
+func parseMkvInfo(data []byte, meta *videoMetadata) error {
+	elements, err := ebmlChildren(data)
+	if err != nil {
+		return err
+	}
+	timecodeScale := uint64(1000000)
+	var duration float64
+	for _, e := range elements {
+		switch e.id {
+		case mkvIDTimecodeScale:
+			timecodeScale = e.uint()
+		case mkvIDDuration:
+			duration = e.float()
+		case mkvIDTitle:
+			meta.Title = strings.TrimSpace(e.string())
+		}
+	}
+	meta.Duration = time.Duration(duration * float64(timecodeScale))
+	return nil
+}
+
+func parseMkvTrack(data []byte, meta *videoMetadata) error {
+	elements, err := ebmlChildren(data)
+	if err != nil {
+		return err
+	}
+	var trackType, defaultDuration uint64
+	var codec, ietfLang string
+	// the default language of tracks is English
+	lang := "eng"
+	var video []byte
+	for _, e := range elements {
+		switch e.id {
+		case mkvIDTrackType:
+			trackType = e.uint()
+		case mkvIDCodecID:
+			codec = mkvCodecName(e.string())
+		case mkvIDLanguage:
+			lang = e.string()
+		case mkvIDLanguageIETF:
+			ietfLang = e.string()
+		case mkvIDDefaultDuration:
+			defaultDuration = e.uint()
+		case mkvIDVideo:
+			video = e.data
+		}
+	}
+	if ietfLang != "" {
+		lang = ietfLang
+	}
+	lang = normalizeLanguage(lang)
+
+	switch trackType {
+	case mkvTrackTypeVideo:
+		if meta.Codec != "" {
+			return nil
+		}
+		meta.Codec = codec
+		if defaultDuration > 0 {
+			meta.FrameRate = math.Round(float64(time.Second)/float64(defaultDuration)*1000) / 1000
+		}
+		elements, err := ebmlChildren(video)
+		if err != nil {
+			return err
+		}
+		var displayWidth, displayHeight int
+		for _, e := range elements {
+			switch e.id {
+			case mkvIDPixelWidth:
+				meta.Width = int(e.uint())
+			case mkvIDPixelHeight:
+				meta.Height = int(e.uint())
+			case mkvIDDisplayWidth:
+				displayWidth = int(e.uint())
+			case mkvIDDisplayHeight:
+				displayHeight = int(e.uint())
+			}
+		}
+		if displayWidth > 0 && displayHeight > 0 {
+			meta.Width, meta.Height = displayWidth, displayHeight
+		}
+	case mkvTrackTypeAudio:
+		meta.AudioCodecs = appendUnique(meta.AudioCodecs, codec)
+		meta.AudioLanguages = appendUnique(meta.AudioLanguages, lang)
+	case mkvTrackTypeSubtitle:
+		meta.SubtitleLanguages = appendUnique(meta.SubtitleLanguages, lang)
+	}
+	return nil
+}
+
+// getMatroskaMetadata reads the segment information and tracks of a
+// Matroska or WebM file, which precede its clusters.
+func getMatroskaMetadata(f io.ReadSeeker) (meta videoMetadata, err error) {
+	id, err := readEbmlVint(f, true)
+	if err != nil {
+		return meta, err
+	}
+	size, err := readEbmlVint(f, false)
+	if err != nil {
+		return meta, err
+	}
+	if id != ebmlIDHeader || size < 0 {
+		return meta, errInvalidEbml
+	}
+	_, err = f.Seek(size, io.SeekCurrent)
+	if err != nil {
+		return meta, err
+	}
+	id, err = readEbmlVint(f, true)
+	if err != nil {
+		return meta, err
+	}
+	_, err = readEbmlVint(f, false)
+	if err != nil {
+		return meta, err
+	}
+	if id != mkvIDSegment {
+		return meta, errInvalidEbml
+	}
+
+	var haveInfo, haveTracks bool
+	for !haveInfo || !haveTracks {
+		id, err = readEbmlVint(f, true)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return meta, err
+		}
+		size, err = readEbmlVint(f, false)
+		if err != nil {
+			return meta, err
+		}
+		if id == mkvIDCluster || size == ebmlUnknownSize {
+			break
+		}
+		if id != mkvIDInfo && id != mkvIDTracks {
+			_, err = f.Seek(size, io.SeekCurrent)
+			if err != nil {
+				return meta, err
+			}
+			continue
+		}
+		if size > mkvMaxElementSize {
+			return meta, errInvalidEbml
+		}
+		data := make([]byte, size)
+		_, err = io.ReadFull(f, data)
+		if err != nil {
+			return meta, err
+		}
+		if id == mkvIDInfo {
+			haveInfo = true
+			err = parseMkvInfo(data, &meta)
+			if err != nil {
+				return meta, err
+			}
+			continue
+		}
+		haveTracks = true
+		tracks, err := ebmlChildren(data)
+		if err != nil {
+			return meta, err
+		}
+		for _, track := range tracks {
+			if track.id != mkvIDTrackEntry {
+				continue
+			}
+			err = parseMkvTrack(track.data, &meta)
+			if err != nil {
+				return meta, err
+			}
+		}
+	}
+	if !haveInfo && !haveTracks {
+		return meta, errInvalidEbml
+	}
+	return meta, nil
+}
@@ -0,0 +1,222 @@
+package idx
+
+import (
+	"io"
+	"math"
+	"strings"
+)
+
+var (
+	// friendly names of sample entry types
+	mp4Codecs = map[string]string{
+		".mp3": "mp3",
+		"ac-3": "ac3",
+		"alac": "alac",
+		"ap4h": "prores",
+		"apch": "prores",
+		"apcn": "prores",
+		"apco": "prores",
+		"apcs": "prores",
+		"av01": "av1",
+		"avc1": "h264",
+		"avc3": "h264",
+		"c608": "eia608",
+		"ec-3": "eac3",
+		"fLaC": "flac",
+		"hev1": "hevc",
+		"hvc1": "hevc",
+		"jpeg": "mjpeg",
+		"lpcm": "pcm",
+		"mp4a": "aac",
+		"mp4v": "mpeg4",
+		"Opus": "opus",
+		"sowt": "pcm",
+		"twos": "pcm",
+		"vp08": "vp8",
+		"vp09": "vp9",
+		"wvtt": "webvtt",
+	}
+)
+
+func mp4CodecName(fourcc string) string {
+	if name, ok := mp4Codecs[fourcc]; ok {
+		return name
+	}
+	return strings.ToLower(strings.TrimSpace(fourcc))
+}
+
+// mp4Language decodes a packed ISO 639-2/T language code.
+func mp4Language(packed uint64) string {
+	// QuickTime uses Macintosh language codes below 0x400
+	if packed < 0x400 {
+		return ""
+	}
+	return normalizeLanguage(string([]byte{
+		byte(packed>>10&0x1f) + 0x60,
+		byte(packed>>5&0x1f) + 0x60,
+		byte(packed&0x1f) + 0x60,
+	}))
+}
+
+// mp4TimeHeader reads the time scale and duration from a movie or media
+// header box, leaving r positioned after them.
+func mp4TimeHeader(r *bmffReader) (timescale, duration uint64) {
+	version, _ := r.fullBoxHeader()
+	if version == 1 {
+		r.next(16)
+		return r.uint(4), r.uint(8)
+	}
+	r.next(8)
+	return r.uint(4), r.uint(4)
+}
+
+// mp4Title returns the title from the iTunes or QuickTime user data.
+func mp4Title(moov []byte) string {
+	udta, ok := bmffChild(moov, "udta")
+	if !ok {
+		return ""
+	}
+	if meta, ok := bmffChild(udta.data, "meta"); ok {
+		data := meta.data
+		// the meta box is a full box in MP4 but not in QuickTime files
+		if len(data) >= 4 && string(data[:4]) == "\x00\x00\x00\x00" {
+			data = data[4:]
+		}
+		if title, ok := bmffChild(data, "ilst", "\xa9nam", "data"); ok && len(title.data) > 8 {
+			return strings.TrimSpace(string(title.data[8:]))
+		}
+	}
+	if title, ok := bmffChild(udta.data, "\xa9nam"); ok && len(title.data) > 4 {
+		r := bmffReader{data: title.data}
+		size := int(r.uint(2))
+		r.uint(2)
+		text := r.next(size)
+		if r.err == nil {
+			return strings.TrimSpace(string(text))
+		}
+	}
+	return ""
+}
+
+// mp4FrameRate computes the frame rate from a decoding time to sample box.
+func mp4FrameRate(stts []byte, timescale uint64) float64 {
+	r := bmffReader{data: stts}
+	r.fullBoxHeader()
+	entries := r.uint(4)
+	var samples, delta uint64
+	for i := uint64(0); i < entries && r.err == nil; i++ {
+		count, sampleDelta := r.uint(4), r.uint(4)
+		samples += count
+		delta += count * sampleDelta
+	}
+	if r.err != nil || delta == 0 {
+		return 0
+	}
+	return math.Round(float64(samples)*float64(timescale)/float64(delta)*1000) / 1000
+}
+
+func parseMp4Track(trak []byte, meta *videoMetadata) {
+	mdia, ok := bmffChild(trak, "mdia")
+	if !ok {
+		return
+	}
+	hdlr, ok := bmffChild(mdia.data, "hdlr")
+	if !ok {
+		return
+	}
+	r := bmffReader{data: hdlr.data}
+	r.fullBoxHeader()
+	r.next(4)
+	handler := string(r.next(4))
+	if r.err != nil {
+		return
+	}
+
+	var timescale uint64
+	var lang string
+	if mdhd, ok := bmffChild(mdia.data, "mdhd"); ok {
+		r := bmffReader{data: mdhd.data}
+		timescale, _ = mp4TimeHeader(&r)
+		packed := r.uint(2)
+		if r.err == nil {
+			lang = mp4Language(packed)
+		}
+	}
+	var codec string
+	var entry bmffBox
+	if stsd, ok := bmffChild(mdia.data, "minf", "stbl", "stsd"); ok && len(stsd.data) > 8 {
+		entries, _ := bmffChildren(stsd.data[8:])
+		if len(entries) > 0 {
+			entry = entries[0]
+			codec = mp4CodecName(entry.boxType)
+		}
+	}
+
+	switch handler {
+	case "vide":
+		if meta.Codec != "" {
+			return
+		}
+		meta.Codec = codec
+		if tkhd, ok := bmffChild(trak, "tkhd"); ok {
+			r := bmffReader{data: tkhd.data}
+			version, _ := r.fullBoxHeader()
+			if version == 1 {
+				r.next(32)
+			} else {
+				r.next(20)
+			}
+			r.next(52)
+			// 16.16 fixed point
+			width, height := r.uint(4)>>16, r.uint(4)>>16
+			if r.err == nil {
+				meta.Width, meta.Height = int(width), int(height)
+			}
+		}
+		if meta.Width == 0 || meta.Height == 0 {
+			// fall back to the coded size of the visual sample entry
+			r := bmffReader{data: entry.data}
+			r.next(24)
+			width, height := r.uint(2), r.uint(2)
+			if r.err == nil {
+				meta.Width, meta.Height = int(width), int(height)
+			}
+		}
+		if stts, ok := bmffChild(mdia.data, "minf", "stbl", "stts"); ok {
+			meta.FrameRate = mp4FrameRate(stts.data, timescale)
+		}
+	case "soun":
+		meta.AudioCodecs = appendUnique(meta.AudioCodecs, codec)
+		meta.AudioLanguages = appendUnique(meta.AudioLanguages, lang)
+	case "clcp", "sbtl", "subt", "text":
+		meta.SubtitleLanguages = appendUnique(meta.SubtitleLanguages, lang)
+	}
+}
+
+func getMp4Metadata(f io.ReadSeeker) (meta videoMetadata, err error) {
+	moov, _, err := readBmffTopLevel(f, "moov", mp4MaxMoovSize)
+	if err != nil {
+		return meta, err
+	}
+	if moov == nil {
+		return meta, errInvalidBmff
+	}
+	if mvhd, ok := bmffChild(moov, "mvhd"); ok {
+		r := bmffReader{data: mvhd.data}
+		timescale, duration := mp4TimeHeader(&r)
+		if r.err == nil {
+			meta.Duration = samplesDuration(duration, int(timescale))
+		}
+	}
+	meta.Title = mp4Title(moov)
+	boxes, err := bmffChildren(moov)
+	if err != nil {
+		return meta, err
+	}
+	for _, box := range boxes {
+		if box.boxType == "trak" {
+			parseMp4Track(box.data, &meta)
+		}
+	}
+	return meta, nil
+}
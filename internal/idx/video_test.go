@@ -0,0 +1,355 @@
+package idx
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fatalbanana/filetundra/internal/env"
+	"github.com/fatalbanana/filetundra/internal/properties"
+
+	"github.com/blugelabs/bluge"
+	"github.com/h2non/filetype/matchers"
+	"github.com/h2non/filetype/types"
+)
+
+func mp4PackLanguage(lang string) []byte {
+	packed := uint16(lang[0]-0x60)<<10 | uint16(lang[1]-0x60)<<5 | uint16(lang[2]-0x60)
+	return appendUint16(binary.BigEndian, nil, packed)
+}
+
+// mp4Track builds a trak box with a single sample description.
+func mp4Track(handler, lang, sampleEntry string, width, height uint32, stts []byte) []byte {
+	tkhd := make([]byte, 84)
+	binary.BigEndian.PutUint32(tkhd[76:], width<<16)
+	binary.BigEndian.PutUint32(tkhd[80:], height<<16)
+	mdhd := make([]byte, 20)
+	binary.BigEndian.PutUint32(mdhd[12:], 24000)
+	mdhd = append(mdhd, mp4PackLanguage(lang)...)
+	mdhd = append(mdhd, 0, 0)
+	hdlr := make([]byte, 24)
+	copy(hdlr[8:], handler)
+	stsd := appendUint32(binary.BigEndian, make([]byte, 4), 1)
+	stsd = append(stsd, isoBox(sampleEntry, make([]byte, 70))...)
+	stbl := isoBox("stsd", stsd)
+	if stts != nil {
+		stbl = append(stbl, isoBox("stts", stts)...)
+	}
+	return isoBox("trak", isoBox("tkhd", tkhd), isoBox("mdia",
+		isoBox("mdhd", mdhd), isoBox("hdlr", hdlr), isoBox("minf", isoBox("stbl", stbl))))
+}
+
+func makeTestMp4() []byte {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:], 60000)
+	title := append(make([]byte, 8), "Sintel"...)
+	udta := isoBox("udta", isoBox("meta", make([]byte, 4),
+		isoBox("ilst", isoBox("\xa9nam", isoBox("data", title)))))
+	// 1440 frames of 1001/24000s
+	stts := appendUint32(binary.BigEndian, make([]byte, 4), 1)
+	stts = appendUint32(binary.BigEndian, stts, 1440)
+	stts = appendUint32(binary.BigEndian, stts, 1001)
+	buf := isoBox("ftyp", []byte("isom\x00\x00\x02\x00isomavc1"))
+	buf = append(buf, isoBox("moov", isoBox("mvhd", mvhd), udta,
+		mp4Track("vide", "und", "avc1", 1920, 1080, stts),
+		mp4Track("soun", "eng", "mp4a", 0, 0, nil),
+		mp4Track("soun", "jpn", "ac-3", 0, 0, nil),
+		mp4Track("sbtl", "spa", "tx3g", 0, 0, nil),
+	)...)
+	return append(buf, isoBox("mdat", make([]byte, 64))...)
+}
+
+// ebmlElem builds an EBML element, using 1 or 8 byte sizes.
+func ebmlElem(id uint32, contents ...[]byte) []byte {
+	var buf []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if b := byte(id >> shift); b != 0 || len(buf) > 0 {
+			buf = append(buf, b)
+		}
+	}
+	var size uint64
+	for _, c := range contents {
+		size += uint64(len(c))
+	}
+	if size < 0x7f {
+		buf = append(buf, byte(size)|0x80)
+	} else {
+		sizeBytes := make([]byte, 8)
+		binary.BigEndian.PutUint64(sizeBytes, size|1<<56)
+		buf = append(buf, sizeBytes...)
+	}
+	for _, c := range contents {
+		buf = append(buf, c...)
+	}
+	return buf
+}
+
+func ebmlUint(id uint32, v uint64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, v)
+	return ebmlElem(id, data)
+}
+
+func makeTestMkv() []byte {
+	duration := make([]byte, 8)
+	binary.BigEndian.PutUint64(duration, math.Float64bits(90500))
+	buf := ebmlElem(ebmlIDHeader, ebmlUint(0x4286, 1), ebmlElem(0x4282, []byte("matroska")))
+	// a segment of unknown size, as written by live encoders
+	buf = append(buf, 0x18, 0x53, 0x80, 0x67, 0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	buf = append(buf, ebmlElem(0x114d9b74, ebmlUint(0x4dbb, 0))...)
+	buf = append(buf, ebmlElem(mkvIDInfo,
+		ebmlUint(mkvIDTimecodeScale, 1000000),
+		ebmlElem(mkvIDDuration, duration),
+		ebmlElem(mkvIDTitle, []byte("Big Buck Bunny")),
+	)...)
+	buf = append(buf, ebmlElem(mkvIDTracks,
+		ebmlElem(mkvIDTrackEntry,
+			ebmlUint(mkvIDTrackType, mkvTrackTypeVideo),
+			ebmlElem(mkvIDCodecID, []byte("V_MPEG4/ISO/AVC")),
+			ebmlElem(mkvIDLanguage, []byte("und")),
+			ebmlUint(mkvIDDefaultDuration, 40000000),
+			ebmlElem(mkvIDVideo, ebmlUint(mkvIDPixelWidth, 1280), ebmlUint(mkvIDPixelHeight, 720)),
+		),
+		ebmlElem(mkvIDTrackEntry,
+			ebmlUint(mkvIDTrackType, mkvTrackTypeAudio),
+			ebmlElem(mkvIDCodecID, []byte("A_AAC/MPEG4/LC")),
+		),
+		ebmlElem(mkvIDTrackEntry,
+			ebmlUint(mkvIDTrackType, mkvTrackTypeAudio),
+			ebmlElem(mkvIDCodecID, []byte("A_AC3")),
+			ebmlElem(mkvIDLanguage, []byte("ger")),
+			ebmlElem(mkvIDLanguageIETF, []byte("de")),
+		),
+		ebmlElem(mkvIDTrackEntry,
+			ebmlUint(mkvIDTrackType, mkvTrackTypeSubtitle),
+			ebmlElem(mkvIDCodecID, []byte("S_TEXT/UTF8")),
+			ebmlElem(mkvIDLanguage, []byte("fre")),
+		),
+	)...)
+	return append(buf, ebmlElem(mkvIDCluster, ebmlUint(0xe7, 0))...)
+}
+
+func riffChunkBytes(id string, contents ...[]byte) []byte {
+	var data []byte
+	for _, c := range contents {
+		data = append(data, c...)
+	}
+	buf := append([]byte(id), appendUint32(binary.LittleEndian, nil, uint32(len(data)))...)
+	buf = append(buf, data...)
+	if len(data)%2 == 1 {
+		buf = append(buf, 0)
+	}
+	return buf
+}
+
+func makeTestAvi() []byte {
+	avih := make([]byte, 56)
+	binary.LittleEndian.PutUint32(avih, 40000)
+	binary.LittleEndian.PutUint32(avih[16:], 250)
+	binary.LittleEndian.PutUint32(avih[32:], 720)
+	binary.LittleEndian.PutUint32(avih[36:], 576)
+	vidsHeader := make([]byte, 56)
+	copy(vidsHeader, "vidsxvid")
+	binary.LittleEndian.PutUint32(vidsHeader[20:], 1)
+	binary.LittleEndian.PutUint32(vidsHeader[24:], 25)
+	binary.LittleEndian.PutUint32(vidsHeader[32:], 250)
+	vidsFormat := make([]byte, 40)
+	copy(vidsFormat[16:], "XVID")
+	audsHeader := make([]byte, 56)
+	copy(audsHeader, "auds")
+	audsFormat := appendUint16(binary.LittleEndian, nil, 0x55)
+	return riffChunkBytes("RIFF", []byte("AVI "),
+		riffChunkBytes("LIST", []byte("hdrl"),
+			riffChunkBytes("avih", avih),
+			riffChunkBytes("LIST", []byte("strl"), riffChunkBytes("strh", vidsHeader), riffChunkBytes("strf", vidsFormat)),
+			riffChunkBytes("LIST", []byte("strl"), riffChunkBytes("strh", audsHeader), riffChunkBytes("strf", audsFormat)),
+		),
+		riffChunkBytes("LIST", []byte("movi"), riffChunkBytes("00dc", make([]byte, 99))),
+		riffChunkBytes("LIST", []byte("INFO"), riffChunkBytes("INAM", []byte("Home Movie\x00"))),
+		riffChunkBytes("idx1", make([]byte, 16)),
+	)
+}
+
+func TestVideoResolution(t *testing.T) {
+	tests := []struct {
+		width    int
+		height   int
+		expected string
+	}{
+		{1920, 1080, "1080p"},
+		{1920, 800, "1080p"},
+		{3840, 2160, "2160p"},
+		{640, 480, "480p"},
+		{720, 576, "576p"},
+		{160, 90, ""},
+	}
+	for _, tt := range tests {
+		if got := videoResolution(tt.width, tt.height); got != tt.expected {
+			t.Fatalf("unexpected resolution of %dx%d: got %q expected %q", tt.width, tt.height, got, tt.expected)
+		}
+	}
+}
+
+func TestGetVideoMetadata(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "filetundra_video")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	tests := []struct {
+		name     string
+		fType    types.Type
+		data     []byte
+		expected videoMetadata
+	}{
+		{"mp4", matchers.TypeMp4, makeTestMp4(), videoMetadata{
+			AudioCodecs:       []string{"aac", "ac3"},
+			AudioLanguages:    []string{"eng", "jpn"},
+			Codec:             "h264",
+			Duration:          time.Minute,
+			FrameRate:         23.976,
+			Height:            1080,
+			SubtitleLanguages: []string{"spa"},
+			Title:             "Sintel",
+			Width:             1920,
+		}},
+		{"mkv", matchers.TypeMkv, makeTestMkv(), videoMetadata{
+			AudioCodecs:       []string{"aac", "ac3"},
+			AudioLanguages:    []string{"eng", "de"},
+			Codec:             "h264",
+			Duration:          90500 * time.Millisecond,
+			FrameRate:         25,
+			Height:            720,
+			SubtitleLanguages: []string{"fre"},
+			Title:             "Big Buck Bunny",
+			Width:             1280,
+		}},
+		{"avi", matchers.TypeAvi, makeTestAvi(), videoMetadata{
+			AudioCodecs: []string{"mp3"},
+			Codec:       "mpeg4",
+			Duration:    10 * time.Second,
+			FrameRate:   25,
+			Height:      576,
+			Title:       "Home Movie",
+			Width:       720,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fpath := filepath.Join(tempDir, "video")
+			err := ioutil.WriteFile(fpath, tt.data, 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			meta, err := getVideoMetadata(fpath, tt.fType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(meta, tt.expected) {
+				t.Fatalf("unexpected video metadata: got %+v expected %+v", meta, tt.expected)
+			}
+		})
+	}
+}
+
+func TestVideoIndexing(t *testing.T) {
+	dataRoot, err := ioutil.TempDir("", "filetundra_root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataRoot)
+	env.Env.Root = dataRoot
+	mp4Path := filepath.Join(dataRoot, "sintel.mp4")
+	err = ioutil.WriteFile(mp4Path, makeTestMp4(), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mkvPath := filepath.Join(dataRoot, "bunny.mkv")
+	err = ioutil.WriteFile(mkvPath, makeTestMkv(), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir, err := ioutil.TempDir("", "filetundra_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	Init(tempDir)
+	_, err = Initial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := bluge.OpenReader(BlugeConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	tests := []struct {
+		field    string
+		term     string
+		expected string
+	}{
+		{properties.VideoResolution, "1080p", mp4Path},
+		{properties.VideoResolution, "720p", mkvPath},
+		{properties.VideoSubtitleLanguage, "fre", mkvPath},
+		{properties.VideoAudioLanguage, "jpn", mp4Path},
+		{properties.VideoCodec, "h264", ""},
+	}
+	for _, tt := range tests {
+		query := bluge.NewTermQuery(tt.term).SetField(tt.field)
+		searchResults, err := reader.Search(context.TODO(), bluge.NewAllMatches(query))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found []string
+		next, err := searchResults.Next()
+		for err == nil && next != nil {
+			fi, err := DocumentMatchToFileInfo(reader, next)
+			if err != nil {
+				t.Fatal(err)
+			}
+			found = append(found, fi.Filename)
+			next, err = searchResults.Next()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.expected == "" && len(found) != 2 || tt.expected != "" && (len(found) != 1 || found[0] != tt.expected) {
+			t.Fatalf("unexpected results for %s:%s: got %v expected %v", tt.field, tt.term, found, tt.expected)
+		}
+	}
+
+	query := bluge.NewMatchQuery("bunny").SetField(properties.VideoTitle).SetAnalyzer(BlugeAnalyzer)
+	searchResults, err := reader.Search(context.TODO(), bluge.NewAllMatches(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := searchResults.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next == nil {
+		t.Fatal("bunny wasn't found")
+	}
+	fi, err := DocumentMatchToFileInfo(reader, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Filename != mkvPath || fi.VideoWidth != 1280 || fi.VideoHeight != 720 || fi.VideoFrameRate != 25 ||
+		fi.VideoDuration != 90500*time.Millisecond || fi.VideoTitle != "Big Buck Bunny" ||
+		!reflect.DeepEqual(fi.VideoAudioLanguages, []string{"eng", "de"}) {
+		t.Fatalf("unexpected file info: %+v", fi)
+	}
+}
@@ -0,0 +1,198 @@
+package idx
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fatalbanana/filetundra/internal/env"
+	"github.com/fatalbanana/filetundra/internal/log"
+
+	"github.com/blugelabs/bluge"
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+const (
+	// flush pending events at the latest after this many debounce periods
+	watchMaxDelayFactor = 10
+)
+
+// Watch recursively watches the root directory and applies changes to the
+// index until ctx is cancelled.
+func Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	addWatches(watcher, env.Env.Root)
+
+	debounce := env.Env.WatchDebounce
+	pending := make(map[string]fsnotify.Op)
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	var firstPending time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			if len(pending) > 0 {
+				applyChanges(pending)
+			}
+			return nil
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if ev.Op == fsnotify.Chmod {
+				continue
+			}
+			if ev.Op&fsnotify.Create != 0 {
+				si, err := os.Stat(ev.Name)
+				if err == nil && si.IsDir() {
+					addWatches(watcher, ev.Name)
+				}
+			}
+			if len(pending) == 0 {
+				firstPending = time.Now()
+			}
+			pending[ev.Name] |= ev.Op
+			if time.Since(firstPending) < debounce*watchMaxDelayFactor {
+				timer.Reset(debounce)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Logger.Error("watcher error", zap.Error(err))
+		case <-timer.C:
+			applyChanges(pending)
+			pending = make(map[string]fsnotify.Op)
+		}
+	}
+}
+
+// addWatches watches root and the directories below it. Directories which
+// can't be read or watched are logged and left out.
+func addWatches(watcher *fsnotify.Watcher, root string) {
+	// the walk function never fails
+	_ = filepath.WalkDir(root, func(fpath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			log.Logger.Error("error walking directory to watch",
+				zap.String("path", fpath), zap.Error(err))
+			return fs.SkipDir
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		err = watcher.Add(fpath)
+		if err != nil {
+			log.Logger.Error("error adding watch",
+				zap.String("path", fpath), zap.Error(err))
+		}
+		return nil
+	})
+}
+
+func applyChanges(pending map[string]fsnotify.Op) {
+	paths := make([]string, 0, len(pending))
+	for fpath := range pending {
+		paths = append(paths, fpath)
+	}
+	sort.Strings(paths)
+
+	reader, err := bluge.OpenReader(BlugeConfig)
+	if err != nil {
+		log.Logger.Error("error opening reader", zap.Error(err))
+		return
+	}
+	defer reader.Close()
+
+	bw := newBatchWriter()
+	for _, fpath := range paths {
+		err = applyChange(reader, bw, fpath, pending[fpath])
+		if err != nil {
+			log.Logger.Error("error applying change",
+				zap.String("path", fpath), zap.Error(err))
+		}
+	}
+
+	err = bw.Flush()
+	if err != nil {
+		log.Logger.Error("error writing batch", zap.Error(err))
+		return
+	}
+	log.Logger.Debug("applied filesystem changes", zap.Int("paths", len(paths)))
+}
+
+func applyChange(reader *bluge.Reader, bw *batchWriter, fpath string, op fsnotify.Op) error {
+	if fpath == env.Env.Root {
+		return nil
+	}
+	si, err := os.Stat(fpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return deletePath(reader, bw, fpath)
+		}
+		return err
+	}
+	d := fs.FileInfoToDirEntry(si)
+	if si.IsDir() && op&fsnotify.Create != 0 {
+		// directories moved into the tree arrive with their contents
+		return filepath.WalkDir(fpath, func(subPath string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			return updatePath(bw, subPath, d)
+		})
+	}
+	return updatePath(bw, fpath, d)
+}
+
+func updatePath(bw *batchWriter, fpath string, d fs.DirEntry) error {
+	doc, err := FileToDocument(fpath, d)
+	if err != nil {
+		return err
+	}
+	return bw.Update(doc)
+}
+
+func deletePath(reader *bluge.Reader, bw *batchWriter, fpath string) error {
+	err := bw.Delete(bluge.Identifier(fpath))
+	if err != nil {
+		return err
+	}
+
+	prefix := strings.TrimSuffix(fpath, string(filepath.Separator)) + string(filepath.Separator)
+	query := bluge.NewPrefixQuery(prefix).SetField("_id")
+	searchResults, err := reader.Search(context.TODO(), bluge.NewAllMatches(query))
+	if err != nil {
+		return err
+	}
+	next, err := searchResults.Next()
+	for err == nil && next != nil {
+		var id bluge.Identifier
+		err = next.VisitStoredFields(func(field string, value []byte) bool {
+			if field == "_id" {
+				id = bluge.Identifier(value)
+				return false
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		err = bw.Delete(id)
+		if err != nil {
+			return err
+		}
+		next, err = searchResults.Next()
+	}
+	return err
+}
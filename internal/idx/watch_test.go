@@ -0,0 +1,144 @@
+package idx
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fatalbanana/filetundra/internal/env"
+
+	"github.com/blugelabs/bluge"
+	"github.com/fsnotify/fsnotify"
+)
+
+func haveIndexed(t *testing.T, fpath string) bool {
+	reader, err := bluge.OpenReader(BlugeConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	query := bluge.NewTermQuery(fpath).SetField("_id")
+	searchResults, err := reader.Search(context.TODO(), bluge.NewAllMatches(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := searchResults.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return next != nil
+}
+
+func waitIndexed(t *testing.T, fpath string, want bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if haveIndexed(t, fpath) == want {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s (indexed: %v)", fpath, want)
+}
+
+func TestAddWatches(t *testing.T) {
+	dataRoot, err := ioutil.TempDir("", "filetundra_root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataRoot)
+	subDir := filepath.Join(dataRoot, "sub")
+	err = os.Mkdir(subDir, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	// directories which can't be walked are skipped
+	addWatches(watcher, filepath.Join(dataRoot, "missing"))
+	addWatches(watcher, dataRoot)
+
+	fpath := filepath.Join(subDir, "new.txt")
+	err = ioutil.WriteFile(fpath, []byte("hello"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-watcher.Events:
+			if ev.Name == fpath {
+				return
+			}
+		case err := <-watcher.Errors:
+			t.Fatal(err)
+		case <-timeout:
+			t.Fatalf("timed out waiting for an event for %s", fpath)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dataRoot, err := ioutil.TempDir("", "filetundra_root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataRoot)
+	env.Env.Root = dataRoot
+	env.Env.WatchDebounce = 50 * time.Millisecond
+
+	tempDir, err := ioutil.TempDir("", "filetundra_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	Init(tempDir)
+	_, err = Initial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- Watch(ctx)
+	}()
+	defer func() {
+		cancel()
+		err := <-done
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	// give the watcher a moment to set up
+	time.Sleep(100 * time.Millisecond)
+
+	subDir := filepath.Join(dataRoot, "sub")
+	err = os.Mkdir(subDir, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitIndexed(t, subDir, true)
+
+	fpath := filepath.Join(subDir, "new.txt")
+	err = ioutil.WriteFile(fpath, []byte("hello"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitIndexed(t, fpath, true)
+
+	err = os.RemoveAll(subDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitIndexed(t, subDir, false)
+	waitIndexed(t, fpath, false)
+}
@@ -1,15 +1,78 @@
 package properties
 
 var (
-	ArchiveFilename = "archive.filename"
-	AudioAlbum      = "audio.album"
-	AudioArtist     = "audio.artist"
-	AudioTitle      = "audio.title"
-	BareBasename    = "basename"
-	Extname         = "extname"
-	Dirname         = "dirname"
-	Filename        = "filename"
-	MimeType        = "mimetype"
-	ModifiedTime    = "modtime"
-	Size            = "size"
+	Ancestor              = "ancestor"
+	ArchiveFilename       = "archive.filename"
+	AudioAlbum            = "audio.album"
+	AudioAlbumArtist      = "audio.albumartist"
+	AudioArtist           = "audio.artist"
+	AudioArtwork          = "audio.artwork"
+	AudioBitrate          = "audio.bitrate"
+	AudioComposer         = "audio.composer"
+	AudioDisc             = "audio.disc"
+	AudioDiscs            = "audio.discs"
+	AudioDuration         = "audio.duration"
+	AudioGenre            = "audio.genre"
+	AudioTitle            = "audio.title"
+	AudioTrack            = "audio.track"
+	AudioTracks           = "audio.tracks"
+	AudioYear             = "audio.year"
+	BareBasename          = "basename"
+	BookAuthor            = "book.author"
+	BookCover             = "book.cover"
+	BookFormat            = "book.format"
+	BookISBN              = "book.isbn"
+	BookLanguage          = "book.language"
+	BookSeries            = "book.series"
+	BookSeriesIndex       = "book.seriesindex"
+	BookTitle             = "book.title"
+	Content               = "content"
+	ContentExcerpt        = "content.excerpt"
+	CoverImage            = "cover"
+	Extname               = "extname"
+	FacetAlbum            = "facet.album"
+	FacetArtist           = "facet.artist"
+	FacetBookAuthor       = "facet.bookauthor"
+	FacetBookSeries       = "facet.bookseries"
+	FacetExtension        = "facet.ext"
+	FacetType             = "facet.type"
+	FacetYear             = "facet.year"
+	Dirname               = "dirname"
+	Filename              = "filename"
+	ImageDateTaken        = "image.datetaken"
+	ImageHeight           = "image.height"
+	ImageLens             = "image.lens"
+	ImageLocation         = "image.location"
+	ImageMake             = "image.make"
+	ImageModel            = "image.model"
+	ImageOrientation      = "image.orientation"
+	ImageWidth            = "image.width"
+	MimeType              = "mimetype"
+	ModifiedTime          = "modtime"
+	OfficeCreated         = "office.created"
+	OfficeCreator         = "office.creator"
+	OfficeLastModifiedBy  = "office.lastmodifiedby"
+	OfficeTitle           = "office.title"
+	PDFAuthor             = "pdf.author"
+	PDFPages              = "pdf.pages"
+	PDFSubject            = "pdf.subject"
+	PDFTitle              = "pdf.title"
+	Size                  = "size"
+	SortName              = "sortname"
+	SortTitle             = "sorttitle"
+	SortType              = "sorttype"
+	SuggestAlbum          = "suggest.album"
+	SuggestArtist         = "suggest.artist"
+	SuggestDirectory      = "suggest.dir"
+	SuggestName           = "suggest.name"
+	VideoAudioCodec       = "video.audiocodec"
+	VideoAudioLanguage    = "video.audiolang"
+	VideoCodec            = "video.codec"
+	VideoDuration         = "video.duration"
+	VideoFrameRate        = "video.fps"
+	VideoHeight           = "video.height"
+	VideoResolution       = "video.resolution"
+	VideoSubtitleLanguage = "video.sublang"
+	VideoTitle            = "video.title"
+	VideoWidth            = "video.width"
 )
@@ -0,0 +1,406 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatalbanana/filetundra/internal/env"
+	"github.com/fatalbanana/filetundra/internal/idx"
+	"github.com/fatalbanana/filetundra/internal/properties"
+
+	"github.com/blugelabs/bluge"
+)
+
+var ErrInvalidValue = errors.New("invalid value")
+
+type fieldKind int
+
+const (
+	// text analyzed by the standard analyzer
+	textField fieldKind = iota
+	// text analyzed by idx.BlugeAnalyzer
+	analyzedField
+	// keywords stored in lower case
+	lowerKeywordField
+	// keywords matched exactly as they are stored
+	exactField
+	numericField
+	// numbers of seconds, also written as minutes:seconds
+	durationField
+	// numbers of bytes with an optional binary unit such as 5M
+	sizeField
+	dateField
+	dirField
+	extField
+	isbnField
+	mimeField
+)
+
+type target struct {
+	field string
+	kind  fieldKind
+}
+
+// fields maps the field names of the query language to the index fields
+// they search.
+var fields = map[string][]target{
+	"album":        {{properties.AudioAlbum, textField}},
+	"album.exact":  {{properties.FacetAlbum, exactField}},
+	"albumartist":  {{properties.AudioAlbumArtist, textField}},
+	"archive":      {{properties.ArchiveFilename, textField}},
+	"artist":       {{properties.AudioArtist, textField}, {properties.AudioAlbumArtist, textField}},
+	"artist.exact": {{properties.FacetArtist, exactField}},
+	"author": {
+		{properties.BookAuthor, textField},
+		{properties.OfficeCreator, textField},
+		{properties.PDFAuthor, textField},
+	},
+	"bitrate":  {{properties.AudioBitrate, numericField}},
+	"codec":    {{properties.VideoCodec, lowerKeywordField}, {properties.VideoAudioCodec, lowerKeywordField}},
+	"composer": {{properties.AudioComposer, textField}},
+	"content":  {{properties.Content, analyzedField}},
+	"created":  {{properties.OfficeCreated, dateField}},
+	"dir":      {{properties.Dirname, dirField}},
+	"duration": {{properties.AudioDuration, durationField}, {properties.VideoDuration, durationField}},
+	"ext":      {{properties.FacetExtension, extField}},
+	"genre":    {{properties.AudioGenre, textField}},
+	"height":   {{properties.ImageHeight, numericField}, {properties.VideoHeight, numericField}},
+	"isbn":     {{properties.BookISBN, isbnField}},
+	"lang": {
+		{properties.BookLanguage, lowerKeywordField},
+		{properties.VideoAudioLanguage, lowerKeywordField},
+		{properties.VideoSubtitleLanguage, lowerKeywordField},
+	},
+	"lens":       {{properties.ImageLens, textField}},
+	"make":       {{properties.ImageMake, textField}},
+	"mime":       {{properties.MimeType, mimeField}},
+	"model":      {{properties.ImageModel, textField}},
+	"modified":   {{properties.ModifiedTime, dateField}},
+	"name":       {{properties.BareBasename, analyzedField}},
+	"pages":      {{properties.PDFPages, numericField}},
+	"resolution": {{properties.VideoResolution, lowerKeywordField}},
+	"series":     {{properties.BookSeries, textField}},
+	"size":       {{properties.Size, sizeField}},
+	"taken":      {{properties.ImageDateTaken, dateField}},
+	"title": {
+		{properties.AudioTitle, textField},
+		{properties.BookTitle, analyzedField},
+		{properties.OfficeTitle, analyzedField},
+		{properties.PDFTitle, analyzedField},
+		{properties.VideoTitle, analyzedField},
+	},
+	"track": {{properties.AudioTrack, numericField}},
+	"type":  {{properties.FacetType, lowerKeywordField}},
+	"width": {{properties.ImageWidth, numericField}, {properties.VideoWidth, numericField}},
+	"year":  {{properties.AudioYear, numericField}},
+}
+
+func isWildcard(value string) bool {
+	return strings.ContainsAny(value, "*?")
+}
+
+// termQuery compiles a single term of the query.
+func termQuery(tok token) (bluge.Query, error) {
+	if tok.value == "" {
+		return nil, nil
+	}
+	if tok.field == "" {
+		return textQuery(tok.value, tok.quoted), nil
+	}
+	targets := fields[tok.field]
+	var alternatives []bluge.Query
+	for _, t := range targets {
+		q, err := fieldQuery(t, tok.value, tok.quoted)
+		if err != nil {
+			return nil, fmt.Errorf("%w for %s: %q", err, tok.field, tok.value)
+		}
+		alternatives = append(alternatives, q)
+	}
+	if len(alternatives) == 1 {
+		return alternatives[0], nil
+	}
+	q := bluge.NewBooleanQuery()
+	for _, alternative := range alternatives {
+		q.AddShould(alternative)
+	}
+	return q, nil
+}
+
+// textQuery searches the names and descriptive metadata of files for free
+// text.
+func textQuery(value string, quoted bool) bluge.Query {
+	q := bluge.NewBooleanQuery()
+	if !quoted && isWildcard(value) {
+		pattern := strings.ToLower(value)
+		for _, field := range []string{properties.BareBasename, properties.ArchiveFilename, properties.Content} {
+			q.AddShould(bluge.NewWildcardQuery(pattern).SetField(field))
+		}
+		return q
+	}
+	match := func(field string, analyzed bool) bluge.Query {
+		return matchQuery(field, value, quoted, analyzed)
+	}
+	q.AddShould(match(properties.BareBasename, true))
+	q.AddShould(bluge.NewFuzzyQuery(value).SetField(properties.BareBasename))
+	q.AddShould(bluge.NewFuzzyQuery(value).SetField(properties.Dirname))
+	q.AddShould(bluge.NewFuzzyQuery(value).SetField(properties.ArchiveFilename))
+	q.AddShould(match(properties.Content, true))
+	q.AddShould(match(properties.PDFTitle, true))
+	q.AddShould(match(properties.PDFAuthor, false))
+	q.AddShould(match(properties.PDFSubject, true))
+	q.AddShould(match(properties.OfficeTitle, true))
+	q.AddShould(match(properties.OfficeCreator, false))
+	q.AddShould(match(properties.OfficeLastModifiedBy, false))
+	q.AddShould(match(properties.BookTitle, true))
+	q.AddShould(match(properties.BookAuthor, false))
+	q.AddShould(match(properties.BookSeries, false))
+	q.AddShould(match(properties.AudioArtist, false))
+	q.AddShould(match(properties.AudioAlbum, false))
+	q.AddShould(match(properties.AudioAlbumArtist, false))
+	q.AddShould(match(properties.AudioComposer, false))
+	q.AddShould(match(properties.AudioGenre, false))
+	q.AddShould(match(properties.AudioTitle, false))
+	q.AddShould(match(properties.ImageMake, false))
+	q.AddShould(match(properties.ImageModel, false))
+	q.AddShould(match(properties.ImageLens, false))
+	// video keywords are stored in lower case
+	videoTerm := strings.ToLower(strings.TrimSpace(value))
+	q.AddShould(bluge.NewTermQuery(videoTerm).SetField(properties.VideoResolution))
+	q.AddShould(bluge.NewTermQuery(videoTerm).SetField(properties.VideoCodec))
+	q.AddShould(bluge.NewTermQuery(videoTerm).SetField(properties.VideoAudioLanguage))
+	q.AddShould(bluge.NewTermQuery(videoTerm).SetField(properties.VideoSubtitleLanguage))
+	q.AddShould(match(properties.VideoTitle, true))
+	return q
+}
+
+func fieldQuery(t target, value string, quoted bool) (bluge.Query, error) {
+	wildcard := !quoted && isWildcard(value)
+	switch t.kind {
+	case textField, analyzedField:
+		if wildcard {
+			return bluge.NewWildcardQuery(strings.ToLower(value)).SetField(t.field), nil
+		}
+		return matchQuery(t.field, value, quoted, t.kind == analyzedField), nil
+	case lowerKeywordField:
+		return keywordQuery(t.field, strings.ToLower(value), wildcard), nil
+	case exactField:
+		return keywordQuery(t.field, value, wildcard), nil
+	case dirField:
+		return keywordQuery(t.field, filepath.Join(env.Env.Root, "/", value), wildcard), nil
+	case extField:
+		if !strings.HasPrefix(value, ".") {
+			value = "." + value
+		}
+		return keywordQuery(t.field, strings.ToLower(value), wildcard), nil
+	case isbnField:
+		isbn := strings.ToUpper(strings.ReplaceAll(value, "-", ""))
+		return keywordQuery(t.field, isbn, wildcard), nil
+	case mimeField:
+		// the standard analyzer splits mime types into their major and
+		// minor type, so audio/* is the term audio
+		value = strings.TrimSuffix(value, "/*")
+		if isWildcard(value) {
+			return bluge.NewWildcardQuery(strings.ToLower(value)).SetField(t.field), nil
+		}
+		return matchQuery(t.field, value, true, false), nil
+	case numericField:
+		return numericQuery(t.field, value, parseNumber)
+	case durationField:
+		return numericQuery(t.field, value, parseDuration)
+	case sizeField:
+		return numericQuery(t.field, value, parseSize)
+	case dateField:
+		return dateQuery(t.field, value)
+	}
+	return keywordQuery(t.field, value, wildcard), nil
+}
+
+// phraseFields are indexed with term positions, which phrase queries need.
+var phraseFields = map[string]bool{properties.Content: true}
+
+// matchQuery searches a text field for the words of value. A quoted value
+// matches a phrase where possible and else all of its words.
+func matchQuery(field string, value string, quoted bool, analyzed bool) bluge.Query {
+	if quoted && phraseFields[field] {
+		q := bluge.NewMatchPhraseQuery(value).SetField(field)
+		if analyzed {
+			q.SetAnalyzer(idx.BlugeAnalyzer)
+		}
+		return q
+	}
+	q := bluge.NewMatchQuery(value).SetField(field)
+	if quoted {
+		q.SetOperator(bluge.MatchQueryOperatorAnd)
+	}
+	if analyzed {
+		q.SetAnalyzer(idx.BlugeAnalyzer)
+	}
+	return q
+}
+
+func keywordQuery(field string, value string, wildcard bool) bluge.Query {
+	if wildcard {
+		return bluge.NewWildcardQuery(value).SetField(field)
+	}
+	return bluge.NewTermQuery(value).SetField(field)
+}
+
+// splitRange splits a range such as >5, <=5 or 1..5 into its operator and
+// bounds. The operator of a single value is empty.
+func splitRange(value string) (op string, lo string, hi string) {
+	for _, op := range []string{">=", "<=", ">", "<"} {
+		if strings.HasPrefix(value, op) {
+			return op, strings.TrimPrefix(value, op), ""
+		}
+	}
+	if i := strings.Index(value, ".."); i >= 0 {
+		return "..", value[:i], value[i+2:]
+	}
+	return "", value, ""
+}
+
+func parseNumber(value string) (float64, error) {
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, ErrInvalidValue
+	}
+	return n, nil
+}
+
+// parseDuration parses seconds, minutes:seconds or hours:minutes:seconds.
+func parseDuration(value string) (float64, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) > 3 {
+		return 0, ErrInvalidValue
+	}
+	var seconds float64
+	for _, part := range parts {
+		n, err := parseNumber(part)
+		if err != nil {
+			return 0, err
+		}
+		seconds = seconds*60 + n
+	}
+	return seconds, nil
+}
+
+var sizeUnits = map[byte]float64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}
+
+// parseSize parses a number of bytes with an optional unit of K, M, G or T,
+// which may be followed by B or iB.
+func parseSize(value string) (float64, error) {
+	number := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(value), "B"), "I")
+	multiplier := 1.0
+	if n := len(number); n > 0 {
+		if unit, ok := sizeUnits[number[n-1]]; ok {
+			multiplier = unit
+			number = number[:n-1]
+		}
+	}
+	n, err := parseNumber(number)
+	if err != nil {
+		return 0, err
+	}
+	return n * multiplier, nil
+}
+
+func numericQuery(field string, value string, parse func(string) (float64, error)) (bluge.Query, error) {
+	op, lo, hi := splitRange(value)
+	min, max := bluge.MinNumeric, bluge.MaxNumeric
+	minInclusive, maxInclusive := true, true
+	var err error
+	switch op {
+	case "":
+		min, err = parse(lo)
+		max = min
+	case ">", ">=":
+		min, err = parse(lo)
+		minInclusive = op == ">="
+	case "<", "<=":
+		max, err = parse(lo)
+		maxInclusive = op == "<="
+	case "..":
+		if lo == "" && hi == "" {
+			return nil, ErrInvalidValue
+		}
+		if lo != "" {
+			min, err = parse(lo)
+		}
+		if err == nil && hi != "" {
+			max, err = parse(hi)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bluge.NewNumericRangeInclusiveQuery(min, max, minInclusive, maxInclusive).SetField(field), nil
+}
+
+var dateLayouts = []struct {
+	layout string
+	// the period of time a date of the layout stands for
+	years, months, days int
+	duration            time.Duration
+}{
+	{"2006", 1, 0, 0, 0},
+	{"2006-01", 0, 1, 0, 0},
+	{"2006-01-02", 0, 0, 1, 0},
+	{"2006-01-02T15:04", 0, 0, 0, time.Minute},
+	{"2006-01-02T15:04:05", 0, 0, 0, time.Second},
+}
+
+// parseDate returns the start and end of the period a date stands for, such
+// as the whole month for 2024-01.
+func parseDate(value string) (start time.Time, end time.Time, err error) {
+	for _, l := range dateLayouts {
+		start, err = time.ParseInLocation(l.layout, value, time.Local)
+		if err == nil {
+			return start, start.AddDate(l.years, l.months, l.days).Add(l.duration), nil
+		}
+	}
+	return start, end, ErrInvalidValue
+}
+
+func dateQuery(field string, value string) (bluge.Query, error) {
+	op, lo, hi := splitRange(value)
+	var start, end time.Time
+	startInclusive := true
+	loStart, loEnd, err := parseDate(lo)
+	if op == ".." && lo == "" {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case "":
+		start, end = loStart, loEnd
+	case ">":
+		start = loEnd
+	case ">=":
+		start = loStart
+	case "<":
+		end = loStart
+	case "<=":
+		end = loEnd
+	case "..":
+		if lo == "" && hi == "" {
+			return nil, ErrInvalidValue
+		}
+		start = loStart
+		if hi != "" {
+			_, end, err = parseDate(hi)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if start.IsZero() {
+		startInclusive = false
+	}
+	return bluge.NewDateRangeInclusiveQuery(start, end, startInclusive, false).SetField(field), nil
+}
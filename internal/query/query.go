@@ -0,0 +1,304 @@
+// Package query parses the search language of the web interface into bluge
+// queries.
+//
+// A query is a list of terms which must all match. Terms are words, quoted
+// phrases or field filters such as artist:"Miles Davis", size:>5M,
+// modified:2024-01..2024-06, ext:.flac, type:image or mime:audio/*. A term
+// prefixed with - must not match, terms separated by OR need only match one
+// of them and parentheses group terms. The facet filters artist.exact and
+// album.exact match a tag value exactly.
+package query
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/blugelabs/bluge"
+)
+
+// limits on the size of queries, which are parsed recursively and expand
+// every free text word into a search of many fields
+const (
+	maxDepth     = 32
+	maxTerms     = 64
+	maxTextTerms = 16
+)
+
+var (
+	ErrTooDeep      = errors.New("too deeply nested parentheses")
+	ErrTooManyTerms = errors.New("too many terms")
+)
+
+type tokenKind int
+
+const (
+	tokenTerm tokenKind = iota
+	tokenOr
+	tokenOpen
+	tokenClose
+)
+
+type token struct {
+	kind   tokenKind
+	negate bool
+	// field name, empty for free text
+	field  string
+	value  string
+	quoted bool
+}
+
+// lexer splits a query into tokens.
+type lexer struct {
+	s   string
+	pos int
+}
+
+func (l *lexer) peek() rune {
+	r, _ := utf8.DecodeRuneInString(l.s[l.pos:])
+	return r
+}
+
+func (l *lexer) done() bool {
+	return l.pos >= len(l.s)
+}
+
+func isWordEnd(r rune) bool {
+	return unicode.IsSpace(r) || r == '(' || r == ')'
+}
+
+// quoted reads a phrase up to the closing quote or the end of the query.
+func (l *lexer) quoted() string {
+	l.pos++
+	end := strings.IndexByte(l.s[l.pos:], '"')
+	if end < 0 {
+		value := l.s[l.pos:]
+		l.pos = len(l.s)
+		return value
+	}
+	value := l.s[l.pos : l.pos+end]
+	l.pos += end + 1
+	return value
+}
+
+func (l *lexer) word() string {
+	start := l.pos
+	for !l.done() && !isWordEnd(l.peek()) {
+		_, size := utf8.DecodeRuneInString(l.s[l.pos:])
+		l.pos += size
+	}
+	return l.s[start:l.pos]
+}
+
+// fieldPrefix consumes a known field name followed by a colon.
+func (l *lexer) fieldPrefix() string {
+	// only look for the colon in the current word
+	word := l.s[l.pos:]
+	if end := strings.IndexFunc(word, isWordEnd); end >= 0 {
+		word = word[:end]
+	}
+	colon := strings.IndexByte(word, ':')
+	if colon <= 0 {
+		return ""
+	}
+	name := strings.ToLower(word[:colon])
+	if _, ok := fields[name]; !ok {
+		return ""
+	}
+	l.pos += colon + 1
+	return name
+}
+
+func (l *lexer) next() (token, bool) {
+	for !l.done() && unicode.IsSpace(l.peek()) {
+		l.pos++
+	}
+	if l.done() {
+		return token{}, false
+	}
+	var tok token
+	if l.peek() == '-' && l.pos+1 < len(l.s) {
+		l.pos++
+		tok.negate = true
+	}
+	switch l.peek() {
+	case '(':
+		l.pos++
+		tok.kind = tokenOpen
+		return tok, true
+	case ')':
+		l.pos++
+		tok.kind = tokenClose
+		return tok, true
+	}
+	tok.field = l.fieldPrefix()
+	if l.peek() == '"' {
+		tok.value = l.quoted()
+		tok.quoted = true
+		return tok, true
+	}
+	tok.value = l.word()
+	if tok.value == "OR" && !tok.negate && tok.field == "" {
+		tok.kind = tokenOr
+	}
+	return tok, true
+}
+
+func lex(s string) []token {
+	l := lexer{s: s}
+	var tokens []token
+	for {
+		tok, ok := l.next()
+		if !ok {
+			return tokens
+		}
+		tokens = append(tokens, tok)
+	}
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	// number of open parentheses
+	depth int
+}
+
+func (p *parser) peek() (token, bool) {
+	if p.pos >= len(p.tokens) {
+		return token{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+// or parses terms separated by OR.
+func (p *parser) or() (bluge.Query, error) {
+	var alternatives []bluge.Query
+	for {
+		q, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		if q != nil {
+			alternatives = append(alternatives, q)
+		}
+		tok, ok := p.peek()
+		if !ok || tok.kind != tokenOr {
+			break
+		}
+		p.pos++
+	}
+	switch len(alternatives) {
+	case 0:
+		return nil, nil
+	case 1:
+		return alternatives[0], nil
+	}
+	q := bluge.NewBooleanQuery()
+	for _, alternative := range alternatives {
+		q.AddShould(alternative)
+	}
+	return q, nil
+}
+
+// and parses a list of terms up to OR, a closing parenthesis or the end.
+func (p *parser) and() (bluge.Query, error) {
+	var must, mustNot []bluge.Query
+	for {
+		tok, ok := p.peek()
+		if !ok || tok.kind == tokenOr || tok.kind == tokenClose {
+			break
+		}
+		p.pos++
+		var q bluge.Query
+		var err error
+		switch tok.kind {
+		case tokenOpen:
+			if p.depth >= maxDepth {
+				return nil, ErrTooDeep
+			}
+			p.depth++
+			q, err = p.or()
+			p.depth--
+			// a missing closing parenthesis is implied at the end
+			if next, ok := p.peek(); ok && next.kind == tokenClose {
+				p.pos++
+			}
+		default:
+			q, err = termQuery(tok)
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case q == nil:
+		case tok.negate:
+			mustNot = append(mustNot, q)
+		default:
+			must = append(must, q)
+		}
+	}
+	if len(must) == 1 && len(mustNot) == 0 {
+		return must[0], nil
+	}
+	if len(must) == 0 && len(mustNot) == 0 {
+		return nil, nil
+	}
+	q := bluge.NewBooleanQuery()
+	if len(must) == 0 {
+		q.AddMust(bluge.NewMatchAllQuery())
+	}
+	q.AddMust(must...)
+	q.AddMustNot(mustNot...)
+	return q, nil
+}
+
+// checkTerms limits the number of terms in a query.
+func checkTerms(tokens []token) error {
+	var terms, textTerms int
+	for _, tok := range tokens {
+		if tok.kind != tokenTerm {
+			continue
+		}
+		terms++
+		if tok.field == "" {
+			textTerms++
+		}
+	}
+	if terms > maxTerms || textTerms > maxTextTerms {
+		return ErrTooManyTerms
+	}
+	return nil
+}
+
+// Parse compiles a search query. Queries without terms match nothing.
+func Parse(s string) (bluge.Query, error) {
+	tokens := lex(s)
+	err := checkTerms(tokens)
+	if err != nil {
+		return nil, err
+	}
+	p := parser{tokens: tokens}
+	var parts []bluge.Query
+	for {
+		q, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if q != nil {
+			parts = append(parts, q)
+		}
+		// skip unbalanced closing parentheses
+		if _, ok := p.peek(); !ok {
+			break
+		}
+		p.pos++
+	}
+	switch len(parts) {
+	case 0:
+		return bluge.NewMatchNoneQuery(), nil
+	case 1:
+		return parts[0], nil
+	}
+	return bluge.NewBooleanQuery().AddMust(parts...), nil
+}
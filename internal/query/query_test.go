@@ -0,0 +1,253 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fatalbanana/filetundra/internal/env"
+	"github.com/fatalbanana/filetundra/internal/idx"
+	"github.com/fatalbanana/filetundra/internal/properties"
+
+	"github.com/blugelabs/bluge"
+)
+
+func makeTestReader(t *testing.T) *bluge.Reader {
+	tempDir, err := ioutil.TempDir("", "filetundra_query")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tempDir) })
+	idx.Init(tempDir)
+	env.Env.Root = "/share"
+
+	file := func(fpath string, basename string, dirname string, extname string, mimeType string) *bluge.Document {
+		return bluge.NewDocument(fpath).
+			AddField(bluge.NewTextField(properties.BareBasename, basename).WithAnalyzer(idx.BlugeAnalyzer)).
+			AddField(bluge.NewKeywordField(properties.Dirname, dirname)).
+			AddField(bluge.NewKeywordField(properties.Extname, extname)).
+			AddField(bluge.NewKeywordField(properties.FacetExtension, strings.ToLower(extname))).
+			AddField(bluge.NewTextField(properties.MimeType, mimeType))
+	}
+	docs := []*bluge.Document{
+		file("/share/music/jazz/take five.flac", "take five", "/share/music/jazz", ".flac", "audio/flac").
+			AddField(bluge.NewTextField(properties.AudioArtist, "Dave Brubeck")).
+			AddField(bluge.NewKeywordField(properties.FacetArtist, "Dave Brubeck")).
+			AddField(bluge.NewNumericField(properties.AudioYear, 1959)).
+			AddField(bluge.NewNumericField(properties.AudioDuration, 324)),
+		file("/share/music/rock/come together.mp3", "come together", "/share/music/rock", ".mp3", "audio/mpeg").
+			AddField(bluge.NewTextField(properties.AudioArtist, "The Beatles")).
+			AddField(bluge.NewNumericField(properties.AudioYear, 1969)).
+			AddField(bluge.NewNumericField(properties.AudioDuration, 259)),
+		file("/share/photos/holiday beach.jpg", "holiday beach", "/share/photos", ".JPG", "image/jpeg").
+			AddField(bluge.NewKeywordField(properties.FacetType, "image")).
+			AddField(bluge.NewTextField(properties.ImageMake, "Canon")).
+			AddField(bluge.NewNumericField(properties.ImageWidth, 4000)).
+			AddField(bluge.NewDateTimeField(properties.ImageDateTaken,
+				time.Date(2019, 8, 1, 12, 0, 0, 0, time.Local))),
+		file("/share/docs/annual report.pdf", "annual report", "/share/docs", ".pdf", "application/pdf").
+			AddField(bluge.NewTextField(properties.PDFTitle, "Annual Report 2019").WithAnalyzer(idx.BlugeAnalyzer)).
+			AddField(bluge.NewNumericField(properties.PDFPages, 12)).
+			AddField(bluge.NewTextField(properties.Content, "quarterly revenue grew").WithAnalyzer(idx.BlugeAnalyzer)),
+	}
+
+	writer, err := bluge.OpenWriter(bluge.InMemoryOnlyConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := bluge.NewBatch()
+	for _, doc := range docs {
+		batch.Update(doc.ID(), doc)
+	}
+	err = writer.Batch(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := writer.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	t.Cleanup(func() { reader.Close() })
+	return reader
+}
+
+func searchIDs(t *testing.T, reader *bluge.Reader, q bluge.Query) []string {
+	results, err := reader.Search(context.Background(), bluge.NewAllMatches(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	next, err := results.Next()
+	for err == nil && next != nil {
+		err = next.VisitStoredFields(func(field string, value []byte) bool {
+			if field == "_id" {
+				ids = append(ids, string(value))
+			}
+			return true
+		})
+		if err == nil {
+			next, err = results.Next()
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestParse(t *testing.T) {
+	reader := makeTestReader(t)
+
+	const (
+		flac = "/share/music/jazz/take five.flac"
+		mp3  = "/share/music/rock/come together.mp3"
+		jpg  = "/share/photos/holiday beach.jpg"
+		pdf  = "/share/docs/annual report.pdf"
+	)
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"holiday", []string{jpg}},
+		{"beatles", []string{mp3}},
+		{`"annual report"`, []string{pdf}},
+		{`artist:"dave brubeck"`, []string{flac}},
+		{"ARTIST:brubeck", []string{flac}},
+		{`artist.exact:"Dave Brubeck"`, []string{flac}},
+		{`artist.exact:"dave brubeck"`, nil},
+		{"artist.exact:Brubeck", nil},
+		{"ext:.flac", []string{flac}},
+		{"ext:mp3", []string{mp3}},
+		{"ext:.jpg", []string{jpg}},
+		{"type:image", []string{jpg}},
+		{"mime:audio/*", []string{flac, mp3}},
+		{"mime:image/jpeg", []string{jpg}},
+		{"-mime:audio/*", []string{pdf, jpg}},
+		{"mime:audio/* -artist:beatles", []string{flac}},
+		{"year:>1960", []string{mp3}},
+		{"year:1950..1960", []string{flac}},
+		{"year:<=1969", []string{flac, mp3}},
+		{"year:1969", []string{mp3}},
+		{"duration:>5:00", []string{flac}},
+		{"width:>=4000", []string{jpg}},
+		{"taken:2019", []string{jpg}},
+		{"taken:2019-07..2019-08", []string{jpg}},
+		{"taken:>2019-08", nil},
+		{"taken:<=2019-08-01", []string{jpg}},
+		{"beatles OR brubeck", []string{flac, mp3}},
+		{"(beatles OR brubeck) year:<1960", []string{flac}},
+		{"-(beatles OR brubeck) -holiday", []string{pdf}},
+		{"name:hol*", []string{jpg}},
+		{"dir:/music/*", []string{flac, mp3}},
+		{"dir:/photos", []string{jpg}},
+		{"content:revenue", []string{pdf}},
+		{"title:annual pages:12", []string{pdf}},
+		{"unknown:field", nil},
+		{"", nil},
+		{"  ) ", nil},
+	}
+	for _, tt := range tests {
+		q, err := Parse(tt.query)
+		if err != nil {
+			t.Fatalf("unexpected error parsing %q: %v", tt.query, err)
+		}
+		if got := searchIDs(t, reader, q); !reflect.DeepEqual(got, tt.expected) {
+			t.Fatalf("unexpected matches for %q: got %v expected %v", tt.query, got, tt.expected)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, query := range []string{"width:wide", "size:>big", "modified:yesterday", "year:..", "duration:1:2:3:4"} {
+		_, err := Parse(query)
+		if !errors.Is(err, ErrInvalidValue) {
+			t.Fatalf("unexpected error parsing %q: got %v expected %v", query, err, ErrInvalidValue)
+		}
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	nested := func(depth int) string {
+		return strings.Repeat("(", depth) + "word" + strings.Repeat(")", depth)
+	}
+	words := func(n int, prefix string) string {
+		var terms []string
+		for i := 0; i < n; i++ {
+			terms = append(terms, fmt.Sprintf("%sword%d", prefix, i))
+		}
+		return strings.Join(terms, " ")
+	}
+	tests := []struct {
+		query    string
+		expected error
+	}{
+		{nested(maxDepth), nil},
+		{nested(maxDepth + 1), ErrTooDeep},
+		{strings.Repeat("(", 900000), ErrTooDeep},
+		{words(maxTextTerms, ""), nil},
+		{words(maxTextTerms+1, ""), ErrTooManyTerms},
+		{words(maxTerms, "name:"), nil},
+		{words(maxTerms+1, "name:"), ErrTooManyTerms},
+		// looking for field names is linear in the length of the query
+		{strings.Repeat("a ", 200000), ErrTooManyTerms},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.query)
+		if !errors.Is(err, tt.expected) {
+			t.Fatalf("unexpected error parsing a query of %d bytes: got %v expected %v", len(tt.query), err, tt.expected)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected float64
+	}{
+		{"100", 100},
+		{"5k", 5 << 10},
+		{"5M", 5 << 20},
+		{"1.5GB", 1.5 * (1 << 30)},
+		{"2TiB", 2 << 40},
+	}
+	for _, tt := range tests {
+		got, err := parseSize(tt.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.expected {
+			t.Fatalf("unexpected size of %q: got %v expected %v", tt.value, got, tt.expected)
+		}
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	tests := []struct {
+		value string
+		start time.Time
+		end   time.Time
+	}{
+		{"2024", time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local), time.Date(2025, 1, 1, 0, 0, 0, 0, time.Local)},
+		{"2024-06", time.Date(2024, 6, 1, 0, 0, 0, 0, time.Local), time.Date(2024, 7, 1, 0, 0, 0, 0, time.Local)},
+		{"2024-12-31", time.Date(2024, 12, 31, 0, 0, 0, 0, time.Local), time.Date(2025, 1, 1, 0, 0, 0, 0, time.Local)},
+		{"2024-01-02T03:04", time.Date(2024, 1, 2, 3, 4, 0, 0, time.Local), time.Date(2024, 1, 2, 3, 5, 0, 0, time.Local)},
+	}
+	for _, tt := range tests {
+		start, end, err := parseDate(tt.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !start.Equal(tt.start) || !end.Equal(tt.end) {
+			t.Fatalf("unexpected period of %q: got %v-%v expected %v-%v", tt.value, start, end, tt.start, tt.end)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package web
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/fatalbanana/filetundra/internal/env"
+	"github.com/fatalbanana/filetundra/internal/idx"
+	"github.com/fatalbanana/filetundra/internal/log"
+	"github.com/fatalbanana/filetundra/internal/properties"
+
+	"github.com/blugelabs/bluge"
+	"github.com/blugelabs/bluge/search"
+	"go.uber.org/zap"
+)
+
+const apiPrefix = "/api/v1"
+
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// apiError is the body of all error responses of the API.
+type apiError struct {
+	Status  int    `json:"status"`
+	Message string `json:"error"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func newAPIError(status int, message string) *apiError {
+	return &apiError{Status: status, Message: message}
+}
+
+// apiFile is a file or directory in API responses.
+type apiFile struct {
+	// path below the root
+	Path string `json:"path"`
+	// API listing of directories and archives
+	Browse string `json:"browse,omitempty"`
+	// contents of files
+	Download    string              `json:"download,omitempty"`
+	Score       float64             `json:"score,omitempty"`
+	Explanation *search.Explanation `json:"explanation,omitempty"`
+	Info        idx.FileInfo        `json:"info"`
+}
+
+type apiListing struct {
+	Path    string    `json:"path"`
+	Total   int       `json:"total"`
+	Page    int       `json:"page"`
+	PerPage int       `json:"per_page"`
+	Entries []apiFile `json:"entries"`
+}
+
+type apiSearchResults struct {
+	Query   string    `json:"query"`
+	Filters []string  `json:"filters,omitempty"`
+	Total   int       `json:"total"`
+	Page    int       `json:"page"`
+	PerPage int       `json:"per_page"`
+	Hits    []apiFile `json:"hits"`
+	Facets  []Facet   `json:"facets"`
+}
+
+func newAPIFile(virtualPath string, fi idx.FileInfo) apiFile {
+	f := apiFile{Path: virtualPath, Info: fi}
+	if fi.MimeType == "inode/directory" || idx.IsArchive(fi.MimeType) {
+		f.Browse = path.Join(apiPrefix, "browse", virtualPath)
+	}
+	if fi.MimeType != "inode/directory" {
+		f.Download = path.Join("/download", virtualPath)
+	}
+	return f
+}
+
+// rootRelative returns the slash-separated path of an indexed file below
+// the root.
+func rootRelative(fpath string) string {
+	return path.Join("/", filepath.ToSlash(strings.TrimPrefix(fpath, env.Env.Root)))
+}
+
+// acceptsJSON reports whether the Accept header of r allows a JSON response.
+func acceptsJSON(r *http.Request) bool {
+	accept := strings.Join(r.Header.Values("Accept"), ",")
+	if strings.TrimSpace(accept) == "" {
+		return true
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		if q, ok := params["q"]; ok {
+			if v, err := strconv.ParseFloat(q, 64); err != nil || v <= 0 {
+				continue
+			}
+		}
+		switch mediaType {
+		case "application/json", "application/*", "*/*":
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Logger.Error("error writing API response", zap.Error(err))
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// apiHandler serves the JSON API below /api/v1.
+func apiHandler(w http.ResponseWriter, r *http.Request) {
+	var res interface{}
+	var err error
+	switch {
+	case r.Method != http.MethodGet && r.Method != http.MethodHead:
+		w.Header().Set("Allow", "GET, HEAD")
+		err = newAPIError(http.StatusMethodNotAllowed, "expected GET")
+	case !acceptsJSON(r):
+		err = newAPIError(http.StatusNotAcceptable, "only application/json is available")
+	default:
+		res, err = apiRoute(r)
+	}
+	if err != nil {
+		var ae *apiError
+		if !errors.As(err, &ae) {
+			log.Logger.Error("API error",
+				zap.String("path", r.URL.Path), zap.Error(err))
+			ae = newAPIError(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		}
+		writeJSON(w, ae.Status, ae)
+		return
+	}
+	if doc, ok := res.([]byte); ok {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_, err = w.Write(doc)
+		if err != nil {
+			panic(http.ErrAbortHandler)
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func apiRoute(r *http.Request) (interface{}, error) {
+	err := r.ParseForm()
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, err.Error())
+	}
+	p := strings.TrimPrefix(r.URL.Path, apiPrefix)
+	switch {
+	case p == "/openapi.json":
+		return openAPIDocument, nil
+	case p == "/status":
+		return idx.GetStatus()
+	case p == "/search":
+		return apiSearch(r)
+	case p == "/browse" || strings.HasPrefix(p, "/browse/"):
+		return apiBrowse(r, path.Clean("/"+strings.TrimPrefix(p, "/browse")))
+	case strings.HasPrefix(p, "/files/"):
+		return apiFileInfo(r.Context(), path.Clean(strings.TrimPrefix(p, "/files")))
+	}
+	return nil, newAPIError(http.StatusNotFound, "no such endpoint")
+}
+
+func apiFileInfo(ctx context.Context, virtualPath string) (interface{}, error) {
+	fi, err := pathToFileInfo(ctx, filepath.Join(env.Env.Root, virtualPath))
+	if err == errNotFound {
+		return nil, newAPIError(http.StatusNotFound, "file not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newAPIFile(virtualPath, fi), nil
+}
+
+func apiBrowse(r *http.Request, virtualPath string) (interface{}, error) {
+	opts, err := parseListingOptions(r, false)
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, err.Error())
+	}
+	res := apiListing{
+		Path:    virtualPath,
+		Page:    opts.Page,
+		PerPage: opts.PerPage,
+		Entries: make([]apiFile, 0),
+	}
+	searchPath := filepath.Join(env.Env.Root, virtualPath)
+
+	fi, inner, err := findArchive(r.Context(), searchPath)
+	if err == nil {
+		children, err := archiveDirectory(fi, inner, opts)
+		if err == errNotFound {
+			return nil, newAPIError(http.StatusNotFound, "directory not found")
+		}
+		if err != nil {
+			return nil, err
+		}
+		res.Total = len(children)
+		start, end := opts.bounds(len(children))
+		for _, c := range children[start:end] {
+			res.Entries = append(res.Entries, archiveAPIFile(virtualPath, c))
+		}
+		return res, nil
+	} else if err != errNotFound {
+		return nil, err
+	}
+
+	if searchPath != env.Env.Root {
+		fi, err = pathToFileInfo(r.Context(), searchPath)
+		if err == errNotFound || (err == nil && fi.MimeType != "inode/directory") {
+			return nil, newAPIError(http.StatusNotFound, "directory not found")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	reader, err := bluge.OpenReader(idx.BlugeConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	query := bluge.NewTermQuery(searchPath).SetField(properties.Dirname)
+	searchResults, err := reader.Search(r.Context(), opts.search(query))
+	if err != nil {
+		return nil, err
+	}
+	next, err := searchResults.Next()
+	for err == nil && next != nil {
+		fi, err = idx.DocumentMatchToFileInfo(reader, next)
+		if err != nil {
+			return nil, err
+		}
+		res.Entries = append(res.Entries, newAPIFile(rootRelative(fi.Filename), fi))
+		next, err = searchResults.Next()
+	}
+	if err != nil {
+		return nil, err
+	}
+	res.Total = int(searchResults.Aggregations().Count())
+	return res, nil
+}
+
+// archiveAPIFile describes an entry of a directory inside an archive. Only
+// its name, type, size and modification time are known, and directories
+// have no size.
+func archiveAPIFile(virtualPath string, c archiveChild) apiFile {
+	fi := idx.FileInfo{
+		BareBasename: c.Name,
+		MimeType:     "inode/directory",
+		Size:         -1,
+	}
+	if !c.Nested {
+		fi.ModTime = c.Member.ModTime
+	}
+	if !c.Dir {
+		fi.Extname = path.Ext(c.Name)
+		fi.BareBasename = strings.TrimSuffix(c.Name, fi.Extname)
+		fi.MimeType = memberMimeType(c.Name)
+		fi.Size = c.Member.Size
+	}
+	return newAPIFile(path.Join(virtualPath, c.Name), fi)
+}
+
+func apiSearch(r *http.Request) (interface{}, error) {
+	opts, err := parseListingOptions(r, true)
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, err.Error())
+	}
+	searchQuery, err := parseSearch(opts)
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, err.Error())
+	}
+
+	reader, err := bluge.OpenReader(idx.BlugeConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	searchReq := opts.search(searchQuery)
+	if opts.Explain {
+		searchReq.ExplainScores()
+	}
+	addFacetAggregations(searchReq)
+	searchResults, err := reader.Search(r.Context(), searchReq)
+	if err != nil {
+		return nil, err
+	}
+
+	res := apiSearchResults{
+		Query:   opts.Query,
+		Filters: opts.Filters,
+		Page:    opts.Page,
+		PerPage: opts.PerPage,
+		Hits:    make([]apiFile, 0),
+	}
+	next, err := searchResults.Next()
+	for err == nil && next != nil {
+		var fi idx.FileInfo
+		fi, err = idx.DocumentMatchToFileInfo(reader, next)
+		if err != nil {
+			return nil, err
+		}
+		hit := newAPIFile(rootRelative(fi.Filename), fi)
+		hit.Score = next.Score
+		hit.Explanation = next.Explanation
+		res.Hits = append(res.Hits, hit)
+		next, err = searchResults.Next()
+	}
+	if err != nil {
+		return nil, err
+	}
+	res.Total = int(searchResults.Aggregations().Count())
+	res.Facets = facets(searchResults.Aggregations(), opts, "/search")
+	if res.Facets == nil {
+		res.Facets = make([]Facet, 0)
+	}
+	return res, nil
+}
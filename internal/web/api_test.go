@@ -0,0 +1,121 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAPI(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(apiHandler))
+	defer ts.Close()
+
+	client := ts.Client()
+	tests := []struct {
+		method string
+		path   string
+		accept string
+		status int
+		// paths of the entries or hits, if listed
+		paths    []string
+		expected []string
+	}{
+		{http.MethodGet, "/api/v1/browse", "", http.StatusOK,
+			[]string{"/aaa", "/album", "/archives", "/books", "/tone.mp3"},
+			[]string{`"browse":"/api/v1/browse/aaa"`, `"download":"/download/tone.mp3"`}},
+		{http.MethodGet, "/api/v1/browse/books?sort=size&order=desc&per_page=2", "application/json", http.StatusOK,
+			[]string{"/books/colour.epub", "/books/light.epub"},
+			[]string{`"total":3`, `"page":1`, `"per_page":2`, `"book_title":"The Colour of Magic"`}},
+		{http.MethodGet, "/api/v1/browse/archives/test.zip", "application/*", http.StatusOK,
+			[]string{"/archives/test.zip/dir", "/archives/test.zip/hello.txt"},
+			[]string{`"browse":"/api/v1/browse/archives/test.zip/dir"`, `"size":11`,
+				// directories inside archives have no size
+				`"mime_type":"inode/directory","mod_time":"2020-09-13T12:26:40Z"}`}},
+		{http.MethodGet, "/api/v1/browse/archives/test.zip/missing", "", http.StatusNotFound, nil,
+			[]string{`{"status":404,"error":"directory not found"}`}},
+		{http.MethodGet, "/api/v1/browse/archives/test.zip/hello.txt", "", http.StatusNotFound, nil, nil},
+		{http.MethodGet, "/api/v1/browse/tone.mp3", "", http.StatusNotFound, nil,
+			[]string{`{"status":404,"error":"directory not found"}`}},
+		{http.MethodGet, "/api/v1/browse/missing", "", http.StatusNotFound, nil, nil},
+		{http.MethodGet, "/api/v1/browse?sort=relevance", "", http.StatusBadRequest, nil, []string{`"status":400`}},
+		{http.MethodGet, "/api/v1/search?q=dir:/books&filter=ext:%22.epub%22&sort=name", "", http.StatusOK,
+			[]string{"/books/colour.epub", "/books/light.epub"},
+			[]string{`"query":"dir:/books"`, `"filters":["ext:\".epub\""]`, `"score":`,
+				`{"value":".epub","count":2,"filter":"ext:\".epub\"","selected":true}`}},
+		{http.MethodGet, "/api/v1/search?q=tones&explain=1", "", http.StatusOK,
+			[]string{"/tone.mp3"},
+			[]string{`"explanation":{"value":`, `"audio_duration":0.432`}},
+		{http.MethodGet, "/api/v1/search?q=mime:audio/*&in=/album&sort=name", "", http.StatusOK,
+			[]string{"/album/embedded.mp3", "/album/plain.mp3"}, nil},
+		{http.MethodGet, "/api/v1/search?q=size:>lots", "", http.StatusBadRequest, nil, nil},
+		{http.MethodGet, "/api/v1/search?q=tones&page=4611686018427387904&per_page=1000", "", http.StatusBadRequest, nil, nil},
+		{http.MethodGet, "/api/v1/browse/archives/test.zip?sort=name&order=desc", "", http.StatusOK,
+			[]string{"/archives/test.zip/hello.txt", "/archives/test.zip/dir"}, nil},
+		{http.MethodGet, "/api/v1/files/books/colour.epub", "", http.StatusOK, nil,
+			[]string{`"path":"/books/colour.epub"`, `"book_isbn":"0552124753"`}},
+		{http.MethodGet, "/api/v1/files/books/missing.epub", "", http.StatusNotFound, nil, nil},
+		{http.MethodGet, "/api/v1/status", "", http.StatusOK, nil,
+			[]string{`"schema_version":`, `"indexing":false`}},
+		{http.MethodGet, "/api/v1/openapi.json", "", http.StatusOK, nil, []string{`"openapi": "3.0.3"`}},
+		{http.MethodGet, "/api/v1/missing", "", http.StatusNotFound, nil, nil},
+		{http.MethodGet, "/api/v1/status", "text/html", http.StatusNotAcceptable, nil,
+			[]string{`"status":406`}},
+		{http.MethodGet, "/api/v1/status", "text/html, application/json;q=0", http.StatusNotAcceptable, nil, nil},
+		{http.MethodGet, "/api/v1/status", "text/html, */*;q=0.1", http.StatusOK, nil, nil},
+		{http.MethodPost, "/api/v1/status", "", http.StatusMethodNotAllowed, nil, nil},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, ts.URL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body json.RawMessage
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("invalid JSON response for %s: %v", tt.path, err)
+		}
+		if resp.StatusCode != tt.status {
+			t.Fatalf("unexpected HTTP status for %s: got %d expected %d", tt.path, resp.StatusCode, tt.status)
+		}
+		if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "application/json") {
+			t.Fatalf("unexpected content type for %s: %s", tt.path, contentType)
+		}
+		if tt.paths != nil {
+			type entry struct {
+				Path string
+			}
+			var listing struct {
+				Entries []entry
+				Hits    []entry
+			}
+			err = json.Unmarshal(body, &listing)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var paths []string
+			for _, f := range append(listing.Entries, listing.Hits...) {
+				paths = append(paths, f.Path)
+			}
+			if !reflect.DeepEqual(paths, tt.paths) {
+				t.Fatalf("unexpected paths for %s: got %v expected %v", tt.path, paths, tt.paths)
+			}
+		}
+		for _, expected := range tt.expected {
+			if !strings.Contains(string(body), expected) {
+				t.Fatalf("response for %s didn't contain %s:\n%s", tt.path, expected, body)
+			}
+		}
+	}
+}
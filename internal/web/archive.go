@@ -0,0 +1,267 @@
+package web
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatalbanana/filetundra/internal/env"
+	"github.com/fatalbanana/filetundra/internal/idx"
+
+	"github.com/h2non/filetype"
+)
+
+// findArchive looks for an indexed archive at or above searchPath, returning
+// its file info and the slash-separated path of searchPath inside it.
+func findArchive(ctx context.Context, searchPath string) (fi idx.FileInfo, inner string, err error) {
+	candidate := searchPath
+	for candidate != env.Env.Root && strings.HasPrefix(candidate, env.Env.Root) {
+		fi, err = pathToFileInfo(ctx, candidate)
+		if err == nil {
+			if !idx.IsArchive(fi.MimeType) {
+				return fi, inner, errNotFound
+			}
+			rel, err := filepath.Rel(candidate, searchPath)
+			if err != nil {
+				return fi, inner, err
+			}
+			inner = idx.CleanMemberName(filepath.ToSlash(rel))
+			return fi, inner, nil
+		}
+		if err != errNotFound {
+			return fi, inner, err
+		}
+		candidate = filepath.Dir(candidate)
+	}
+	return fi, inner, errNotFound
+}
+
+// archiveCacheSize is the number of archives whose members are kept in
+// memory between listings.
+const archiveCacheSize = 32
+
+// cachedArchive holds the members of an archive as long as the archive keeps
+// its modification time and size.
+type cachedArchive struct {
+	modTime time.Time
+	size    int64
+	members []idx.ArchiveMember
+}
+
+var (
+	archiveCacheMu sync.Mutex
+	archiveCache   = make(map[string]cachedArchive)
+	// paths in archiveCache, oldest first
+	archiveCacheOrder []string
+)
+
+// listArchive returns the members of the archive at fpath, reading them
+// again only if the archive changed since it was last listed.
+func listArchive(fpath string) ([]idx.ArchiveMember, error) {
+	st, err := os.Stat(fpath)
+	if os.IsNotExist(err) {
+		// removed since last indexed
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	archiveCacheMu.Lock()
+	cached, ok := archiveCache[fpath]
+	archiveCacheMu.Unlock()
+	if ok && cached.modTime.Equal(st.ModTime()) && cached.size == st.Size() {
+		return cached.members, nil
+	}
+
+	members, err := idx.ListArchive(fpath)
+	if err != nil {
+		return nil, err
+	}
+	archiveCacheMu.Lock()
+	defer archiveCacheMu.Unlock()
+	if _, ok := archiveCache[fpath]; !ok {
+		if len(archiveCacheOrder) >= archiveCacheSize {
+			delete(archiveCache, archiveCacheOrder[0])
+			archiveCacheOrder = archiveCacheOrder[1:]
+		}
+		archiveCacheOrder = append(archiveCacheOrder, fpath)
+	}
+	archiveCache[fpath] = cachedArchive{modTime: st.ModTime(), size: st.Size(), members: members}
+	return members, nil
+}
+
+func memberMimeType(name string) string {
+	return filetype.GetType(strings.TrimPrefix(path.Ext(name), ".")).MIME.Value
+}
+
+// archiveChild is an entry of a directory inside an archive.
+type archiveChild struct {
+	Name   string
+	Member idx.ArchiveMember
+	// whether the child is a directory, which may only be implied by the
+	// members inside it
+	Dir    bool
+	Nested bool
+}
+
+// mimeType returns the type of c the way it is indexed for files.
+func (c archiveChild) mimeType() string {
+	if c.Dir {
+		return "inode/directory"
+	}
+	if t := memberMimeType(c.Name); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// archiveSortValue is the value of an archive entry a listing is sorted by.
+type archiveSortValue struct {
+	known bool
+	num   int64
+	str   string
+}
+
+func (c archiveChild) sortValue(sortName string) archiveSortValue {
+	switch sortName {
+	case "size":
+		if !c.Dir && c.Member.Size >= 0 {
+			return archiveSortValue{known: true, num: c.Member.Size}
+		}
+	case "modified":
+		if !c.Nested && !c.Member.ModTime.IsZero() {
+			return archiveSortValue{known: true, num: c.Member.ModTime.UnixNano()}
+		}
+	case "type":
+		return archiveSortValue{known: true, str: c.mimeType()}
+	}
+	return archiveSortValue{}
+}
+
+// sortArchiveChildren orders the entries of a directory inside an archive
+// like listings of indexed files: unknown values, such as the size of a
+// directory, come last and equal values are ordered by name.
+func sortArchiveChildren(children []archiveChild, opts listingOptions) {
+	sort.SliceStable(children, func(i, j int) bool {
+		a, b := children[i], children[j]
+		if opts.Sort == "name" {
+			return (a.Name < b.Name) != opts.Desc && a.Name != b.Name
+		}
+		va, vb := a.sortValue(opts.Sort), b.sortValue(opts.Sort)
+		if va.known != vb.known {
+			return va.known
+		}
+		if va != vb {
+			return (va.num < vb.num || va.num == vb.num && va.str < vb.str) != opts.Desc
+		}
+		return a.Name < b.Name
+	})
+}
+
+// archiveChildren returns the entries of the directory inner of an archive
+// with the given members, sorted by name.
+func archiveChildren(members []idx.ArchiveMember, inner string) []archiveChild {
+	var prefix string
+	if inner != "" {
+		prefix = inner + "/"
+	}
+	var res []archiveChild
+	children := make(map[string]int)
+	for _, m := range members {
+		name := idx.CleanMemberName(m.Name)
+		if name == inner || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		child, _, nested := strings.Cut(strings.TrimPrefix(name, prefix), "/")
+		c := archiveChild{
+			Name:   child,
+			Member: m,
+			Dir:    nested || m.IsDir,
+			Nested: nested,
+		}
+		i, ok := children[child]
+		if !ok {
+			children[child] = len(res)
+			res = append(res, c)
+		} else if !nested {
+			// directories need not have their own entry
+			res[i] = c
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+// archiveDirectory returns the sorted entries of the directory inner of the
+// archive fi, or errNotFound if the archive has no such directory.
+func archiveDirectory(fi idx.FileInfo, inner string, opts listingOptions) ([]archiveChild, error) {
+	members, err := listArchive(fi.Filename)
+	if err != nil {
+		return nil, err
+	}
+	children := archiveChildren(members, inner)
+	if len(children) == 0 && !archiveHasDir(members, inner) {
+		return nil, errNotFound
+	}
+	sortArchiveChildren(children, opts)
+	return children, nil
+}
+
+// archiveHasDir reports whether one of members is the directory inner, which
+// is the root of the archive if empty.
+func archiveHasDir(members []idx.ArchiveMember, inner string) bool {
+	if inner == "" {
+		return true
+	}
+	for _, m := range members {
+		if m.IsDir && idx.CleanMemberName(m.Name) == inner {
+			return true
+		}
+	}
+	return false
+}
+
+func archiveToDirectoryListing(fi idx.FileInfo, inner string, virtualPath string, opts listingOptions) (res DirectoryListing, err error) {
+	children, err := archiveDirectory(fi, inner, opts)
+	if err != nil {
+		return res, err
+	}
+
+	res.Name = virtualPath
+	res.Attributes = true
+	res.Files = make([]DirectoryListingFile, 0)
+	virtualParentDir, _ := path.Split(virtualPath)
+	res.Back = path.Join("/browse", virtualParentDir)
+
+	res.Total = len(children)
+	base := path.Join("/browse", virtualPath)
+	res.Sorts = opts.sortLinks(base)
+	res.Pages = opts.pageLinks(base, res.Total)
+	start, end := opts.bounds(len(children))
+	for _, c := range children[start:end] {
+		fileRes := DirectoryListingFile{
+			Name: c.Name,
+		}
+		if c.Dir {
+			fileRes.Image = getImage("inode/directory")
+			fileRes.Path = path.Join("/browse", virtualPath, c.Name)
+			if !c.Nested {
+				fileRes.Modified = formatModTime(c.Member.ModTime)
+			}
+		} else {
+			fileRes.Image = getImage(memberMimeType(c.Name))
+			fileRes.Path = path.Join("/download", virtualPath, c.Name)
+			fileRes.Size = formatSize(c.Member.Size)
+			fileRes.Modified = formatModTime(c.Member.ModTime)
+		}
+		res.Files = append(res.Files, fileRes)
+	}
+	return res, nil
+}
@@ -0,0 +1,62 @@
+package web
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fatalbanana/filetundra/internal/env"
+)
+
+func TestListArchiveCache(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join(env.Env.Root, "archives", "test.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempDir, err := ioutil.TempDir("", "filetundra_archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fpath := filepath.Join(tempDir, "test.zip")
+	err = ioutil.WriteFile(fpath, data, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := listArchive(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached, err := listArchive(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 3 || &cached[0] != &first[0] {
+		t.Fatal("members weren't cached")
+	}
+
+	modTime := time.Now().Add(time.Hour)
+	err = os.Chtimes(fpath, modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed, err := listArchive(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 3 || &changed[0] == &first[0] {
+		t.Fatal("members of the changed archive were cached")
+	}
+
+	err = os.Remove(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = listArchive(fpath)
+	if err != errNotFound {
+		t.Fatalf("unexpected error for removed archive: %v", err)
+	}
+}
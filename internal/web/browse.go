@@ -3,11 +3,14 @@ package web
 import (
 	"context"
 	_ "embed"
+	"fmt"
 	"html/template"
 	"net/http"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/fatalbanana/filetundra/internal/env"
 	"github.com/fatalbanana/filetundra/internal/idx"
@@ -23,20 +26,173 @@ import (
 var browseTemplate string
 
 type DirectoryListing struct {
-	Autoback    bool
-	Back        string
-	Name        string
-	Files       []DirectoryListingFile
+	// entries have size and modification time columns
+	Attributes bool
+	Back       string
+	Facets     []Facet
+	Name       string
+	Files      []DirectoryListingFile
+	Pages      []ListingLink
+	// directory searches from the listing are limited to
+	Scope       string
 	SearchValue string
+	Sorts       []ListingLink
+	// number of entries on all pages, zero if not paged
+	Total int
 }
 
 type DirectoryListingFile struct {
-	Name  string
-	Image string
-	Path  string
+	Browse  string
+	Cover   bool
+	Details string
+	// score breakdown of a search hit, if requested
+	Explanation string
+	// fragments of the fields a search hit matched
+	Highlights []Highlight
+	Name       string
+	Image      string
+	Modified   string
+	Path       string
+	Size       string
 }
 
-func pathToDirectoryListing(ctx context.Context, searchPath string, virtualPath string) (res DirectoryListing, err error) {
+func formatSize(size int64) string {
+	if size < 0 {
+		return ""
+	}
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// formatDuration formats d as minutes and seconds, or hours if needed.
+func formatDuration(d time.Duration) string {
+	seconds := int64(d.Round(time.Second) / time.Second)
+	if seconds >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+	}
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
+// fileDetails summarises the metadata of a file for display.
+func fileDetails(fi idx.FileInfo) string {
+	var details []string
+	if fi.AudioArtist != "" {
+		details = append(details, fi.AudioArtist)
+	}
+	if fi.AudioAlbum != "" {
+		album := fi.AudioAlbum
+		if fi.AudioYear > 0 {
+			album = fmt.Sprintf("%s (%d)", album, fi.AudioYear)
+		}
+		details = append(details, album)
+	}
+	if fi.AudioTrack > 0 {
+		details = append(details, fmt.Sprintf("track %d", fi.AudioTrack))
+	}
+	if fi.AudioGenre != "" {
+		details = append(details, fi.AudioGenre)
+	}
+	if fi.AudioDuration > 0 {
+		details = append(details, formatDuration(fi.AudioDuration))
+	}
+	if fi.AudioBitrate > 0 {
+		details = append(details, fmt.Sprintf("%d kbit/s", fi.AudioBitrate/1000))
+	}
+	if fi.PDFTitle != "" {
+		details = append(details, fi.PDFTitle)
+	}
+	if fi.PDFAuthor != "" {
+		details = append(details, fi.PDFAuthor)
+	}
+	if fi.PDFSubject != "" {
+		details = append(details, fi.PDFSubject)
+	}
+	if fi.PDFPages == 1 {
+		details = append(details, "1 page")
+	} else if fi.PDFPages > 1 {
+		details = append(details, fmt.Sprintf("%d pages", fi.PDFPages))
+	}
+	if fi.OfficeTitle != "" {
+		details = append(details, fi.OfficeTitle)
+	}
+	if fi.OfficeCreator != "" {
+		details = append(details, fi.OfficeCreator)
+	}
+	if fi.OfficeLastModifiedBy != "" && fi.OfficeLastModifiedBy != fi.OfficeCreator {
+		details = append(details, "edited by "+fi.OfficeLastModifiedBy)
+	}
+	if !fi.OfficeCreated.IsZero() {
+		details = append(details, "created "+formatModTime(fi.OfficeCreated))
+	}
+	if fi.BookTitle != "" {
+		details = append(details, fi.BookTitle)
+	}
+	if len(fi.BookAuthors) > 0 {
+		details = append(details, strings.Join(fi.BookAuthors, ", "))
+	}
+	if fi.BookSeries != "" {
+		details = append(details, bookSeries(fi))
+	}
+	if camera := strings.TrimSpace(fi.ImageMake + " " + fi.ImageModel); camera != "" {
+		details = append(details, camera)
+	}
+	if fi.ImageLens != "" {
+		details = append(details, fi.ImageLens)
+	}
+	if fi.ImageWidth > 0 && fi.ImageHeight > 0 {
+		details = append(details, fmt.Sprintf("%d×%d", fi.ImageWidth, fi.ImageHeight))
+	}
+	if !fi.ImageDateTaken.IsZero() {
+		details = append(details, "taken "+formatModTime(fi.ImageDateTaken))
+	}
+	if fi.VideoTitle != "" {
+		details = append(details, fi.VideoTitle)
+	}
+	if fi.VideoResolution != "" {
+		details = append(details, fi.VideoResolution)
+	} else if fi.VideoWidth > 0 && fi.VideoHeight > 0 {
+		details = append(details, fmt.Sprintf("%d×%d", fi.VideoWidth, fi.VideoHeight))
+	}
+	if fi.VideoCodec != "" {
+		details = append(details, fi.VideoCodec)
+	}
+	if fi.VideoDuration > 0 {
+		details = append(details, formatDuration(fi.VideoDuration))
+	}
+	if len(fi.VideoAudioLanguages) > 0 {
+		details = append(details, "audio "+strings.Join(fi.VideoAudioLanguages, ", "))
+	}
+	if len(fi.VideoSubtitleLanguages) > 0 {
+		details = append(details, "subtitles "+strings.Join(fi.VideoSubtitleLanguages, ", "))
+	}
+	return strings.Join(details, " · ")
+}
+
+// bookSeries formats the series of a book with its position, as in
+// "Discworld #1".
+func bookSeries(fi idx.FileInfo) string {
+	if fi.BookSeriesIndex > 0 {
+		return fmt.Sprintf("%s #%s", fi.BookSeries, strconv.FormatFloat(fi.BookSeriesIndex, 'f', -1, 64))
+	}
+	return fi.BookSeries
+}
+
+func formatModTime(modTime time.Time) string {
+	if modTime.IsZero() {
+		return ""
+	}
+	return modTime.Format("2006-01-02 15:04")
+}
+
+func pathToDirectoryListing(ctx context.Context, searchPath string, virtualPath string, opts listingOptions) (res DirectoryListing, err error) {
 	reader, err := bluge.OpenReader(idx.BlugeConfig)
 	if err != nil {
 		return res, err
@@ -44,8 +200,7 @@ func pathToDirectoryListing(ctx context.Context, searchPath string, virtualPath
 	defer reader.Close()
 
 	query := bluge.NewTermQuery(searchPath).SetField(properties.Dirname)
-	searchReq := bluge.NewAllMatches(query)
-	searchResults, err := reader.Search(ctx, searchReq)
+	searchResults, err := reader.Search(ctx, opts.search(query))
 	if err != nil {
 		return res, err
 	}
@@ -56,8 +211,11 @@ func pathToDirectoryListing(ctx context.Context, searchPath string, virtualPath
 	if virtualPath != "/" && virtualPath != "" {
 		virtualParentDir, _ := path.Split(virtualPath)
 		res.Back = path.Join("/browse", virtualParentDir)
+		res.Scope = virtualPath
 	}
 
+	subdirs := make(map[string]int)
+	var audioFiles []int
 	var next *search.DocumentMatch
 	var fi idx.FileInfo
 	next, err = searchResults.Next()
@@ -72,14 +230,56 @@ func pathToDirectoryListing(ctx context.Context, searchPath string, virtualPath
 		}
 		properBasename := fi.BareBasename + fi.Extname
 		fileRes := DirectoryListingFile{
-			Name:  properBasename,
-			Image: getImage(fi.MimeType),
-			Path:  path.Join(basePath, virtualPath, properBasename),
+			Details: fileDetails(fi),
+			Name:    properBasename,
+			Image:   getImage(fi.MimeType),
+			Path:    path.Join(basePath, virtualPath, properBasename),
+		}
+		if idx.IsArchive(fi.MimeType) {
+			fileRes.Browse = path.Join("/browse", virtualPath, properBasename)
+		}
+		switch {
+		case fi.MimeType == "inode/directory":
+			subdirs[fi.Filename] = len(res.Files)
+		case fi.AudioArtwork, fi.BookCover:
+			fileRes.Image = coverPath(path.Join(virtualPath, properBasename))
+			fileRes.Cover = true
+		case isAudio(fi.MimeType):
+			audioFiles = append(audioFiles, len(res.Files))
 		}
 		res.Files = append(res.Files, fileRes)
 		next, err = searchResults.Next()
 	}
-	return res, err
+	if err != nil {
+		return res, err
+	}
+	res.Total = int(searchResults.Aggregations().Count())
+	base := path.Join("/browse", virtualPath)
+	res.Sorts = opts.sortLinks(base)
+	res.Pages = opts.pageLinks(base, res.Total)
+
+	// directories and audio files without artwork show cover images
+	dirs := []string{searchPath}
+	for dir := range subdirs {
+		dirs = append(dirs, dir)
+	}
+	covers, err := idx.FindCovers(ctx, reader, dirs...)
+	if err != nil {
+		return res, err
+	}
+	for dir, i := range subdirs {
+		if _, ok := covers[dir]; ok {
+			res.Files[i].Image = coverPath(path.Join(virtualPath, res.Files[i].Name))
+			res.Files[i].Cover = true
+		}
+	}
+	if _, ok := covers[searchPath]; ok {
+		for _, i := range audioFiles {
+			res.Files[i].Image = coverPath(path.Join(virtualPath, res.Files[i].Name))
+			res.Files[i].Cover = true
+		}
+	}
+	return res, nil
 }
 
 func browseHandler(w http.ResponseWriter, r *http.Request) {
@@ -95,8 +295,28 @@ func browseHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts, err := parseListingOptions(r, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	var res DirectoryListing
-	res, err = pathToDirectoryListing(r.Context(), searchPath, virtualPath)
+	fi, inner, err := findArchive(r.Context(), searchPath)
+	if err == nil {
+		res, err = archiveToDirectoryListing(fi, inner, virtualPath, opts)
+	} else if err == errNotFound {
+		res, err = pathToDirectoryListing(r.Context(), searchPath, virtualPath, opts)
+	}
+	if err == errNotFound {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		log.Logger.Error("error fetching directory listing",
 			zap.String("directory", searchPath),
@@ -114,39 +334,43 @@ func browseHandler(w http.ResponseWriter, r *http.Request) {
 
 func getImage(mType string) string {
 	switch mType {
-	case "application/gzip":
-	case "application/vnd.debian.binary-package":
-	case "application/vnd.rar":
-	case "application/x-7z-compressed":
-	case "application/x-rpm":
-	case "application/x-tar":
-	case "application/x-unix-archive":
-	case "application/x-xz":
-	case "application/zip":
-	case "application/zstd":
-		return "/static/icons/archive-unindexed.svg"
+	case "application/gzip",
+		"application/vnd.debian.binary-package",
+		"application/vnd.rar",
+		"application/x-7z-compressed",
+		"application/x-bzip2",
+		"application/x-rpm",
+		"application/x-tar",
+		"application/x-unix-archive",
+		"application/x-xz",
+		"application/zip",
+		"application/zstd":
+		return "/static/icons/archive.svg"
 
 	case "inode/directory":
 		return "/static/icons/directory.svg"
 
-	case "application/msword":
-	case "application/vnd.openxmlformats-officedocument.wordprocessingml.document":
+	case "application/msword",
+		"application/vnd.oasis.opendocument.text",
+		"application/vnd.openxmlformats-officedocument.wordprocessingml.document":
 		return "/static/icons/document.svg"
 
-	case "application/x-executable":
-	case "application/x-mach-binary":
-	case "application/vnd.microsoft.portable-executable":
+	case "application/x-executable",
+		"application/x-mach-binary",
+		"application/vnd.microsoft.portable-executable":
 		return "/static/icons/executable.svg"
 
 	case "application/pdf":
 		return "/static/icons/pdf.svg"
 
-	case "application/vnd.ms-powerpoint":
-	case "application/vnd.openxmlformats-officedocument.presentationml.presentation":
+	case "application/vnd.ms-powerpoint",
+		"application/vnd.oasis.opendocument.presentation",
+		"application/vnd.openxmlformats-officedocument.presentationml.presentation":
 		return "/static/icons/presentation.svg"
 
-	case "application/vnd.ms-excel":
-	case "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":
+	case "application/vnd.ms-excel",
+		"application/vnd.oasis.opendocument.spreadsheet",
+		"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":
 		return "/static/icons/spreadsheet.svg"
 	}
 
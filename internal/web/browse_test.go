@@ -7,8 +7,12 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/fatalbanana/filetundra/internal/env"
 	"github.com/fatalbanana/filetundra/internal/idx"
@@ -17,6 +21,7 @@ import (
 
 func TestMain(m *testing.M) {
 	log.SetupLogger()
+	time.Local = time.UTC
 
 	tempDir, err := ioutil.TempDir("", "filetundra_test")
 	if err != nil {
@@ -31,9 +36,10 @@ func TestMain(m *testing.M) {
 	dataRoot := filepath.Join(filepath.Dir(ourFile),
 		"..", "..", "testdata", "fileroot")
 	env.Env.Root = dataRoot
+	env.Env.ContentMaxSize = 1 << 20
 
 	idx.Init(tempDir)
-	err = idx.Initial()
+	_, err = idx.Initial()
 	if err != nil {
 		panic(err)
 	}
@@ -79,3 +85,157 @@ func TestBrowse(t *testing.T) {
 		t.Fatal("response didn't match expected render")
 	}
 }
+
+func TestBrowseArchive(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(browseHandler))
+	defer ts.Close()
+
+	client := ts.Client()
+	tests := []struct {
+		path     string
+		expected []string
+	}{
+		{
+			path: "/browse/archives/test.zip/",
+			expected: []string{
+				`<a href="/browse/archives/test.zip/dir">dir</a>`,
+				`<a href="/download/archives/test.zip/hello.txt">hello.txt</a></td><td>11 B</td><td>2020-09-13 12:26</td>`,
+				`<a href="/browse/archives">`,
+			},
+		},
+		{
+			// the directory is only implied by the path of its member
+			path: "/browse/archives/test.tar.gz",
+			expected: []string{
+				`<a href="/browse/archives/test.tar.gz/dir">dir</a></td><td></td><td></td></tr>`,
+			},
+		},
+		{
+			path: "/browse/archives/test.tar.gz/dir",
+			expected: []string{
+				`<a href="/download/archives/test.tar.gz/dir/inner.txt">inner.txt</a></td><td>14 B</td><td>2020-09-13 12:26</td>`,
+				`<a href="/browse/archives/test.tar.gz">`,
+			},
+		},
+		{
+			path: "/browse/archives",
+			expected: []string{
+				`<a href="/browse/archives/test.zip"><img src="/static/icons/archive.svg"></a>`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		responseBytes, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected HTTP status for %s: got %d expected %d",
+				tt.path, resp.StatusCode, http.StatusOK)
+		}
+		for _, expected := range tt.expected {
+			if !strings.Contains(string(responseBytes), expected) {
+				t.Fatalf("response for %s didn't contain %s", tt.path, expected)
+			}
+		}
+	}
+}
+
+var listingNameRe = regexp.MustCompile(`<td><a href="/(?:download|browse)/[^"]*">([^<]+)</a>`)
+
+func listingNames(body []byte) []string {
+	var names []string
+	for _, m := range listingNameRe.FindAllSubmatch(body, -1) {
+		names = append(names, string(m[1]))
+	}
+	return names
+}
+
+func TestBrowseSortAndPages(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(browseHandler))
+	defer ts.Close()
+
+	client := ts.Client()
+	tests := []struct {
+		path     string
+		status   int
+		names    []string
+		expected []string
+	}{
+		{"/browse/books", http.StatusOK, []string{"astro.cbz", "colour.epub", "light.epub"},
+			[]string{
+				`3 entries · sort by <a href="/browse/books?order=desc">name ▲</a>`,
+				`<input type="hidden" name="in" value="/books">`,
+			}},
+		{"/browse/books?order=desc", http.StatusOK, []string{"light.epub", "colour.epub", "astro.cbz"},
+			[]string{`<a href="/browse/books">name ▼</a>`}},
+		{"/browse/books?sort=size", http.StatusOK, []string{"astro.cbz", "light.epub", "colour.epub"},
+			[]string{`<a href="/browse/books?order=desc&amp;sort=size">size ▲</a>`}},
+		{"/browse/books?sort=size&order=desc", http.StatusOK, []string{"colour.epub", "light.epub", "astro.cbz"}, nil},
+		{"/browse/books?sort=type&per_page=2", http.StatusOK, []string{"colour.epub", "light.epub"},
+			[]string{`<span>page 1 of 2</span> · <a href="/browse/books?page=2&amp;per_page=2&amp;sort=type">next »</a>`}},
+		{"/browse/books?per_page=2&page=2", http.StatusOK, []string{"light.epub"},
+			[]string{`<a href="/browse/books?per_page=2">« previous</a> · <span>page 2 of 2</span>`}},
+		// nothing here has a track, so the names decide
+		{"/browse/album?sort=track&order=desc", http.StatusOK, []string{"cover.png", "embedded.mp3", "plain.mp3"},
+			[]string{`<a href="/browse/album?sort=track">track ▼</a>`}},
+		{"/browse/books?sort=relevance", http.StatusBadRequest, nil, nil},
+		{"/browse/books?page=0", http.StatusBadRequest, nil, nil},
+		{"/browse/books?per_page=100000", http.StatusBadRequest, nil, nil},
+		{"/browse/books?page=101", http.StatusOK, nil, nil},
+		{"/browse/books?page=102", http.StatusBadRequest, nil, nil},
+		{"/browse/?page=9223372036854775807", http.StatusBadRequest, nil, nil},
+		{"/browse/archives/test.zip?order=desc", http.StatusOK, []string{"hello.txt", "dir"},
+			[]string{`2 entries · sort by <a href="/browse/archives/test.zip">name ▼</a>`}},
+		// directories have no size and come last in either order
+		{"/browse/archives/test.zip?sort=size", http.StatusOK, []string{"hello.txt", "dir"}, nil},
+		{"/browse/archives/test.zip?sort=size&order=desc", http.StatusOK, []string{"hello.txt", "dir"}, nil},
+		{"/browse/archives/test.zip?sort=type&order=desc", http.StatusOK, []string{"dir", "hello.txt"}, nil},
+		{"/browse/archives/test.zip/missing", http.StatusNotFound, nil, nil},
+		{"/browse/archives/test.zip/hello.txt", http.StatusNotFound, nil, nil},
+		{"/browse/archives/test.tar.gz/dir/missing", http.StatusNotFound, nil, nil},
+		{"/browse/archives/test.zip?per_page=1&page=2", http.StatusOK, []string{"hello.txt"},
+			[]string{`<a href="/browse/archives/test.zip?per_page=1">« previous</a> · <span>page 2 of 2</span>`}},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		responseBytes, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.status {
+			t.Fatalf("unexpected HTTP status for %s: got %d expected %d",
+				tt.path, resp.StatusCode, tt.status)
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		if names := listingNames(responseBytes); !reflect.DeepEqual(names, tt.names) {
+			t.Fatalf("unexpected entries for %s: got %v expected %v", tt.path, names, tt.names)
+		}
+		for _, expected := range tt.expected {
+			if !strings.Contains(string(responseBytes), expected) {
+				t.Fatalf("response for %s didn't contain %s:\n%s", tt.path, expected, responseBytes)
+			}
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fatalbanana/filetundra/internal/idx"
+)
+
+// validators identify the version of downloaded content, so that clients
+// can revalidate cached copies and resume downloads safely.
+type validators struct {
+	// strong entity tag, including its quotes
+	etag         string
+	lastModified time.Time
+}
+
+// newValidators derives validators from the modification time and size of
+// a file. They are taken from the file on disk rather than the index, which
+// may not have caught up with changes yet.
+func newValidators(modTime time.Time, size int64) validators {
+	return validators{
+		etag:         fmt.Sprintf(`"%x-%x"`, modTime.UnixNano(), size),
+		lastModified: modTime,
+	}
+}
+
+// memberValidators derives the validators of an archive member from the
+// archive it is in, which changes whenever any of its members do.
+func memberValidators(archive os.FileInfo, m idx.ArchiveMember) validators {
+	return validators{
+		etag:         fmt.Sprintf(`"%x-%x-%x"`, archive.ModTime().UnixNano(), archive.Size(), m.Size),
+		lastModified: archive.ModTime(),
+	}
+}
+
+func (v validators) writeHeaders(w http.ResponseWriter) {
+	w.Header().Set("ETag", v.etag)
+	if !v.lastModified.IsZero() {
+		w.Header().Set("Last-Modified", v.lastModified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// etagMatches reports whether the list of entity tags in header contains
+// etag. A weak comparison ignores the W/ prefix of weak tags, a strong one
+// doesn't match them at all.
+func etagMatches(header string, etag string, weak bool) bool {
+	s := strings.TrimSpace(header)
+	if s == "*" {
+		return true
+	}
+	for s != "" {
+		s = strings.TrimLeft(s, " \t,")
+		isWeak := strings.HasPrefix(s, "W/")
+		s = strings.TrimPrefix(s, "W/")
+		if !strings.HasPrefix(s, `"`) {
+			return false
+		}
+		end := strings.IndexByte(s[1:], '"')
+		if end < 0 {
+			return false
+		}
+		tag := s[:end+2]
+		s = s[end+2:]
+		if tag == etag && (weak || !isWeak) {
+			return true
+		}
+	}
+	return false
+}
+
+// modifiedSince reports whether lastModified is later than the HTTP date in
+// header, which has a resolution of seconds. Invalid dates are ignored.
+func modifiedSince(header string, lastModified time.Time) (modified bool, ok bool) {
+	if header == "" || lastModified.IsZero() {
+		return false, false
+	}
+	t, err := http.ParseTime(header)
+	if err != nil {
+		return false, false
+	}
+	return lastModified.Truncate(time.Second).After(t), true
+}
+
+// checkPreconditions evaluates the conditional headers of r in the order of
+// RFC 7232 Section 6. It returns true if a 304 or 412 response has been
+// written instead of the content.
+func checkPreconditions(w http.ResponseWriter, r *http.Request, v validators) bool {
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if !etagMatches(ifMatch, v.etag, false) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return true
+		}
+	} else if modified, ok := modifiedSince(r.Header.Get("If-Unmodified-Since"), v.lastModified); ok && modified {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return true
+	}
+
+	isRead := r.Method == http.MethodGet || r.Method == http.MethodHead
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if !etagMatches(ifNoneMatch, v.etag, true) {
+			return false
+		}
+		if isRead {
+			writeNotModified(w)
+		} else {
+			w.WriteHeader(http.StatusPreconditionFailed)
+		}
+		return true
+	}
+	if modified, ok := modifiedSince(r.Header.Get("If-Modified-Since"), v.lastModified); ok && !modified && isRead {
+		writeNotModified(w)
+		return true
+	}
+	return false
+}
+
+func writeNotModified(w http.ResponseWriter) {
+	// a 304 response has no content to describe
+	w.Header().Del("Content-Type")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// rangeAllowed reports whether the Range header of r may be honoured, which
+// If-Range only allows while the content is still the version the client
+// has part of.
+func rangeAllowed(r *http.Request, v validators) bool {
+	ifRange := r.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		return etagMatches(ifRange, v.etag, false)
+	}
+	// a date only validates if it is exactly the last modification time
+	t, err := http.ParseTime(ifRange)
+	return err == nil && !v.lastModified.IsZero() && v.lastModified.Truncate(time.Second).Equal(t)
+}
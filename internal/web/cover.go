@@ -0,0 +1,136 @@
+package web
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/fatalbanana/filetundra/internal/env"
+	"github.com/fatalbanana/filetundra/internal/idx"
+	"github.com/fatalbanana/filetundra/internal/log"
+
+	"github.com/blugelabs/bluge"
+	"go.uber.org/zap"
+)
+
+// coverPath returns the path to the cover endpoint for the file at
+// virtualPath.
+func coverPath(virtualPath string) string {
+	return path.Join("/cover", virtualPath)
+}
+
+func isAudio(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "audio/")
+}
+
+func coverHandler(w http.ResponseWriter, r *http.Request) {
+	virtualPath := path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/cover"))
+	searchPath := filepath.Join(env.Env.Root, virtualPath)
+
+	fi, err := pathToFileInfo(r.Context(), searchPath)
+	if err == errNotFound {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Logger.Error("error looking up file",
+			zap.String("path", searchPath), zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	if fi.AudioArtwork || fi.BookCover {
+		picture := idx.AudioPicture
+		if fi.BookCover {
+			picture = idx.BookCover
+		}
+		si, err := os.Stat(fi.Filename)
+		var data []byte
+		var mimeType string
+		if err == nil {
+			data, mimeType, err = picture(fi.Filename)
+		}
+		if err == nil {
+			// the picture changes with the file it is in
+			v := newValidators(si.ModTime(), si.Size())
+			w.Header().Set("Content-Type", mimeType)
+			v.writeHeaders(w)
+			if checkPreconditions(w, r, v) {
+				return
+			}
+			err = serveContent(w, r, bytes.NewReader(data), int64(len(data)), v)
+			if err != nil {
+				log.Logger.Error("error serving cover",
+					zap.String("path", searchPath), zap.Error(err))
+				panic(http.ErrAbortHandler)
+			}
+			return
+		}
+		log.Logger.Error("error extracting picture",
+			zap.String("path", searchPath), zap.Error(err))
+	}
+
+	var dir string
+	switch {
+	case fi.MimeType == "inode/directory":
+		dir = fi.Filename
+	case isAudio(fi.MimeType):
+		dir = filepath.Dir(fi.Filename)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	reader, err := bluge.OpenReader(idx.BlugeConfig)
+	if err != nil {
+		log.Logger.Error("error opening reader", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+	covers, err := idx.FindCovers(r.Context(), reader, dir)
+	if err != nil {
+		log.Logger.Error("error finding cover",
+			zap.String("path", dir), zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	cover, ok := covers[dir]
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	f, err := os.Open(cover.Filename) // #nosec: shut up
+	if os.IsNotExist(err) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Logger.Error("error opening cover",
+			zap.String("path", cover.Filename), zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	si, err := f.Stat()
+	if err != nil {
+		log.Logger.Error("error getting cover size",
+			zap.String("path", cover.Filename), zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	v := newValidators(si.ModTime(), si.Size())
+	w.Header().Set("Content-Type", cover.MimeType)
+	v.writeHeaders(w)
+	if checkPreconditions(w, r, v) {
+		return
+	}
+	err = serveContent(w, r, f, si.Size(), v)
+	if err != nil {
+		log.Logger.Error("error serving cover",
+			zap.String("path", cover.Filename), zap.Error(err))
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,95 @@
+package web
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fatalbanana/filetundra/internal/env"
+)
+
+func TestCover(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(coverHandler))
+	defer ts.Close()
+
+	cover, err := ioutil.ReadFile(filepath.Join(env.Env.Root, "album", "cover.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := ts.Client()
+	tests := []struct {
+		path        string
+		status      int
+		contentType string
+		// whether the body is the album cover, else the embedded picture
+		albumCover bool
+	}{
+		{"/cover/album", http.StatusOK, "image/png", true},
+		{"/cover/album/plain.mp3", http.StatusOK, "image/png", true},
+		{"/cover/album/embedded.mp3", http.StatusOK, "image/png", false},
+		{"/cover/books/colour.epub", http.StatusOK, "image/png", true},
+		{"/cover/books/light.epub", http.StatusNotFound, "", false},
+		{"/cover/tone.mp3", http.StatusNotFound, "", false},
+		{"/cover/album/cover.png", http.StatusNotFound, "", false},
+		{"/cover/missing", http.StatusNotFound, "", false},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		responseBytes, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.status {
+			t.Fatalf("unexpected HTTP status for %s: got %d expected %d",
+				tt.path, resp.StatusCode, tt.status)
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		if contentType := resp.Header.Get("Content-Type"); contentType != tt.contentType {
+			t.Fatalf("unexpected Content-Type for %s: got %s expected %s", tt.path, contentType, tt.contentType)
+		}
+		if bytes.Equal(responseBytes, cover) != tt.albumCover || !bytes.HasPrefix(responseBytes, []byte("\x89PNG")) {
+			t.Fatalf("unexpected picture for %s", tt.path)
+		}
+	}
+}
+
+func TestBrowseCovers(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(browseHandler))
+	defer ts.Close()
+
+	resp, err := ts.Client().Get(ts.URL + "/browse/album")
+	if err != nil {
+		t.Fatal(err)
+	}
+	responseBytes, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`<img src="/cover/album/embedded.mp3" class="cover">`,
+		`<img src="/cover/album/plain.mp3" class="cover">`,
+		`<img src="/static/icons/image.svg">`,
+	} {
+		if !strings.Contains(string(responseBytes), expected) {
+			t.Fatalf("response didn't contain %s", expected)
+		}
+	}
+}
@@ -1,11 +1,14 @@
 package web
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -17,6 +20,7 @@ import (
 	"github.com/fatalbanana/filetundra/internal/log"
 
 	"github.com/blugelabs/bluge"
+	"github.com/h2non/filetype"
 	"go.uber.org/zap"
 )
 
@@ -51,9 +55,142 @@ func pathToFileInfo(ctx context.Context, searchPath string) (dud idx.FileInfo, e
 	return idx.DocumentMatchToFileInfo(reader, next)
 }
 
-func writeHeaders(w http.ResponseWriter, fi idx.FileInfo) {
+func writeHeaders(w http.ResponseWriter, fi idx.FileInfo, v validators) {
 	w.Header().Set("Accept-Ranges", "bytes")
 	w.Header().Set("Content-Type", fi.MimeType)
+	v.writeHeaders(w)
+}
+
+// maxRanges is the number of ranges served in one response after
+// coalescing. Requests for more are answered with the whole content, so that
+// many tiny ranges can't be used to multiply the work of a download.
+const maxRanges = 64
+
+// serveContent writes content of the given size, or the ranges of it
+// requested by the client if the content still has the validators v. The
+// caller is expected to have set the entity headers. A negative size means
+// the size is unknown, as for members of some compressed archives. Ranges
+// of such content are not served: most of them can't be answered without
+// the size, so the whole content is sent and Accept-Ranges is left out.
+func serveContent(w http.ResponseWriter, r *http.Request, content io.Reader, size int64, v validators) error {
+	rangeHdr := r.Header.Get("Range")
+	var ranges []httprange.Range
+	if rangeHdr != "" && size >= 0 && rangeAllowed(r, v) {
+		var err error
+		ranges, err = httprange.ParseRange(rangeHdr, size)
+		if err == httprange.ErrNoOverlap {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			http.Error(w, "", http.StatusRequestedRangeNotSatisfiable)
+			return nil
+		}
+		if err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return nil
+		}
+		ranges = httprange.Coalesce(ranges)
+		if len(ranges) > maxRanges {
+			ranges = nil
+		}
+	}
+
+	switch len(ranges) {
+	case 0:
+		if size >= 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		}
+		_, err := io.Copy(w, content)
+		return err
+	case 1:
+		err := skipTo(content, 0, ranges[0].Start)
+		if err != nil {
+			log.Logger.Error("seek failed", zap.Error(err))
+			http.Error(w, "", http.StatusInternalServerError)
+			return nil
+		}
+		w.Header().Set("Content-Range", ranges[0].ContentRange(size))
+		w.Header().Set("Content-Length", strconv.FormatInt(ranges[0].Length, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		_, err = io.CopyN(w, content, ranges[0].Length)
+		return err
+	}
+	return serveMultipartRanges(w, content, size, ranges)
+}
+
+// skipTo moves content from offset pos to offset start. Content which can't
+// seek, such as compressed archive members, is read through instead.
+func skipTo(content io.Reader, pos int64, start int64) error {
+	if seeker, ok := content.(io.Seeker); ok {
+		_, err := seeker.Seek(start, io.SeekStart)
+		return err
+	}
+	_, err := io.CopyN(io.Discard, content, start-pos)
+	return err
+}
+
+// rangePartHeader returns the headers of the part of a multipart/byteranges
+// response holding ra.
+func rangePartHeader(ra httprange.Range, contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {ra.ContentRange(size)},
+		"Content-Type":  {contentType},
+	}
+}
+
+// serveMultipartRanges writes ranges, sorted and without overlaps, as a
+// multipart/byteranges response.
+func serveMultipartRanges(w http.ResponseWriter, content io.Reader, size int64, ranges []httprange.Range) error {
+	contentType := w.Header().Get("Content-Type")
+
+	// the parts are written twice, to count their length first
+	var length countingWriter
+	mw := multipart.NewWriter(&length)
+	for _, ra := range ranges {
+		_, err := mw.CreatePart(rangePartHeader(ra, contentType, size))
+		if err != nil {
+			return err
+		}
+		length += countingWriter(ra.Length)
+	}
+	err := mw.Close()
+	if err != nil {
+		return err
+	}
+
+	boundary := mw.Boundary()
+	mw = multipart.NewWriter(w)
+	err = mw.SetBoundary(boundary)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+	w.Header().Set("Content-Length", strconv.FormatInt(int64(length), 10))
+	w.WriteHeader(http.StatusPartialContent)
+
+	var pos int64
+	for _, ra := range ranges {
+		part, err := mw.CreatePart(rangePartHeader(ra, contentType, size))
+		if err != nil {
+			return err
+		}
+		err = skipTo(content, pos, ra.Start)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(part, content, ra.Length)
+		if err != nil {
+			return err
+		}
+		pos = ra.Start + ra.Length
+	}
+	return mw.Close()
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
 }
 
 func downloadHandler(w http.ResponseWriter, r *http.Request) {
@@ -61,69 +198,135 @@ func downloadHandler(w http.ResponseWriter, r *http.Request) {
 	searchPath := filepath.Join(env.Env.Root, virtualPath)
 
 	fi, err := pathToFileInfo(r.Context(), searchPath)
+	if err == errNotFound {
+		archiveFi, inner, err := findArchive(r.Context(), searchPath)
+		if err == nil && inner != "" {
+			downloadArchiveMember(w, r, archiveFi, inner)
+			return
+		}
+		if err != nil && err != errNotFound {
+			log.Logger.Error("error fetching archive info", zap.Error(err))
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		if err == errNotFound {
+		log.Logger.Error("error fetching path info", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	f, err := os.Open(fi.Filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// removed since last indexed
 			http.Error(w, "Not Found", http.StatusNotFound)
 			return
 		}
-		log.Logger.Error("error fetching path info", zap.Error(err))
+		log.Logger.Error("failed to open file",
+			zap.Error(err), zap.String("path", fi.Filename))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	si, err := f.Stat()
+	if err != nil {
+		log.Logger.Error("failed to stat file",
+			zap.Error(err), zap.String("path", fi.Filename))
 		http.Error(w, "", http.StatusInternalServerError)
 		return
 	}
 
+	v := newValidators(si.ModTime(), si.Size())
+	writeHeaders(w, fi, v)
+	if checkPreconditions(w, r, v) {
+		return
+	}
 	if r.Method == http.MethodHead {
-		writeHeaders(w, fi)
+		w.Header().Set("Content-Length", strconv.FormatInt(si.Size(), 10))
 		return
 	}
+	err = serveContent(w, r, f, si.Size(), v)
+	if err != nil {
+		log.Logger.Error("error serving file",
+			zap.Error(err), zap.String("path", fi.Filename))
+		panic(http.ErrAbortHandler)
+	}
+}
 
-	rangeHdr := r.Header.Get("Range")
-	var ranges []httprange.Range
-	var haveRange bool
-	if rangeHdr != "" {
-		haveRange = true
-		ranges, err = httprange.ParseRange(rangeHdr, fi.Size)
-		if err != nil {
-			http.Error(w, "", http.StatusBadRequest)
-			return
-		}
-		if len(ranges) > 1 {
-			http.Error(w, "multiple ranges unimplemented", http.StatusNotImplemented)
-			return
-		}
+// sniffContentType determines the MIME type of content from its first bytes.
+func sniffContentType(head []byte) string {
+	fType, err := filetype.Match(head)
+	if err == nil && fType.MIME.Value != "" {
+		return fType.MIME.Value
 	}
+	return http.DetectContentType(head)
+}
 
-	f, err := os.Open(fi.Filename)
-	if err != nil {
-		log.Logger.Error("failed to open file",
+func downloadArchiveMember(w http.ResponseWriter, r *http.Request, fi idx.FileInfo, inner string) {
+	archive, err := os.Stat(fi.Filename)
+	if os.IsNotExist(err) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Logger.Error("failed to stat archive",
 			zap.Error(err), zap.String("path", fi.Filename))
 		http.Error(w, "", http.StatusInternalServerError)
 		return
 	}
-	if haveRange {
-		_, err := f.Seek(ranges[0].Start, 0)
+	err = idx.VisitArchiveMember(fi.Filename, inner, func(m idx.ArchiveMember, content io.Reader) error {
+		if m.IsDir {
+			return idx.ErrMemberNotFound
+		}
+		v := memberValidators(archive, m)
+		v.writeHeaders(w)
+		if checkPreconditions(w, r, v) {
+			return nil
+		}
+
+		head := make([]byte, 512)
+		n, err := io.ReadFull(content, head)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		head = head[:n]
+		if seeker, ok := content.(io.Seeker); ok {
+			_, err = seeker.Seek(0, io.SeekStart)
+			if err != nil {
+				return err
+			}
+		} else {
+			content = io.MultiReader(bytes.NewReader(head), content)
+		}
+
+		// serveContent ignores ranges of members of unknown size
+		if m.Size >= 0 {
+			w.Header().Set("Accept-Ranges", "bytes")
+		}
+		w.Header().Set("Content-Type", sniffContentType(head))
+		if r.Method == http.MethodHead {
+			if m.Size >= 0 {
+				w.Header().Set("Content-Length", strconv.FormatInt(m.Size, 10))
+			}
+			return nil
+		}
+		err = serveContent(w, r, content, m.Size, v)
 		if err != nil {
-			log.Logger.Error("seek failed", zap.Error(err))
-			http.Error(w, "", http.StatusInternalServerError)
-			return
+			log.Logger.Error("error serving archive member",
+				zap.Error(err), zap.String("path", fi.Filename), zap.String("member", inner))
+			panic(http.ErrAbortHandler)
 		}
-		w.Header().Set("Content-Range",
-			fmt.Sprintf("bytes %d-%d/%d",
-				ranges[0].Start,
-				ranges[0].Start+ranges[0].Length,
-				fi.Size))
-	}
-	writeHeaders(w, fi)
-	if haveRange {
-		w.Header().Set("Content-Length", strconv.FormatInt(ranges[0].Length, 10))
-		w.WriteHeader(http.StatusPartialContent)
-		_, err = io.CopyN(w, f, ranges[0].Length)
-	} else {
-		w.Header().Set("Content-Length", strconv.FormatInt(fi.Size, 10))
-		_, err = io.Copy(w, f)
+		return nil
+	})
+	if err == idx.ErrMemberNotFound {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
 	}
 	if err != nil {
-		log.Logger.Error("error serving file",
-			zap.Error(err), zap.String("path", fi.Filename))
-		panic(http.ErrAbortHandler)
+		log.Logger.Error("error reading archive member",
+			zap.Error(err), zap.String("path", fi.Filename), zap.String("member", inner))
+		http.Error(w, "", http.StatusInternalServerError)
 	}
 }
@@ -2,12 +2,19 @@ package web
 
 import (
 	"bytes"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/fatalbanana/filetundra/internal/env"
 )
@@ -86,3 +93,297 @@ func TestDownload(t *testing.T) {
 		t.Fatalf("Unexpected body: %s", responseString)
 	}
 }
+
+func TestDownloadArchiveMember(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(downloadHandler))
+	defer ts.Close()
+
+	client := ts.Client()
+	tests := []struct {
+		path        string
+		rangeHdr    string
+		status      int
+		body        string
+		contentType string
+	}{
+		{"/download/archives/test.zip/hello.txt", "", http.StatusOK, "hello world", "text/plain; charset=utf-8"},
+		{"/download/archives/test.zip/hello.txt", "bytes=6-", http.StatusPartialContent, "world", "text/plain; charset=utf-8"},
+		{"/download/archives/test.zip/dir/inner.txt", "bytes=6-9", http.StatusPartialContent, "cont", "text/plain; charset=utf-8"},
+		{"/download/archives/test.tar.gz/dir/inner.txt", "", http.StatusOK, "inner contents", "text/plain; charset=utf-8"},
+		{"/download/archives/test.tar.gz/hello.txt", "bytes=0-4", http.StatusPartialContent, "hello", "text/plain; charset=utf-8"},
+		{"/download/archives/test.zip/sniodmnioewjriodsf", "", http.StatusNotFound, "", ""},
+		{"/download/archives/test.zip/dir", "", http.StatusNotFound, "", ""},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.rangeHdr != "" {
+			req.Header.Set("Range", tt.rangeHdr)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		responseBytes, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.status {
+			t.Fatalf("unexpected HTTP status for %s: got %d expected %d",
+				tt.path, resp.StatusCode, tt.status)
+		}
+		if tt.status == http.StatusNotFound {
+			continue
+		}
+		if string(responseBytes) != tt.body {
+			t.Fatalf("unexpected body for %s: got %q expected %q", tt.path, responseBytes, tt.body)
+		}
+		if contentType := resp.Header.Get("Content-Type"); contentType != tt.contentType {
+			t.Fatalf("unexpected content type for %s: got %s expected %s", tt.path, contentType, tt.contentType)
+		}
+	}
+}
+
+func TestDownloadRanges(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(downloadHandler))
+	defer ts.Close()
+
+	var tooMany []string
+	for i := 0; i <= maxRanges; i++ {
+		tooMany = append(tooMany, fmt.Sprintf("%d-%d", 2*i, 2*i))
+	}
+
+	client := ts.Client()
+	tests := []struct {
+		path     string
+		rangeHdr string
+		status   int
+		// Content-Range of the response or of each part
+		contentRanges []string
+		// body or bodies of each part
+		parts []string
+	}{
+		{"/download/tone.mp3", "bytes=78-83,85-89", http.StatusPartialContent,
+			[]string{"bytes 78-83/522", "bytes 85-89/522"}, []string{"Andrew", "Lewis"}},
+		{"/download/tone.mp3", "bytes=84-89,78-84", http.StatusPartialContent,
+			[]string{"bytes 78-89/522"}, []string{"Andrew Lewis"}},
+		{"/download/tone.mp3", "bytes=512-,78-83", http.StatusPartialContent,
+			[]string{"bytes 78-83/522", "bytes 512-521/522"}, nil},
+		{"/download/tone.mp3", "bytes=522-", http.StatusRequestedRangeNotSatisfiable,
+			[]string{"bytes */522"}, nil},
+		{"/download/tone.mp3", "bytes=" + strings.Join(tooMany, ","), http.StatusOK, nil, nil},
+		{"/download/archives/test.tar.gz/hello.txt", "bytes=6-,0-4", http.StatusPartialContent,
+			[]string{"bytes 0-4/11", "bytes 6-10/11"}, []string{"hello", "world"}},
+		{"/download/archives/test.zip/hello.txt", "bytes=0-0,-1", http.StatusPartialContent,
+			[]string{"bytes 0-0/11", "bytes 10-10/11"}, []string{"h", "d"}},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Range", tt.rangeHdr)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		responseBytes, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.status {
+			t.Fatalf("unexpected HTTP status for %s: got %d expected %d", tt.rangeHdr, resp.StatusCode, tt.status)
+		}
+		if resp.ContentLength >= 0 && resp.ContentLength != int64(len(responseBytes)) {
+			t.Fatalf("unexpected Content-Length for %s: got %d expected %d", tt.rangeHdr, resp.ContentLength, len(responseBytes))
+		}
+
+		var contentRanges, parts []string
+		mediaType, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if mediaType == "multipart/byteranges" {
+			mr := multipart.NewReader(bytes.NewReader(responseBytes), params["boundary"])
+			for {
+				part, err := mr.NextPart()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if contentType := part.Header.Get("Content-Type"); contentType == "" {
+					t.Fatalf("part for %s has no content type", tt.rangeHdr)
+				}
+				partBytes, err := ioutil.ReadAll(part)
+				if err != nil {
+					t.Fatal(err)
+				}
+				contentRanges = append(contentRanges, part.Header.Get("Content-Range"))
+				parts = append(parts, string(partBytes))
+			}
+		} else if contentRange := resp.Header.Get("Content-Range"); contentRange != "" {
+			contentRanges = []string{contentRange}
+			parts = []string{string(responseBytes)}
+		}
+		if !reflect.DeepEqual(contentRanges, tt.contentRanges) {
+			t.Fatalf("unexpected ranges for %s: got %v expected %v", tt.rangeHdr, contentRanges, tt.contentRanges)
+		}
+		if tt.parts != nil && !reflect.DeepEqual(parts, tt.parts) {
+			t.Fatalf("unexpected parts for %s: got %q expected %q", tt.rangeHdr, parts, tt.parts)
+		}
+	}
+}
+
+func TestServeContentUnknownSize(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/download/notes.txt.gz/notes.txt", nil)
+	req.Header.Set("Range", "bytes=6-10")
+	w := httptest.NewRecorder()
+	err := serveContent(w, req, strings.NewReader("hello world"), -1, validators{etag: `"1"`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected HTTP status: got %d expected %d", w.Code, http.StatusOK)
+	}
+	if contentRange := w.Header().Get("Content-Range"); contentRange != "" {
+		t.Fatalf("unexpected Content-Range: %s", contentRange)
+	}
+	if body := w.Body.String(); body != "hello world" {
+		t.Fatalf("unexpected body: got %q expected %q", body, "hello world")
+	}
+}
+
+func TestDownloadConditional(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(downloadHandler))
+	defer ts.Close()
+
+	client := ts.Client()
+	validators := make(map[string]http.Header)
+	for _, p := range []string{"/download/tone.mp3", "/download/archives/test.zip/hello.txt"} {
+		resp, err := client.Head(ts.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.Header.Get("ETag") == "" || resp.Header.Get("Last-Modified") == "" {
+			t.Fatalf("missing validators for %s: %v", p, resp.Header)
+		}
+		validators[p] = resp.Header
+	}
+	etag := validators["/download/tone.mp3"].Get("ETag")
+	lastModified := validators["/download/tone.mp3"].Get("Last-Modified")
+	modTime, err := http.ParseTime(lastModified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	earlier := modTime.Add(-time.Hour).Format(http.TimeFormat)
+
+	tests := []struct {
+		method  string
+		path    string
+		headers map[string]string
+		status  int
+	}{
+		{http.MethodGet, "/download/tone.mp3", map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{http.MethodHead, "/download/tone.mp3", map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{http.MethodGet, "/download/tone.mp3", map[string]string{"If-None-Match": `"other", W/` + etag}, http.StatusNotModified},
+		{http.MethodGet, "/download/tone.mp3", map[string]string{"If-None-Match": "*"}, http.StatusNotModified},
+		{http.MethodGet, "/download/tone.mp3", map[string]string{"If-None-Match": `"other"`}, http.StatusOK},
+		{http.MethodGet, "/download/tone.mp3", map[string]string{"If-Modified-Since": lastModified}, http.StatusNotModified},
+		{http.MethodGet, "/download/tone.mp3", map[string]string{"If-Modified-Since": earlier}, http.StatusOK},
+		{http.MethodGet, "/download/tone.mp3", map[string]string{"If-Modified-Since": "yesterday"}, http.StatusOK},
+		{http.MethodGet, "/download/tone.mp3",
+			map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": lastModified}, http.StatusOK},
+		{http.MethodGet, "/download/tone.mp3", map[string]string{"If-Match": etag}, http.StatusOK},
+		{http.MethodGet, "/download/tone.mp3", map[string]string{"If-Match": `"other"`}, http.StatusPreconditionFailed},
+		{http.MethodGet, "/download/tone.mp3", map[string]string{"If-Match": "W/" + etag}, http.StatusPreconditionFailed},
+		{http.MethodGet, "/download/tone.mp3", map[string]string{"If-Unmodified-Since": lastModified}, http.StatusOK},
+		{http.MethodGet, "/download/tone.mp3", map[string]string{"If-Unmodified-Since": earlier}, http.StatusPreconditionFailed},
+		{http.MethodGet, "/download/tone.mp3",
+			map[string]string{"If-Match": etag, "If-Unmodified-Since": earlier}, http.StatusOK},
+		{http.MethodGet, "/download/tone.mp3", map[string]string{"Range": "bytes=78-89", "If-Range": etag}, http.StatusPartialContent},
+		{http.MethodGet, "/download/tone.mp3", map[string]string{"Range": "bytes=78-89", "If-Range": lastModified}, http.StatusPartialContent},
+		{http.MethodGet, "/download/tone.mp3", map[string]string{"Range": "bytes=78-89", "If-Range": `"other"`}, http.StatusOK},
+		{http.MethodGet, "/download/tone.mp3", map[string]string{"Range": "bytes=78-89", "If-Range": "W/" + etag}, http.StatusOK},
+		{http.MethodGet, "/download/tone.mp3", map[string]string{"Range": "bytes=78-89", "If-Range": earlier}, http.StatusOK},
+		{http.MethodGet, "/download/archives/test.zip/hello.txt",
+			map[string]string{"If-None-Match": validators["/download/archives/test.zip/hello.txt"].Get("ETag")}, http.StatusNotModified},
+		{http.MethodGet, "/download/archives/test.zip/hello.txt", map[string]string{"If-None-Match": etag}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, ts.URL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range tt.headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Fatalf("unexpected HTTP status for %s %v: got %d expected %d", tt.path, tt.headers, resp.StatusCode, tt.status)
+		}
+		if tt.status != http.StatusPreconditionFailed && resp.Header.Get("ETag") != validators[tt.path].Get("ETag") {
+			t.Fatalf("unexpected ETag for %s %v: got %s expected %s",
+				tt.path, tt.headers, resp.Header.Get("ETag"), validators[tt.path].Get("ETag"))
+		}
+	}
+}
+
+func TestDownloadChangedSinceIndexed(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(downloadHandler))
+	defer ts.Close()
+
+	client := ts.Client()
+	resp, err := client.Head(ts.URL + "/download/aaa/bbb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+
+	// the index isn't updated, as while the watcher waits for changes to
+	// settle
+	fpath := filepath.Join(env.Env.Root, "aaa", "bbb")
+	si, err := os.Stat(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(fpath, si.ModTime(), si.ModTime().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chtimes(fpath, si.ModTime(), si.ModTime())
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/download/aaa/bbb", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=1-")
+	req.Header.Set("If-Range", etag)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected HTTP status: got %d expected %d", resp.StatusCode, http.StatusOK)
+	}
+	if resp.Header.Get("ETag") == etag {
+		t.Fatalf("ETag %s didn't change with the file", etag)
+	}
+	expected := si.ModTime().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if lastModified := resp.Header.Get("Last-Modified"); lastModified != expected {
+		t.Fatalf("unexpected Last-Modified: got %s expected %s", lastModified, expected)
+	}
+}
@@ -0,0 +1,113 @@
+package web
+
+import (
+	"strings"
+
+	"github.com/fatalbanana/filetundra/internal/properties"
+
+	"github.com/blugelabs/bluge"
+	"github.com/blugelabs/bluge/search"
+	"github.com/blugelabs/bluge/search/aggregations"
+)
+
+// number of values shown per facet
+const facetSize = 10
+
+// Facet counts the search results by the values of a field.
+type Facet struct {
+	Name   string       `json:"name"`
+	Label  string       `json:"label"`
+	Values []FacetValue `json:"values"`
+}
+
+// FacetValue links to the search results narrowed to a value, or widened
+// again if the value is already selected.
+type FacetValue struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+	// query term selecting the value
+	Filter   string      `json:"filter"`
+	Link     ListingLink `json:"-"`
+	Selected bool        `json:"selected"`
+}
+
+type facetDefinition struct {
+	name  string
+	label string
+	field string
+	// filter returns the query term selecting a value
+	filter func(value string) string
+}
+
+// quoteFilterValue quotes a facet value for a query term. The query language
+// has no escapes, so values containing quotes can't be filtered for.
+func quoteFilterValue(field string, value string) string {
+	if strings.Contains(value, `"`) {
+		return ""
+	}
+	return field + `:"` + value + `"`
+}
+
+var facetDefinitions = []facetDefinition{
+	{"type", "Type", properties.FacetType, func(value string) string {
+		return "type:" + value
+	}},
+	{"ext", "Extension", properties.FacetExtension, func(value string) string {
+		return quoteFilterValue("ext", value)
+	}},
+	{"year", "Year", properties.FacetYear, func(value string) string {
+		return "modified:" + value
+	}},
+	{"artist", "Artist", properties.FacetArtist, func(value string) string {
+		return quoteFilterValue("artist.exact", value)
+	}},
+	{"album", "Album", properties.FacetAlbum, func(value string) string {
+		return quoteFilterValue("album.exact", value)
+	}},
+}
+
+// addFacetAggregations requests the counts of the facets with a search.
+func addFacetAggregations(req *bluge.TopNSearch) {
+	for _, def := range facetDefinitions {
+		req.AddAggregation(def.name, aggregations.NewTermsAggregation(search.Field(def.field), facetSize))
+	}
+}
+
+// facets returns the facets of a search with at least one value. Their links
+// keep the other parameters of opts.
+func facets(results *search.Bucket, opts listingOptions, base string) []Facet {
+	var res []Facet
+	for _, def := range facetDefinitions {
+		facet := Facet{Name: def.name, Label: def.label}
+		for _, bucket := range results.Buckets(def.name) {
+			filter := def.filter(bucket.Name())
+			if filter == "" {
+				continue
+			}
+			value := FacetValue{
+				Value:  bucket.Name(),
+				Count:  int(bucket.Count()),
+				Filter: filter,
+			}
+			other := opts
+			other.Page = 1
+			other.Filters = nil
+			for _, f := range opts.Filters {
+				if f == filter {
+					value.Selected = true
+				} else {
+					other.Filters = append(other.Filters, f)
+				}
+			}
+			if !value.Selected {
+				other.Filters = append(other.Filters, filter)
+			}
+			value.Link = other.link(base, bucket.Name())
+			facet.Values = append(facet.Values, value)
+		}
+		if len(facet.Values) > 0 {
+			res = append(res, facet)
+		}
+	}
+	return res
+}
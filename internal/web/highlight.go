@@ -0,0 +1,171 @@
+package web
+
+import (
+	"fmt"
+	"html/template"
+	"path/filepath"
+	"strings"
+
+	"github.com/fatalbanana/filetundra/internal/env"
+	"github.com/fatalbanana/filetundra/internal/properties"
+
+	"github.com/blugelabs/bluge"
+	"github.com/blugelabs/bluge/search"
+	"github.com/blugelabs/bluge/search/highlight"
+)
+
+// Highlight is a fragment of a field a search hit matched, with the matching
+// terms marked.
+type Highlight struct {
+	Label    string
+	Fragment template.HTML
+}
+
+// highlightFields are the fields shown to explain search hits, in display
+// order.
+var highlightFields = []struct {
+	field string
+	label string
+}{
+	{properties.BareBasename, "name"},
+	{properties.Dirname, "directory"},
+	{properties.ArchiveFilename, "archive"},
+	{properties.AudioTitle, "title"},
+	{properties.AudioArtist, "artist"},
+	{properties.AudioAlbumArtist, "album artist"},
+	{properties.AudioAlbum, "album"},
+	{properties.AudioComposer, "composer"},
+	{properties.AudioGenre, "genre"},
+	{properties.BookTitle, "title"},
+	{properties.BookAuthor, "author"},
+	{properties.BookSeries, "series"},
+	{properties.OfficeTitle, "title"},
+	{properties.OfficeCreator, "author"},
+	{properties.OfficeLastModifiedBy, "edited by"},
+	{properties.PDFTitle, "title"},
+	{properties.PDFAuthor, "author"},
+	{properties.PDFSubject, "subject"},
+	{properties.VideoTitle, "title"},
+	{properties.ImageMake, "make"},
+	{properties.ImageModel, "model"},
+	{properties.ImageLens, "lens"},
+	{properties.Content, "content"},
+}
+
+var highlighter = highlight.NewHTMLHighlighterTags("<mark>", "</mark>")
+
+// highlights returns fragments of the fields match was found in. The search
+// must have been made with locations included.
+func highlights(reader *bluge.Reader, match *search.DocumentMatch) ([]Highlight, error) {
+	if len(match.Locations) == 0 {
+		return nil, nil
+	}
+	values := make(map[string][]string)
+	err := reader.VisitStoredFields(match.Number, func(field string, value []byte) bool {
+		if _, ok := match.Locations[field]; ok || field == "_id" {
+			values[field] = append(values[field], string(value))
+		}
+		// only the beginning of the content is stored, matches beyond it
+		// are left out by matchedValue
+		if _, ok := match.Locations[properties.Content]; ok && field == properties.ContentExcerpt {
+			values[properties.Content] = append(values[properties.Content], string(value))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	// directories are not stored, but are part of the file name
+	if ids := values["_id"]; len(ids) > 0 {
+		values[properties.Dirname] = []string{filepath.Dir(ids[0])}
+	}
+
+	var res []Highlight
+	for _, hf := range highlightFields {
+		tlm, ok := match.Locations[hf.field]
+		if !ok {
+			continue
+		}
+		value, tlm := matchedValue(values[hf.field], tlm)
+		if value == "" {
+			continue
+		}
+		if hf.field == properties.Dirname {
+			value, tlm = trimRoot(value, tlm)
+		}
+		fragment := highlighter.BestFragment(tlm, []byte(value))
+		if fragment == "" {
+			continue
+		}
+		res = append(res, Highlight{
+			Label: hf.label,
+			// the highlighter escapes the text around the marks
+			Fragment: template.HTML(fragment),
+		})
+	}
+	return res, nil
+}
+
+// matchedValue picks the value of a field which may have several, such as
+// the member names of an archive, that the locations were found in. Their
+// offsets are relative to each value, so it is the first value with words at
+// those offsets that start with the (possibly stemmed) terms.
+func matchedValue(values []string, tlm search.TermLocationMap) (string, search.TermLocationMap) {
+	for _, value := range values {
+		found := make(search.TermLocationMap)
+		for term, locations := range tlm {
+			prefix := strings.ToLower(term)
+			for _, l := range locations {
+				if l.Start <= l.End && l.End <= len(value) &&
+					strings.HasPrefix(strings.ToLower(value[l.Start:l.End]), prefix) {
+					found.AddLocation(term, l)
+				}
+			}
+		}
+		if len(found) > 0 {
+			return value, found
+		}
+	}
+	return "", nil
+}
+
+// trimRoot removes the root directory from a directory and moves the
+// locations in it accordingly.
+func trimRoot(dir string, tlm search.TermLocationMap) (string, search.TermLocationMap) {
+	trimmed := strings.TrimPrefix(dir, env.Env.Root)
+	shift := len(dir) - len(trimmed)
+	if trimmed == "" {
+		trimmed = "/"
+	}
+	moved := make(search.TermLocationMap)
+	for term, locations := range tlm {
+		for _, l := range locations {
+			start, end := l.Start-shift, l.End-shift
+			if start < 0 {
+				start = 0
+			}
+			if end > len(trimmed) {
+				end = len(trimmed)
+			}
+			if start < end {
+				moved.AddLocation(term, &search.Location{Pos: l.Pos, Start: start, End: end})
+			}
+		}
+	}
+	return trimmed, moved
+}
+
+// formatExplanation lays out the score explanation of a search hit as an
+// indented tree.
+func formatExplanation(e *search.Explanation) string {
+	var b strings.Builder
+	var write func(e *search.Explanation, depth int)
+	write = func(e *search.Explanation, depth int) {
+		fmt.Fprintf(&b, "%s%.4f %s\n", strings.Repeat("  ", depth), e.Value, e.Message)
+		for _, child := range e.Children {
+			write(child, depth+1)
+		}
+	}
+	write(e, 0)
+	return b.String()
+}
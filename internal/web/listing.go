@@ -0,0 +1,248 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+
+	"github.com/fatalbanana/filetundra/internal/properties"
+
+	"github.com/blugelabs/bluge"
+)
+
+const (
+	defaultPerPage = 100
+	maxPerPage     = 1000
+	// entries skipped before the last page that can be requested, which
+	// bounds the work of a search for a page far down the results
+	maxOffset = 10000
+)
+
+var errInvalidListingOptions = errors.New("invalid sort, order, page or per_page")
+
+// sortFields are the index fields listings can be sorted by.
+var sortFields = map[string]string{
+	"modified":  properties.ModifiedTime,
+	"name":      properties.SortName,
+	"relevance": "_score",
+	"size":      properties.Size,
+	"track":     properties.AudioTrack,
+	"type":      properties.SortType,
+	"year":      properties.AudioYear,
+}
+
+// sortNames are the sort orders offered in listings, in display order.
+var sortNames = []string{"relevance", "name", "size", "modified", "type", "track", "year"}
+
+// ListingLink is a link to another page or order of a listing.
+type ListingLink struct {
+	Current bool
+	Href    string
+	Label   string
+}
+
+// listingOptions are the sorting and pagination parameters of a listing.
+type listingOptions struct {
+	// search query, empty when browsing
+	Query   string
+	Sort    string
+	Desc    bool
+	Page    int
+	PerPage int
+	// query terms narrowing a search, such as selected facets
+	Filters []string
+	// directory below the root a search is limited to, empty for all files
+	In string
+	// whether to show how the score of each search hit was computed
+	Explain bool
+	// whether results can be ordered by relevance
+	relevance bool
+}
+
+// parseListingOptions reads the sort, order, page, per_page, filter and
+// explain parameters of r. Searches also read their query from q and the
+// directory they are limited to from in, unless everywhere is set, and may
+// be sorted by relevance, which is their default order.
+func parseListingOptions(r *http.Request, relevance bool) (listingOptions, error) {
+	opts := listingOptions{
+		Sort:      "name",
+		Page:      1,
+		PerPage:   defaultPerPage,
+		relevance: relevance,
+	}
+	if relevance {
+		opts.Query = r.Form.Get("q")
+		opts.Sort = "relevance"
+		if in := path.Clean("/" + r.Form.Get("in")); in != "/" && r.Form.Get("everywhere") != "1" {
+			opts.In = in
+		}
+	}
+	if s := r.Form.Get("sort"); s != "" {
+		if _, ok := sortFields[s]; !ok || (s == "relevance" && !relevance) {
+			return opts, errInvalidListingOptions
+		}
+		opts.Sort = s
+	}
+	switch r.Form.Get("order") {
+	case "":
+		// the best matches come first
+		opts.Desc = opts.Sort == "relevance"
+	case "asc":
+	case "desc":
+		opts.Desc = true
+	default:
+		return opts, errInvalidListingOptions
+	}
+	for _, filter := range r.Form["filter"] {
+		if filter != "" {
+			opts.Filters = append(opts.Filters, filter)
+		}
+	}
+	opts.Explain = r.Form.Get("explain") == "1"
+	var err error
+	if s := r.Form.Get("page"); s != "" {
+		opts.Page, err = strconv.Atoi(s)
+		if err != nil || opts.Page < 1 {
+			return opts, errInvalidListingOptions
+		}
+	}
+	if s := r.Form.Get("per_page"); s != "" {
+		opts.PerPage, err = strconv.Atoi(s)
+		if err != nil || opts.PerPage < 1 || opts.PerPage > maxPerPage {
+			return opts, errInvalidListingOptions
+		}
+	}
+	if !pageInRange(opts.Page, opts.PerPage) {
+		return opts, errInvalidListingOptions
+	}
+	return opts, nil
+}
+
+// pageInRange reports whether the entries before page, with perPage entries
+// on each, are at most maxOffset.
+func pageInRange(page int, perPage int) bool {
+	return page >= 1 && page-1 <= maxOffset/perPage
+}
+
+// bounds returns the range of the entries of a listing with n entries which
+// are on the page selected by opts.
+func (opts listingOptions) bounds(n int) (start int, end int) {
+	start = (opts.Page - 1) * opts.PerPage
+	if start > n {
+		start = n
+	}
+	end = start + opts.PerPage
+	if end > n {
+		end = n
+	}
+	return start, end
+}
+
+// search returns the bluge request for the page of query selected by opts.
+func (opts listingOptions) search(query bluge.Query) *bluge.TopNSearch {
+	order := []string{sortFields[opts.Sort]}
+	if opts.Desc {
+		order[0] = "-" + order[0]
+	}
+	if opts.Sort != "name" {
+		order = append(order, properties.SortName)
+	}
+	order = append(order, "_id")
+	return bluge.NewTopNSearch(opts.PerPage, query).
+		SetFrom((opts.Page - 1) * opts.PerPage).
+		SortBy(order).
+		WithStandardAggregations()
+}
+
+// query encodes opts as URL parameters, leaving out defaults.
+func (opts listingOptions) query() url.Values {
+	defaults, _ := parseListingOptions(&http.Request{Form: url.Values{}}, opts.relevance)
+	v := url.Values{}
+	if opts.relevance {
+		v.Set("q", opts.Query)
+	}
+	if opts.In != "" {
+		v.Set("in", opts.In)
+	}
+	if opts.Sort != defaults.Sort {
+		v.Set("sort", opts.Sort)
+	}
+	// only relevance is sorted in descending order by default
+	if opts.Desc != (opts.Sort == "relevance") {
+		v.Set("order", "asc")
+		if opts.Desc {
+			v.Set("order", "desc")
+		}
+	}
+	if opts.Page != 1 {
+		v.Set("page", strconv.Itoa(opts.Page))
+	}
+	if opts.PerPage != defaultPerPage {
+		v.Set("per_page", strconv.Itoa(opts.PerPage))
+	}
+	if len(opts.Filters) > 0 {
+		v["filter"] = opts.Filters
+	}
+	if opts.Explain {
+		v.Set("explain", "1")
+	}
+	return v
+}
+
+func (opts listingOptions) link(base string, label string) ListingLink {
+	u := url.URL{Path: base, RawQuery: opts.query().Encode()}
+	return ListingLink{Href: u.String(), Label: label}
+}
+
+// sortLinks returns links to the listing in each sort order. The link of the
+// current order reverses it.
+func (opts listingOptions) sortLinks(base string) []ListingLink {
+	var links []ListingLink
+	for _, name := range sortNames {
+		if name == "relevance" && !opts.relevance {
+			continue
+		}
+		other := opts
+		other.Sort = name
+		other.Page = 1
+		label := name
+		if name == opts.Sort {
+			other.Desc = !opts.Desc
+			label += " ▲"
+			if opts.Desc {
+				label = name + " ▼"
+			}
+		} else {
+			other.Desc = name == "relevance"
+		}
+		links = append(links, other.link(base, label))
+	}
+	return links
+}
+
+// pageLinks returns links to the previous and next page around the current
+// one, or nothing if all of the total hits fit on one page.
+func (opts listingOptions) pageLinks(base string, total int) []ListingLink {
+	pages := (total + opts.PerPage - 1) / opts.PerPage
+	if pages <= 1 {
+		return nil
+	}
+	var links []ListingLink
+	if opts.Page > 1 {
+		prev := opts
+		prev.Page--
+		links = append(links, prev.link(base, "« previous"))
+	}
+	links = append(links, ListingLink{
+		Current: true,
+		Label:   "page " + strconv.Itoa(opts.Page) + " of " + strconv.Itoa(pages),
+	})
+	if opts.Page < pages {
+		next := opts
+		next.Page++
+		links = append(links, next.link(base, "next »"))
+	}
+	return links
+}
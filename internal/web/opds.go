@@ -0,0 +1,448 @@
+package web
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatalbanana/filetundra/internal/env"
+	"github.com/fatalbanana/filetundra/internal/idx"
+	"github.com/fatalbanana/filetundra/internal/log"
+	"github.com/fatalbanana/filetundra/internal/properties"
+
+	"github.com/blugelabs/bluge"
+	"github.com/blugelabs/bluge/search"
+	"go.uber.org/zap"
+)
+
+const (
+	opdsNavigationType  = "application/atom+xml;profile=opds-catalog;kind=navigation"
+	opdsAcquisitionType = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+	openSearchType      = "application/opensearchdescription+xml"
+)
+
+// opdsPageSize is the number of entries per page of a feed, and of books in
+// the recently added feed.
+var opdsPageSize = 50
+
+var errInvalidPage = errors.New("invalid page")
+
+type atomLink struct {
+	Rel   string `xml:"rel,attr,omitempty"`
+	Href  string `xml:"href,attr"`
+	Type  string `xml:"type,attr,omitempty"`
+	Title string `xml:"title,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Title      string       `xml:"title"`
+	ID         string       `xml:"id"`
+	Updated    string       `xml:"updated"`
+	Authors    []atomAuthor `xml:"author"`
+	Language   string       `xml:"dc:language,omitempty"`
+	Identifier string       `xml:"dc:identifier,omitempty"`
+	Content    *atomContent `xml:"content"`
+	Links      []atomLink   `xml:"link"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	DCNS    string      `xml:"xmlns:dc,attr"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type openSearchURL struct {
+	Rel      string `xml:"rel,attr,omitempty"`
+	Type     string `xml:"type,attr"`
+	Method   string `xml:"method,attr,omitempty"`
+	Template string `xml:"template,attr"`
+}
+
+type openSearchDescription struct {
+	XMLName       xml.Name        `xml:"http://a9.com/-/spec/opensearch/1.1/ OpenSearchDescription"`
+	ShortName     string          `xml:"ShortName"`
+	Description   string          `xml:"Description"`
+	InputEncoding string          `xml:"InputEncoding"`
+	URLs          []openSearchURL `xml:"Url"`
+}
+
+func opdsHref(p string, query url.Values) string {
+	u := url.URL{Path: p, RawQuery: query.Encode()}
+	return u.String()
+}
+
+func atomTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// newFeed returns a feed linking to the catalog root and search.
+func newFeed(id string, title string, self string, kind string) atomFeed {
+	return atomFeed{
+		DCNS:  "http://purl.org/dc/elements/1.1/",
+		ID:    "urn:filetundra:opds:" + id,
+		Title: title,
+		Links: []atomLink{
+			{Rel: "self", Href: self, Type: kind},
+			{Rel: "start", Href: "/opds", Type: opdsNavigationType},
+			{Rel: "search", Href: "/opds/opensearch.xml", Type: openSearchType},
+		},
+	}
+}
+
+// bookMimeType returns the media type e-readers expect for a book.
+func bookMimeType(fi idx.FileInfo) string {
+	if fi.BookFormat == idx.BookFormatCBZ {
+		return "application/vnd.comicbook+zip"
+	}
+	return fi.MimeType
+}
+
+func bookEntry(fi idx.FileInfo) atomEntry {
+	virtualPath := strings.TrimPrefix(fi.Filename, env.Env.Root)
+	entry := atomEntry{
+		Title:    fi.BookTitle,
+		ID:       "urn:filetundra:book:" + virtualPath,
+		Updated:  atomTime(fi.ModTime),
+		Language: fi.BookLanguage,
+		Links: []atomLink{{
+			Rel:  "http://opds-spec.org/acquisition",
+			Href: path.Join("/download", virtualPath),
+			Type: bookMimeType(fi),
+		}},
+	}
+	if entry.Title == "" {
+		entry.Title = fi.BareBasename + fi.Extname
+	}
+	for _, author := range fi.BookAuthors {
+		entry.Authors = append(entry.Authors, atomAuthor{Name: author})
+	}
+	if fi.BookISBN != "" {
+		entry.Identifier = "urn:isbn:" + fi.BookISBN
+	}
+	if fi.BookSeries != "" {
+		entry.Content = &atomContent{Type: "text", Text: bookSeries(fi)}
+	}
+	if fi.BookCover {
+		cover := coverPath(virtualPath)
+		entry.Links = append(entry.Links,
+			atomLink{Rel: "http://opds-spec.org/image", Href: cover},
+			atomLink{Rel: "http://opds-spec.org/image/thumbnail", Href: cover})
+	}
+	return entry
+}
+
+func navigationEntry(id string, title string, content string, href string, kind string, updated time.Time) atomEntry {
+	return atomEntry{
+		Title:   title,
+		ID:      "urn:filetundra:opds:" + id,
+		Updated: atomTime(updated),
+		Content: &atomContent{Type: "text", Text: content},
+		Links:   []atomLink{{Rel: "subsection", Href: href, Type: kind}},
+	}
+}
+
+// bookOrder lists books by series, position in the series and title.
+var bookOrder = []string{properties.FacetBookSeries, properties.BookSeriesIndex, properties.SortTitle, "_id"}
+
+// booksQuery returns a query for the indexed e-books matching query, or all
+// of them if query is nil.
+func booksQuery(query bluge.Query) bluge.Query {
+	books := bluge.NewBooleanQuery().
+		AddMust(bluge.NewWildcardQuery("*").SetField(properties.BookFormat))
+	if query != nil {
+		books.AddMust(query)
+	}
+	return books
+}
+
+// findBooks returns a page of the indexed e-books matching query in the given
+// order, and the number of all matching books.
+func findBooks(ctx context.Context, query bluge.Query, order []string, page int) ([]idx.FileInfo, int, error) {
+	reader, err := bluge.OpenReader(idx.BlugeConfig)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer reader.Close()
+
+	searchReq := bluge.NewTopNSearch(opdsPageSize, booksQuery(query)).
+		SetFrom((page - 1) * opdsPageSize).
+		SortBy(order).
+		WithStandardAggregations()
+	searchResults, err := reader.Search(ctx, searchReq)
+	if err != nil {
+		return nil, 0, err
+	}
+	var res []idx.FileInfo
+	var next *search.DocumentMatch
+	next, err = searchResults.Next()
+	for err == nil && next != nil {
+		var fi idx.FileInfo
+		fi, err = idx.DocumentMatchToFileInfo(reader, next)
+		if err != nil {
+			return nil, 0, err
+		}
+		res = append(res, fi)
+		next, err = searchResults.Next()
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return res, int(searchResults.Aggregations().Count()), nil
+}
+
+// lastUpdated returns the most recent modification time of the books
+// matching query, or the current time if there are none.
+func lastUpdated(ctx context.Context, query bluge.Query) (time.Time, error) {
+	books, _, err := findBooks(ctx, query, []string{"-" + properties.ModifiedTime}, 1)
+	if err != nil || len(books) == 0 {
+		return time.Now(), err
+	}
+	return books[0].ModTime, nil
+}
+
+// opdsPage returns the page of a feed requested by r.
+func opdsPage(r *http.Request) (int, error) {
+	s := r.URL.Query().Get("page")
+	if s == "" {
+		return 1, nil
+	}
+	page, err := strconv.Atoi(s)
+	if err != nil || !pageInRange(page, opdsPageSize) {
+		return 0, errInvalidPage
+	}
+	return page, nil
+}
+
+// addPageLinks links a feed to the pages before and after page, if the
+// total entries need them.
+func addPageLinks(feed *atomFeed, r *http.Request, kind string, page int, total int) {
+	link := func(rel string, page int) atomLink {
+		query := r.URL.Query()
+		query.Del("page")
+		if page > 1 {
+			query.Set("page", strconv.Itoa(page))
+		}
+		return atomLink{Rel: rel, Href: opdsHref(r.URL.Path, query), Type: kind}
+	}
+	if page > 1 {
+		feed.Links = append(feed.Links, link("previous", page-1))
+	}
+	if page*opdsPageSize < total {
+		feed.Links = append(feed.Links, link("next", page+1))
+	}
+}
+
+// bookFeed is an acquisition feed of a page of the books matching query.
+func bookFeed(r *http.Request, feed atomFeed, query bluge.Query, order []string) (atomFeed, error) {
+	page, err := opdsPage(r)
+	if err != nil {
+		return feed, err
+	}
+	books, total, err := findBooks(r.Context(), query, order, page)
+	if err != nil {
+		return feed, err
+	}
+	updated, err := lastUpdated(r.Context(), query)
+	if err != nil {
+		return feed, err
+	}
+	feed.Updated = atomTime(updated)
+	for _, fi := range books {
+		feed.Entries = append(feed.Entries, bookEntry(fi))
+	}
+	addPageLinks(&feed, r, opdsAcquisitionType, page, total)
+	return feed, nil
+}
+
+// bookGroups returns a page of the values of a book keyword field with the
+// number of books having each, and the number of all values.
+func bookGroups(field string, page int) ([]idx.Suggestion, int, error) {
+	reader, err := bluge.OpenReader(idx.BlugeConfig)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer reader.Close()
+
+	it, err := reader.DictionaryIterator(field, nil, nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer it.Close()
+
+	var res []idx.Suggestion
+	total := 0
+	first := (page - 1) * opdsPageSize
+	entry, err := it.Next()
+	for err == nil && entry != nil {
+		if entry.Count() > 0 {
+			if total >= first && len(res) < opdsPageSize {
+				res = append(res, idx.Suggestion{Value: entry.Term(), Count: entry.Count()})
+			}
+			total++
+		}
+		entry, err = it.Next()
+	}
+	return res, total, err
+}
+
+func booksCount(n uint64) string {
+	if n == 1 {
+		return "1 book"
+	}
+	return fmt.Sprintf("%d books", n)
+}
+
+// groupFeed lists the groups of books by the values of field, or the books of
+// the group named in the query.
+func groupFeed(r *http.Request, id string, title string, field string) (atomFeed, error) {
+	if name := r.URL.Query().Get("name"); name != "" {
+		feed := newFeed(id+":"+name, name, opdsHref(r.URL.Path, url.Values{"name": {name}}), opdsAcquisitionType)
+		return bookFeed(r, feed, bluge.NewTermQuery(name).SetField(field), bookOrder)
+	}
+	feed := newFeed(id, title, r.URL.Path, opdsNavigationType)
+	page, err := opdsPage(r)
+	if err != nil {
+		return feed, err
+	}
+	groups, total, err := bookGroups(field, page)
+	if err != nil {
+		return feed, err
+	}
+	updated, err := lastUpdated(r.Context(), nil)
+	if err != nil {
+		return feed, err
+	}
+	feed.Updated = atomTime(updated)
+	for _, group := range groups {
+		href := opdsHref(r.URL.Path, url.Values{"name": {group.Value}})
+		feed.Entries = append(feed.Entries, navigationEntry(id+":"+group.Value, group.Value,
+			booksCount(group.Count), href, opdsAcquisitionType, updated))
+	}
+	addPageLinks(&feed, r, opdsNavigationType, page, total)
+	return feed, nil
+}
+
+func rootFeed(r *http.Request) (atomFeed, error) {
+	updated, err := lastUpdated(r.Context(), nil)
+	if err != nil {
+		return atomFeed{}, err
+	}
+	feed := newFeed("root", "FileTundra", "/opds", opdsNavigationType)
+	feed.Updated = atomTime(updated)
+	feed.Entries = []atomEntry{
+		navigationEntry("authors", "Authors", "Books by author", "/opds/authors", opdsNavigationType, updated),
+		navigationEntry("series", "Series", "Books by series", "/opds/series", opdsNavigationType, updated),
+		navigationEntry("recent", "Recently added", "The most recently added books", "/opds/recent", opdsAcquisitionType, updated),
+	}
+	return feed, nil
+}
+
+func recentFeed(r *http.Request) (atomFeed, error) {
+	books, _, err := findBooks(r.Context(), nil, []string{"-" + properties.ModifiedTime, "_id"}, 1)
+	if err != nil {
+		return atomFeed{}, err
+	}
+	feed := newFeed("recent", "Recently added", "/opds/recent", opdsAcquisitionType)
+	feed.Updated = atomTime(time.Now())
+	if len(books) > 0 {
+		feed.Updated = atomTime(books[0].ModTime)
+	}
+	for _, fi := range books {
+		feed.Entries = append(feed.Entries, bookEntry(fi))
+	}
+	return feed, nil
+}
+
+func searchFeed(r *http.Request) (atomFeed, error) {
+	searchQ := r.URL.Query().Get("q")
+	query := bluge.NewBooleanQuery()
+	query.AddShould(bluge.NewMatchQuery(searchQ).SetField(properties.BookTitle).SetAnalyzer(idx.BlugeAnalyzer))
+	query.AddShould(bluge.NewMatchQuery(searchQ).SetField(properties.BookAuthor))
+	query.AddShould(bluge.NewMatchQuery(searchQ).SetField(properties.BookSeries))
+	query.AddShould(bluge.NewMatchQuery(searchQ).SetField(properties.BareBasename).SetAnalyzer(idx.BlugeAnalyzer))
+	feed := newFeed("search:"+searchQ, "Search results for "+searchQ,
+		opdsHref("/opds/search", url.Values{"q": {searchQ}}), opdsAcquisitionType)
+	return bookFeed(r, feed, query, bookOrder)
+}
+
+func writeXML(w http.ResponseWriter, contentType string, v interface{}) {
+	w.Header().Set("Content-Type", contentType+";charset=utf-8")
+	_, err := w.Write([]byte(xml.Header))
+	if err == nil {
+		enc := xml.NewEncoder(w)
+		enc.Indent("", "  ")
+		err = enc.Encode(v)
+	}
+	if err != nil {
+		log.Logger.Error("error writing OPDS response", zap.Error(err))
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func opdsHandler(w http.ResponseWriter, r *http.Request) {
+	var feed atomFeed
+	var err error
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case "/opds":
+		feed, err = rootFeed(r)
+	case "/opds/authors":
+		feed, err = groupFeed(r, "authors", "Authors", properties.FacetBookAuthor)
+	case "/opds/series":
+		feed, err = groupFeed(r, "series", "Series", properties.FacetBookSeries)
+	case "/opds/recent":
+		feed, err = recentFeed(r)
+	case "/opds/search":
+		feed, err = searchFeed(r)
+	case "/opds/opensearch.xml":
+		writeXML(w, openSearchType, openSearchDescription{
+			ShortName:     "FileTundra",
+			Description:   "Search the books of FileTundra",
+			InputEncoding: "UTF-8",
+			URLs: []openSearchURL{{
+				Type:     opdsAcquisitionType,
+				Template: requestBaseURL(r) + "/opds/search?q={searchTerms}",
+			}},
+		})
+		return
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err == errInvalidPage {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Logger.Error("error building OPDS feed",
+			zap.String("path", r.URL.Path), zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	kind := opdsNavigationType
+	for _, link := range feed.Links {
+		if link.Rel == "self" {
+			kind = link.Type
+		}
+	}
+	writeXML(w, kind, feed)
+}
@@ -0,0 +1,180 @@
+package web
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOPDS(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(opdsHandler))
+	defer ts.Close()
+
+	client := ts.Client()
+	tests := []struct {
+		path        string
+		status      int
+		contentType string
+		// titles of the feed entries in order
+		entries []string
+	}{
+		{"/opds", http.StatusOK, opdsNavigationType, []string{"Authors", "Series", "Recently added"}},
+		{"/opds/authors", http.StatusOK, opdsNavigationType, []string{"Ann Writer", "Terry Pratchett"}},
+		{"/opds/authors?name=Terry+Pratchett", http.StatusOK, opdsAcquisitionType,
+			[]string{"The Colour of Magic", "The Light Fantastic"}},
+		{"/opds/series", http.StatusOK, opdsNavigationType, []string{"Astro Kid", "Discworld"}},
+		{"/opds/series?name=Astro+Kid", http.StatusOK, opdsAcquisitionType, []string{"Origins"}},
+		{"/opds/search?q=fantastic", http.StatusOK, opdsAcquisitionType, []string{"The Light Fantastic"}},
+		{"/opds/search?q=pratchett", http.StatusOK, opdsAcquisitionType,
+			[]string{"The Colour of Magic", "The Light Fantastic"}},
+		{"/opds/opensearch.xml", http.StatusOK, openSearchType, nil},
+		{"/opds/missing", http.StatusNotFound, "", nil},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		responseBytes, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.status {
+			t.Fatalf("unexpected HTTP status for %s: got %d expected %d",
+				tt.path, resp.StatusCode, tt.status)
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, tt.contentType+";") {
+			t.Fatalf("unexpected content type for %s: got %s expected %s", tt.path, ct, tt.contentType)
+		}
+		if tt.contentType == openSearchType {
+			// clients don't all resolve relative templates
+			if template := `template="` + ts.URL + `/opds/search?q={searchTerms}"`; !strings.Contains(string(responseBytes), template) {
+				t.Fatalf("OpenSearch description doesn't contain %s:\n%s", template, responseBytes)
+			}
+			continue
+		}
+		var feed atomFeed
+		err = xml.Unmarshal(responseBytes, &feed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var titles []string
+		for _, entry := range feed.Entries {
+			titles = append(titles, entry.Title)
+		}
+		if !reflect.DeepEqual(titles, tt.entries) {
+			t.Fatalf("unexpected entries for %s: got %v expected %v", tt.path, titles, tt.entries)
+		}
+	}
+}
+
+func TestOPDSBookEntry(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(opdsHandler))
+	defer ts.Close()
+
+	resp, err := ts.Client().Get(ts.URL + "/opds/series?name=Discworld")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`xmlns:dc="http://purl.org/dc/elements/1.1/"`,
+		`<dc:identifier>urn:isbn:0552124753</dc:identifier>`,
+		`<dc:language>en</dc:language>`,
+		`<content type="text">Discworld #1</content>`,
+		`<link rel="http://opds-spec.org/acquisition" href="/download/books/colour.epub" type="application/epub+zip"></link>`,
+		`<link rel="http://opds-spec.org/image/thumbnail" href="/cover/books/colour.epub"></link>`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Fatalf("feed does not contain %s:\n%s", expected, body)
+		}
+	}
+}
+
+func TestOPDSPages(t *testing.T) {
+	pageSize := opdsPageSize
+	opdsPageSize = 1
+	defer func() {
+		opdsPageSize = pageSize
+	}()
+
+	ts := httptest.NewServer(http.HandlerFunc(opdsHandler))
+	defer ts.Close()
+
+	client := ts.Client()
+	tests := []struct {
+		path    string
+		status  int
+		entries []string
+		// links to the other pages by relation
+		links map[string]string
+	}{
+		{"/opds/authors", http.StatusOK, []string{"Ann Writer"},
+			map[string]string{"next": "/opds/authors?page=2"}},
+		{"/opds/authors?page=2", http.StatusOK, []string{"Terry Pratchett"},
+			map[string]string{"previous": "/opds/authors"}},
+		{"/opds/authors?name=Terry+Pratchett&page=2", http.StatusOK, []string{"The Light Fantastic"},
+			map[string]string{"previous": "/opds/authors?name=Terry+Pratchett"}},
+		{"/opds/search?q=pratchett", http.StatusOK, []string{"The Colour of Magic"},
+			map[string]string{"next": "/opds/search?page=2&q=pratchett"}},
+		{"/opds/series?page=0", http.StatusBadRequest, nil, nil},
+		{"/opds/series?page=10002", http.StatusBadRequest, nil, nil},
+		{"/opds/authors?name=Terry+Pratchett&page=9223372036854775807", http.StatusBadRequest, nil, nil},
+	}
+	for _, tt := range tests {
+		resp, err := client.Get(ts.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		responseBytes, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.status {
+			t.Fatalf("unexpected HTTP status for %s: got %d expected %d",
+				tt.path, resp.StatusCode, tt.status)
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		var feed atomFeed
+		err = xml.Unmarshal(responseBytes, &feed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var titles []string
+		for _, entry := range feed.Entries {
+			titles = append(titles, entry.Title)
+		}
+		if !reflect.DeepEqual(titles, tt.entries) {
+			t.Fatalf("unexpected entries for %s: got %v expected %v", tt.path, titles, tt.entries)
+		}
+		links := make(map[string]string)
+		for _, link := range feed.Links {
+			if link.Rel == "next" || link.Rel == "previous" {
+				links[link.Rel] = link.Href
+			}
+		}
+		if !reflect.DeepEqual(links, tt.links) {
+			t.Fatalf("unexpected page links for %s: got %v expected %v", tt.path, links, tt.links)
+		}
+	}
+}
@@ -3,31 +3,63 @@ package web
 import (
 	"html/template"
 	"net/http"
+	"net/url"
 	"path"
+	"path/filepath"
 	"strings"
 
 	"github.com/fatalbanana/filetundra/internal/env"
 	"github.com/fatalbanana/filetundra/internal/idx"
 	"github.com/fatalbanana/filetundra/internal/log"
 	"github.com/fatalbanana/filetundra/internal/properties"
+	"github.com/fatalbanana/filetundra/internal/query"
 
 	"github.com/blugelabs/bluge"
 	"github.com/blugelabs/bluge/search"
 	"go.uber.org/zap"
 )
 
-func searchHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "expected POST", http.StatusMethodNotAllowed)
-		return
+// parseSearch compiles the query of a search narrowed by its filters and
+// directory.
+func parseSearch(opts listingOptions) (bluge.Query, error) {
+	searchQuery, err := query.Parse(opts.Query)
+	if err != nil || (len(opts.Filters) == 0 && opts.In == "") {
+		return searchQuery, err
+	}
+	filtered := bluge.NewBooleanQuery().AddMust(searchQuery)
+	if opts.In != "" {
+		filtered.AddMust(bluge.NewTermQuery(filepath.Join(env.Env.Root, opts.In)).SetField(properties.Ancestor))
+	}
+	for _, filter := range opts.Filters {
+		filterQuery, err := query.Parse(filter)
+		if err != nil {
+			return nil, err
+		}
+		filtered.AddMust(filterQuery)
 	}
+	return filtered, nil
+}
 
+// searchHandler shows the results of GET /search?q=... Posted searches are
+// redirected there, so that results can be bookmarked and reloaded.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		redirectSearch(w, r)
+		return
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "expected GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+
 	t, err := template.New("browse").Parse(browseTemplate)
 	if err != nil {
 		log.Logger.Error("error preparing browse template",
@@ -44,18 +76,22 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer reader.Close()
 
-	searchQ := r.Form.Get("search")
-	basenameSearch := bluge.NewMatchQuery(searchQ).SetField(properties.BareBasename).SetAnalyzer(idx.BlugeAnalyzer)
-	fuzzyBasenameSearch := bluge.NewFuzzyQuery(searchQ).SetField(properties.BareBasename)
-	dirnameSearch := bluge.NewFuzzyQuery(searchQ).SetField(properties.Dirname)
-	archiveSearch := bluge.NewFuzzyQuery(searchQ).SetField(properties.ArchiveFilename)
-	query := bluge.NewBooleanQuery()
-	query.AddShould(basenameSearch)
-	query.AddShould(fuzzyBasenameSearch)
-	query.AddShould(dirnameSearch)
-	query.AddShould(archiveSearch)
+	opts, err := parseListingOptions(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	searchQuery, err := parseSearch(opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	searchReq := bluge.NewAllMatches(query)
+	searchReq := opts.search(searchQuery).IncludeLocations()
+	if opts.Explain {
+		searchReq.ExplainScores()
+	}
+	addFacetAggregations(searchReq)
 	searchResults, err := reader.Search(r.Context(), searchReq)
 	if err != nil {
 		log.Logger.Error("search error", zap.Error(err))
@@ -64,8 +100,9 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	res := DirectoryListing{
-		Autoback:    true,
-		SearchValue: searchQ,
+		Back:        path.Join("/browse", opts.In),
+		Scope:       opts.In,
+		SearchValue: opts.Query,
 	}
 	var next *search.DocumentMatch
 	var fi idx.FileInfo
@@ -79,18 +116,91 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		properBasename := fi.BareBasename + fi.Extname
 		fileRes := DirectoryListingFile{
-			Name:  properBasename,
-			Image: getImage(fi.MimeType),
-			Path:  path.Join("/download", strings.TrimPrefix(fi.Filename, env.Env.Root)),
+			Details: fileDetails(fi),
+			Name:    properBasename,
+			Image:   getImage(fi.MimeType),
+			Path:    path.Join("/download", strings.TrimPrefix(fi.Filename, env.Env.Root)),
+		}
+		if idx.IsArchive(fi.MimeType) {
+			fileRes.Browse = path.Join("/browse", strings.TrimPrefix(fi.Filename, env.Env.Root))
+		}
+		if fi.AudioArtwork || fi.BookCover {
+			fileRes.Image = coverPath(strings.TrimPrefix(fi.Filename, env.Env.Root))
+			fileRes.Cover = true
+		}
+		fileRes.Highlights, err = highlights(reader, next)
+		if err != nil {
+			log.Logger.Error("highlight error", zap.Error(err))
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		if next.Explanation != nil {
+			fileRes.Explanation = formatExplanation(next.Explanation)
 		}
 		res.Files = append(res.Files, fileRes)
 		next, err = searchResults.Next()
 	}
+	if err != nil {
+		log.Logger.Error("search error", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	res.Total = int(searchResults.Aggregations().Count())
+	res.Sorts = opts.sortLinks("/search")
+	res.Pages = opts.pageLinks("/search", res.Total)
+	res.Facets = facets(searchResults.Aggregations(), opts, "/search")
 
 	err = t.Execute(w, res)
 	if err != nil {
 		log.Logger.Error("error rendering template", zap.Error(err))
 		panic(http.ErrAbortHandler)
 	}
+}
 
+// redirectSearch sends a posted search to its GET URL. The query is read
+// from q, or from search as posted by earlier versions of the search form.
+func redirectSearch(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query()
+	for _, key := range []string{"in", "everywhere"} {
+		if r.PostForm.Has(key) {
+			v.Set(key, r.PostForm.Get(key))
+		}
+	}
+	q := r.PostForm.Get("q")
+	if q == "" {
+		q = r.PostForm.Get("search")
+	}
+	if q != "" || v.Get("q") == "" {
+		v.Set("q", q)
+	}
+	u := url.URL{Path: "/search", RawQuery: v.Encode()}
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
+
+// openSearchHandler serves the OpenSearch description which lets browsers add
+// the search as a search engine.
+func openSearchHandler(w http.ResponseWriter, r *http.Request) {
+	base := requestBaseURL(r)
+	writeXML(w, openSearchType, openSearchDescription{
+		ShortName:     "FileTundra",
+		Description:   "Search the files of FileTundra",
+		InputEncoding: "UTF-8",
+		URLs: []openSearchURL{
+			{Type: "text/html", Method: "get", Template: base + "/search?q={searchTerms}"},
+			{Type: suggestionsType, Method: "get", Template: base + "/suggest?q={searchTerms}&format=opensearch"},
+			{Rel: "self", Type: openSearchType, Template: base + "/opensearch.xml"},
+		},
+	})
+}
+
+// requestBaseURL returns the scheme and host the request was made to.
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
 }
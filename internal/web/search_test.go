@@ -0,0 +1,393 @@
+package web
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(searchHandler))
+	defer ts.Close()
+
+	client := ts.Client()
+	tests := []struct {
+		query    string
+		status   int
+		expected []string
+		excluded []string
+	}{
+		{"ext:.epub", http.StatusOK, []string{"colour.epub", "light.epub"}, []string{"astro.cbz"}},
+		{"author:pratchett -title:magic", http.StatusOK, []string{"light.epub"}, []string{"colour.epub"}},
+		{"mime:audio/* artist:lewis", http.StatusOK, []string{"tone.mp3"}, []string{"colour.epub"}},
+		{"ext:.cbz size:<1M modified:>2000", http.StatusOK, []string{"astro.cbz"}, []string{"colour.epub"}},
+		{"ext:.cbz size:>1G", http.StatusOK, nil, []string{"astro.cbz"}},
+		{"size:>lots", http.StatusBadRequest, nil, nil},
+		{strings.Repeat("(", 100000), http.StatusBadRequest, nil, nil},
+	}
+	for _, tt := range tests {
+		resp, err := client.Get(ts.URL + "?" + url.Values{"q": {tt.query}}.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		responseBytes, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.status {
+			t.Fatalf("unexpected HTTP status for %q: got %d expected %d",
+				tt.query, resp.StatusCode, tt.status)
+		}
+		for _, name := range tt.expected {
+			if !strings.Contains(string(responseBytes), ">"+name+"<") {
+				t.Fatalf("results for %q don't contain %s", tt.query, name)
+			}
+		}
+		for _, name := range tt.excluded {
+			if strings.Contains(string(responseBytes), ">"+name+"<") {
+				t.Fatalf("results for %q contain %s", tt.query, name)
+			}
+		}
+	}
+}
+
+func TestSearchSortAndPages(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(searchHandler))
+	defer ts.Close()
+
+	client := ts.Client()
+	tests := []struct {
+		query    string
+		names    []string
+		expected []string
+	}{
+		{"sort=name&per_page=2", []string{"astro.cbz", "colour.epub"}, []string{
+			`3 entries · sort by <a href="/search?per_page=2&amp;q=dir%3A%2Fbooks">relevance</a>`,
+			`<a href="/search?page=2&amp;per_page=2&amp;q=dir%3A%2Fbooks&amp;sort=name">next »</a>`,
+		}},
+		{"sort=size&order=desc&page=2&per_page=2", []string{"astro.cbz"}, []string{
+			`<span>page 2 of 2</span>`,
+		}},
+	}
+	for _, tt := range tests {
+		resp, err := client.Get(ts.URL + "?q=dir:/books&" + tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		responseBytes, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected HTTP status for %s: got %d expected %d",
+				tt.query, resp.StatusCode, http.StatusOK)
+		}
+		if names := listingNames(responseBytes); !reflect.DeepEqual(names, tt.names) {
+			t.Fatalf("unexpected results for %s: got %v expected %v", tt.query, names, tt.names)
+		}
+		for _, expected := range tt.expected {
+			if !strings.Contains(string(responseBytes), expected) {
+				t.Fatalf("response for %s didn't contain %s:\n%s", tt.query, expected, responseBytes)
+			}
+		}
+	}
+}
+
+func TestSearchFacets(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(searchHandler))
+	defer ts.Close()
+
+	client := ts.Client()
+	tests := []struct {
+		search   string
+		params   string
+		names    []string
+		expected []string
+	}{
+		{"dir:/books", "", []string{"colour.epub", "light.epub", "astro.cbz"}, []string{
+			`Type: <a href="/search?filter=type%3Aapplication&amp;q=dir%3A%2Fbooks">application</a> (3)`,
+			`Extension: <a href="/search?filter=ext%3A%22.epub%22&amp;q=dir%3A%2Fbooks">.epub</a> (2) · ` +
+				`<a href="/search?filter=ext%3A%22.cbz%22&amp;q=dir%3A%2Fbooks">.cbz</a> (1)`,
+			`<p class="facets">Year: `,
+		}},
+		{"dir:/books", "sort=name&filter=ext:%22.epub%22", []string{"colour.epub", "light.epub"}, []string{
+			`Extension: <b><a href="/search?q=dir%3A%2Fbooks&amp;sort=name">.epub</a></b> (2)</p>`,
+		}},
+		{"tones", "", []string{"tone.mp3"}, []string{
+			`Artist: <a href="/search?filter=artist.exact%3A%22Andrew&#43;Lewis%22&amp;q=tones">Andrew Lewis</a> (1)`,
+			`Album: <a href="/search?filter=album.exact%3A%22Tones&#43;of&#43;the&#43;DTMF%22&amp;q=tones">Tones of the DTMF</a> (1)`,
+		}},
+		{"mime:audio/*", "filter=artist.exact:%22Andrew+Lewis%22", []string{"tone.mp3", "embedded.mp3", "plain.mp3"}, nil},
+		{"mime:audio/*", "filter=artist.exact:%22andrew+lewis%22", nil, nil},
+		{"dir:/books", "filter=type:application&filter=ext:%22.cbz%22", []string{"astro.cbz"}, nil},
+	}
+	for _, tt := range tests {
+		resp, err := client.Get(ts.URL + "?q=" + url.QueryEscape(tt.search) + "&" + tt.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		responseBytes, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected HTTP status for %q: got %d expected %d",
+				tt.search, resp.StatusCode, http.StatusOK)
+		}
+		names := listingNames(responseBytes)
+		sort.Strings(names)
+		sort.Strings(tt.names)
+		if !reflect.DeepEqual(names, tt.names) {
+			t.Fatalf("unexpected results for %q&%s: got %v expected %v", tt.search, tt.params, names, tt.names)
+		}
+		for _, expected := range tt.expected {
+			if !strings.Contains(string(responseBytes), expected) {
+				t.Fatalf("response for %q didn't contain %s:\n%s", tt.search, expected, responseBytes)
+			}
+		}
+	}
+}
+
+func TestSearchHighlights(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(searchHandler))
+	defer ts.Close()
+
+	client := ts.Client()
+	tests := []struct {
+		search   string
+		params   string
+		expected []string
+		absent   []string
+	}{
+		{"tones", "", []string{
+			`<small class="highlight">album: <mark>Tones</mark> of the DTMF</small>`,
+		}, []string{`<pre class="explain">`}},
+		{"dir:/books", "", []string{
+			`<small class="highlight">directory: <mark>/books</mark></small>`,
+		}, nil},
+		{"archive:inner.txt", "", []string{
+			`<small class="highlight">archive: dir/<mark>inner.txt</mark></small>`,
+		}, nil},
+		{"content:bbb", "", []string{
+			`<small class="highlight">content: <mark>bbb</mark>`,
+		}, nil},
+		{"tones", "explain=1", []string{
+			`<pre class="explain">`,
+			`<a href="/search?explain=1&amp;q=tones&amp;sort=name">name</a>`,
+		}, nil},
+	}
+	for _, tt := range tests {
+		resp, err := client.Get(ts.URL + "?q=" + url.QueryEscape(tt.search) + "&" + tt.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		responseBytes, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, expected := range tt.expected {
+			if !strings.Contains(string(responseBytes), expected) {
+				t.Fatalf("response for %q didn't contain %s:\n%s", tt.search, expected, responseBytes)
+			}
+		}
+		for _, absent := range tt.absent {
+			if strings.Contains(string(responseBytes), absent) {
+				t.Fatalf("response for %q unexpectedly contained %s:\n%s", tt.search, absent, responseBytes)
+			}
+		}
+	}
+}
+
+func TestSearchScope(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(searchHandler))
+	defer ts.Close()
+
+	client := ts.Client()
+	tests := []struct {
+		params   string
+		names    []string
+		expected []string
+	}{
+		{"in=/album", []string{"embedded.mp3", "plain.mp3"}, []string{
+			`<a href="/browse/album">`,
+			`<input type="hidden" name="in" value="/album">`,
+			`<a href="/search?in=%2Falbum&amp;q=mime%3Aaudio%2F%2A">relevance</a>`,
+		}},
+		{"in=album/", []string{"embedded.mp3", "plain.mp3"}, nil},
+		{"in=/album&everywhere=1", []string{"embedded.mp3", "plain.mp3", "tone.mp3"}, nil},
+		{"in=/", []string{"embedded.mp3", "plain.mp3", "tone.mp3"}, nil},
+		{"in=/alb", nil, nil},
+		{"in=/album/plain.mp3", nil, nil},
+	}
+	for _, tt := range tests {
+		resp, err := client.Get(ts.URL + "?q=mime:audio/*&sort=name&" + tt.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		responseBytes, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names := listingNames(responseBytes); !reflect.DeepEqual(names, tt.names) {
+			t.Fatalf("unexpected results for %s: got %v expected %v", tt.params, names, tt.names)
+		}
+		for _, expected := range tt.expected {
+			if !strings.Contains(string(responseBytes), expected) {
+				t.Fatalf("response for %s didn't contain %s:\n%s", tt.params, expected, responseBytes)
+			}
+		}
+	}
+}
+
+func TestSearchRedirect(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(searchHandler))
+	defer ts.Close()
+
+	client := ts.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	tests := []struct {
+		method   string
+		params   string
+		form     url.Values
+		status   int
+		location string
+	}{
+		{http.MethodPost, "", url.Values{"q": {"ext:.epub"}}, http.StatusSeeOther, "/search?q=ext%3A.epub"},
+		{http.MethodPost, "?sort=name", url.Values{"search": {"tones"}}, http.StatusSeeOther, "/search?q=tones&sort=name"},
+		{http.MethodPost, "?q=tones", nil, http.StatusSeeOther, "/search?q=tones"},
+		{http.MethodPost, "", url.Values{"q": {"tones"}, "in": {"/album"}}, http.StatusSeeOther, "/search?in=%2Falbum&q=tones"},
+		{http.MethodGet, "?q=tones", nil, http.StatusOK, ""},
+		{http.MethodDelete, "?q=tones", nil, http.StatusMethodNotAllowed, ""},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, ts.URL+tt.params, strings.NewReader(tt.form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Fatalf("unexpected HTTP status for %s %s: got %d expected %d",
+				tt.method, tt.params, resp.StatusCode, tt.status)
+		}
+		if location := resp.Header.Get("Location"); location != tt.location {
+			t.Fatalf("unexpected location for %s %s: got %s expected %s",
+				tt.method, tt.params, location, tt.location)
+		}
+	}
+}
+
+func TestOpenSearch(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(openSearchHandler))
+	defer ts.Close()
+
+	resp, err := ts.Client().Get(ts.URL + "/opensearch.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	responseBytes, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, openSearchType) {
+		t.Fatalf("unexpected content type: got %s expected %s", contentType, openSearchType)
+	}
+	for _, expected := range []string{
+		`<Url type="text/html" method="get" template="` + ts.URL + `/search?q={searchTerms}"></Url>`,
+		`<Url type="` + suggestionsType + `" method="get" template="` + ts.URL + `/suggest?q={searchTerms}&amp;format=opensearch"></Url>`,
+	} {
+		if !strings.Contains(string(responseBytes), expected) {
+			t.Fatalf("description didn't contain %s:\n%s", expected, responseBytes)
+		}
+	}
+}
+
+func TestSuggest(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(suggestHandler))
+	defer ts.Close()
+
+	client := ts.Client()
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"andrew", []string{`artist:"Andrew Lewis"`}},
+		{"ton", []string{"tone", `album:"Tones of the DTMF"`}},
+		{"mime:audio/* ARTIST:and", []string{`mime:audio/* artist:"Andrew Lewis"`}},
+		{"dir:/b", []string{"dir:/books"}},
+		{"dir:aa", []string{"dir:/aaa"}},
+		{"dir:/books/", []string{}},
+		{"-albu", []string{"-album", "-dir:/album"}},
+		{`name:"col`, []string{"name:colour"}},
+		{"size:>1", []string{}},
+		{"andrew ", []string{}},
+		{"", []string{}},
+	}
+	for _, tt := range tests {
+		resp, err := client.Get(ts.URL + "?" + url.Values{"q": {tt.query}}.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res suggestResults
+		err = json.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		texts := make([]string, 0)
+		for _, s := range res.Suggestions {
+			texts = append(texts, s.Text)
+		}
+		if !reflect.DeepEqual(texts, tt.expected) {
+			t.Fatalf("unexpected suggestions for %q: got %q expected %q", tt.query, texts, tt.expected)
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"?q=andrew", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", suggestionsType)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responseBytes, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != suggestionsType {
+		t.Fatalf("unexpected content type: got %s expected %s", contentType, suggestionsType)
+	}
+	expected := `["andrew",["artist:\"Andrew Lewis\""],["artist, 3 files"],["` + ts.URL + `/search?q=artist%3A%22Andrew+Lewis%22"]]`
+	if strings.TrimSpace(string(responseBytes)) != expected {
+		t.Fatalf("unexpected OpenSearch suggestions: got %s expected %s", responseBytes, expected)
+	}
+}
@@ -25,6 +25,7 @@ import (
 //go:embed static/icons/spreadsheet.svg
 //go:embed static/icons/text.svg
 //go:embed static/icons/video.svg
+//go:embed static/js/suggest.js
 
 var efs embed.FS
 
@@ -37,6 +38,8 @@ func staticHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	if strings.HasPrefix(virtualPath, "static/icons/") {
 		w.Header().Set("Content-type", "image/svg+xml")
+	} else if strings.HasPrefix(virtualPath, "static/js/") {
+		w.Header().Set("Content-type", "text/javascript")
 	}
 	_, err = io.Copy(w, f)
 	if err != nil {
@@ -0,0 +1,54 @@
+// Offers completions of the search query from /suggest in the datalist of
+// the search field. Without this script the search form works as before.
+(function () {
+	"use strict";
+
+	var input = document.getElementById("search");
+	var list = document.getElementById("suggestions");
+	if (!input || !list || !window.fetch) {
+		return;
+	}
+
+	var timer = null;
+	var controller = null;
+
+	function show(suggestions) {
+		while (list.firstChild) {
+			list.removeChild(list.firstChild);
+		}
+		suggestions.forEach(function (s) {
+			var option = document.createElement("option");
+			option.value = s.text;
+			option.label = s.kind + " (" + s.count + ")";
+			list.appendChild(option);
+		});
+	}
+
+	function suggest() {
+		var q = input.value;
+		if (controller) {
+			controller.abort();
+		}
+		if (q.trim() === "") {
+			show([]);
+			return;
+		}
+		controller = window.AbortController ? new AbortController() : null;
+		fetch("/suggest?q=" + encodeURIComponent(q), {
+			headers: {"Accept": "application/json"},
+			signal: controller ? controller.signal : undefined
+		}).then(function (resp) {
+			return resp.ok ? resp.json() : {suggestions: []};
+		}).then(function (res) {
+			// ignore answers to queries which have since changed
+			if (res.query === input.value) {
+				show(res.suggestions);
+			}
+		}).catch(function () {});
+	}
+
+	input.addEventListener("input", function () {
+		clearTimeout(timer);
+		timer = setTimeout(suggest, 150);
+	});
+})();
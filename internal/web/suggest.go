@@ -0,0 +1,227 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/fatalbanana/filetundra/internal/idx"
+	"github.com/fatalbanana/filetundra/internal/log"
+	"github.com/fatalbanana/filetundra/internal/properties"
+
+	"github.com/blugelabs/bluge"
+	"go.uber.org/zap"
+)
+
+const (
+	suggestionsType = "application/x-suggestions+json"
+
+	// number of completions returned
+	suggestLimit = 10
+)
+
+// suggestSource is a suggestion field and the query field its values are
+// completed as, empty for free text.
+type suggestSource struct {
+	kind       string
+	field      string
+	queryField string
+}
+
+var suggestSources = []suggestSource{
+	{"name", properties.SuggestName, ""},
+	{"artist", properties.SuggestArtist, "artist"},
+	{"album", properties.SuggestAlbum, "album"},
+	{"dir", properties.SuggestDirectory, "dir"},
+}
+
+// suggestion is a completion of the whole query.
+type suggestion struct {
+	// the query with its last term completed
+	Text string `json:"text"`
+	// the value the last term was completed with
+	Value string `json:"value"`
+	Kind  string `json:"kind"`
+	// number of files with the value
+	Count uint64 `json:"count"`
+}
+
+type suggestResults struct {
+	Query       string       `json:"query"`
+	Suggestions []suggestion `json:"suggestions"`
+}
+
+// lastTerm splits a query before its last term and splits the field name,
+// if any, off the term. A leading - is kept in the head. A query ending in
+// a space has an empty last term.
+func lastTerm(q string) (head string, field string, value string) {
+	start := 0
+	inQuote := false
+	for i, r := range q {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+		case !inQuote && (unicode.IsSpace(r) || r == '(' || r == ')'):
+			start = i + len(string(r))
+		}
+	}
+	head, term := q[:start], q[start:]
+	if strings.HasPrefix(term, "-") {
+		head += "-"
+		term = term[1:]
+	}
+	if name, rest, found := strings.Cut(term, ":"); found && !strings.Contains(name, `"`) {
+		field = strings.ToLower(name)
+		term = rest
+	}
+	return head, field, strings.Trim(term, `"`)
+}
+
+// quoteTerm quotes a value which would otherwise not be read as one term.
+func quoteTerm(value string) string {
+	if strings.ContainsAny(value, "():") || strings.HasPrefix(value, "-") ||
+		strings.IndexFunc(value, unicode.IsSpace) >= 0 {
+		return `"` + value + `"`
+	}
+	return value
+}
+
+// suggestions returns the ranked completions of the last term of q.
+func suggestions(reader *bluge.Reader, q string) ([]suggestion, error) {
+	head, field, value := lastTerm(q)
+	if value == "" {
+		return nil, nil
+	}
+	var res []suggestion
+	seen := make(map[string]bool)
+	for _, src := range suggestSources {
+		if field != "" && field != src.kind {
+			continue
+		}
+		prefix := value
+		if src.kind == "dir" {
+			// directories are looked up by their name
+			prefix = path.Base(value)
+		}
+		values, err := idx.Suggest(reader, src.field, prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range values {
+			// quotes can't be part of a term
+			if strings.Contains(v.Value, `"`) {
+				continue
+			}
+			if src.kind == "dir" && strings.Contains(value, "/") &&
+				!strings.HasPrefix(strings.ToLower(v.Value), strings.ToLower(value)) {
+				continue
+			}
+			completion := quoteTerm(v.Value)
+			if field != "" || src.queryField != "" {
+				completion = src.kind + ":" + completion
+			}
+			text := head + completion
+			if seen[text] {
+				continue
+			}
+			seen[text] = true
+			res = append(res, suggestion{Text: text, Value: v.Value, Kind: src.kind, Count: v.Count})
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].Count != res[j].Count {
+			return res[i].Count > res[j].Count
+		}
+		if len(res[i].Value) != len(res[j].Value) {
+			return len(res[i].Value) < len(res[j].Value)
+		}
+		return res[i].Value < res[j].Value
+	})
+	if len(res) > suggestLimit {
+		res = res[:suggestLimit]
+	}
+	return res, nil
+}
+
+// wantsOpenSearchSuggestions reports whether the OpenSearch suggestions
+// format was asked for.
+func wantsOpenSearchSuggestions(r *http.Request) bool {
+	if r.Form.Get("format") == "opensearch" {
+		return true
+	}
+	for _, accept := range r.Header.Values("Accept") {
+		if strings.Contains(accept, suggestionsType) {
+			return true
+		}
+	}
+	return false
+}
+
+// suggestHandler completes the last term of GET /suggest?q=... from the
+// names, artists, albums and directories in the index.
+func suggestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "expected GET", http.StatusMethodNotAllowed)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reader, err := bluge.OpenReader(idx.BlugeConfig)
+	if err != nil {
+		log.Logger.Error("error opening reader", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+
+	q := r.Form.Get("q")
+	res, err := suggestions(reader, q)
+	if err != nil {
+		log.Logger.Error("suggestion error", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	if !wantsOpenSearchSuggestions(r) {
+		if res == nil {
+			res = make([]suggestion, 0)
+		}
+		writeJSON(w, http.StatusOK, suggestResults{Query: q, Suggestions: res})
+		return
+	}
+
+	// the OpenSearch suggestions format is the query followed by arrays of
+	// completions, their descriptions and their result URLs
+	base := requestBaseURL(r)
+	texts := make([]string, 0, len(res))
+	descriptions := make([]string, 0, len(res))
+	urls := make([]string, 0, len(res))
+	for _, s := range res {
+		texts = append(texts, s.Text)
+		descriptions = append(descriptions, fmt.Sprintf("%s, %d %s", s.Kind, s.Count, plural(s.Count, "file", "files")))
+		urls = append(urls, base+"/search?"+url.Values{"q": {s.Text}}.Encode())
+	}
+	w.Header().Set("Content-Type", suggestionsType)
+	err = json.NewEncoder(w).Encode([]interface{}{q, texts, descriptions, urls})
+	if err != nil {
+		log.Logger.Error("error writing suggestions", zap.Error(err))
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func plural(n uint64, one string, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
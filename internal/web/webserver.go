@@ -17,10 +17,15 @@ var (
 
 func RunWebserver() error {
 	router := mux.NewRouter()
+	router.PathPrefix("/api/v1").HandlerFunc(apiHandler)
 	router.PathPrefix("/browse").HandlerFunc(browseHandler)
+	router.PathPrefix("/cover").HandlerFunc(coverHandler)
 	router.PathPrefix("/download").HandlerFunc(downloadHandler)
+	router.PathPrefix("/opds").HandlerFunc(opdsHandler)
+	router.HandleFunc("/opensearch.xml", openSearchHandler)
 	router.HandleFunc("/search", searchHandler)
 	router.PathPrefix("/static").HandlerFunc(staticHandler)
+	router.HandleFunc("/suggest", suggestHandler)
 	Server = &http.Server{
 		Addr:              net.JoinHostPort(env.Env.HTTPAddress, fmt.Sprintf("%d", env.Env.HTTPPort)),
 		Handler:           router,
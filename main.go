@@ -65,25 +65,64 @@ func run(blugeDir string) bool {
 				zap.String("path", blugeDir), zap.Error(err))
 			return false
 		}
+	} else {
+		version, err := idx.ReadSchemaVersion(blugeDir)
+		if err != nil {
+			log.Logger.Error("failed to read index schema version",
+				zap.String("path", blugeDir), zap.Error(err))
+			return false
+		}
+		if version != idx.SchemaVersion {
+			log.Logger.Info("index schema changed, rebuilding index",
+				zap.Int("version", version), zap.Int("current", idx.SchemaVersion))
+			err = os.RemoveAll(blugeDir)
+			if err != nil {
+				log.Logger.Error("failed to remove index",
+					zap.String("path", blugeDir), zap.Error(err))
+				return false
+			}
+			makeInitialIndex = true
+		}
 	}
 	idx.Init(blugeDir)
+
+	watchCtx, cancelWatchCtx := context.WithCancel(context.Background())
+	defer cancelWatchCtx()
+
 	if makeInitialIndex {
 		log.Logger.Info("performing initial indexing, please wait")
-		err = idx.Initial()
+		stats, err := idx.Initial()
 		if err != nil {
 			log.Logger.Error("failed to create index", zap.Error(err))
 			return false
 		}
-		log.Logger.Info("created initial index")
+		log.Logger.Info("created initial index", zap.Int("added", stats.Added))
+		err = idx.WriteSchemaVersion(blugeDir)
+		if err != nil {
+			log.Logger.Error("failed to write index schema version", zap.Error(err))
+			return false
+		}
 	} else {
 		go func() {
 			log.Logger.Info("updating index")
-			err = idx.Update()
+			stats, err := idx.Update()
 			if err != nil {
 				log.Logger.Error("failed to update index", zap.Error(err))
 				return
 			}
-			log.Logger.Info("index updated")
+			log.Logger.Info("index updated",
+				zap.Int("added", stats.Added),
+				zap.Int("updated", stats.Updated),
+				zap.Int("removed", stats.Removed))
+		}()
+	}
+
+	if env.Env.Watch {
+		go func() {
+			err := idx.Watch(watchCtx)
+			if err != nil {
+				log.Logger.Error("failed to watch filesystem", zap.Error(err))
+			}
 		}()
 	}
 